@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Keys that are always indexed and cannot be removed at runtime
+var builtinKeys = map[string]bool{
+	"":      true,
+	"from":  true,
+	"to":    true,
+	flagKey: true,
+}
+
+// An indexed key, with the progress of indexing it in existing messages
+type jsonKey struct {
+	Header   string        `json:"header"`
+	Type     string        `json:"type"`
+	Backfill *jsonBackfill `json:"backfill,omitempty"`
+}
+
+type jsonBackfill struct {
+	Done     int       `json:"done"`
+	Total    int       `json:"total"`
+	Finished bool      `json:"finished"`
+	Started  time.Time `json:"started"`
+}
+
+func (h *httpHandler) jsonKey(key string, kt keyType) *jsonKey {
+	jk := &jsonKey{Header: key, Type: kt.String()}
+	if b := h.crawler.backfillOf(key); b != nil {
+		done, total := b.progress()
+		jk.Backfill = &jsonBackfill{
+			Done:     done,
+			Total:    total,
+			Finished: done == total,
+			Started:  b.started,
+		}
+	}
+	return jk
+}
+
+// List all indexed keys
+func (h *httpHandler) adminKeys() func(w http.ResponseWriter, r *http.Request) {
+	return h.handler(func(h *httpHandler, w http.ResponseWriter, r *http.Request) error {
+		if r.Method != "GET" {
+			http.Error(w, "Method not supported", 405)
+			return nil
+		}
+		keys := h.indexer.keys()
+		names := make([]string, 0, len(keys))
+		for k := range keys {
+			if k != "" {
+				names = append(names, k)
+			}
+		}
+		sort.Strings(names)
+
+		list := make([]*jsonKey, len(names))
+		for i, k := range names {
+			list[i] = h.jsonKey(k, keys[k])
+		}
+		w.Header().Set("Content-Type", "application/json")
+		return newJSONEncoder(w).Encode(list)
+	})
+}
+
+// Show, add or remove an indexed key. Values of an added key are indexed
+// in the background: GET shows the progress.
+func (h *httpHandler) adminKey() func(w http.ResponseWriter, r *http.Request) {
+	return h.handler(func(h *httpHandler, w http.ResponseWriter, r *http.Request) error {
+		key := strings.ToLower(mux.Vars(r)["header"])
+
+		switch r.Method {
+		case "GET":
+			keys := h.indexer.keys()
+			if !keys.has(key) {
+				return errNotFound
+			}
+			w.Header().Set("Content-Type", "application/json")
+			return newJSONEncoder(w).Encode(h.jsonKey(key, keys.keyType(key)))
+		case "PUT":
+			if err := validKey(key); err != nil {
+				http.Error(w, err.Error(), 400)
+				return nil
+			}
+			kt := keyTypeNormal
+			if t := r.URL.Query().Get("type"); t != "" {
+				var err error
+				if kt, err = parseKeyType(t); err != nil {
+					http.Error(w, err.Error(), 400)
+					return nil
+				}
+			}
+			if builtinKeys[key] && h.indexer.keys().keyType(key) != kt {
+				http.Error(w, "Type of this key cannot be changed", 400)
+				return nil
+			}
+			b := h.crawler.changeKeys(func(keys indexKey) indexKey {
+				keys = keys.copy()
+				keys.add(key, kt)
+				return keys
+			})
+			h.routes.refresh()
+
+			w.Header().Set("Content-Type", "application/json")
+			if b != nil {
+				w.WriteHeader(202)
+			}
+			return newJSONEncoder(w).Encode(h.jsonKey(key, kt))
+		case "DELETE":
+			if !h.indexer.keys().has(key) {
+				return errNotFound
+			}
+			if builtinKeys[key] {
+				http.Error(w, "This key cannot be removed", 400)
+				return nil
+			}
+			h.crawler.changeKeys(func(keys indexKey) indexKey {
+				keys = keys.copy()
+				delete(keys, key)
+				return keys
+			})
+			h.routes.refresh()
+			w.WriteHeader(204)
+			return nil
+		}
+		http.Error(w, "Method not supported", 405)
+		return nil
+	})
+}
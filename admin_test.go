@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminKey(t *testing.T) {
+	dir := testMaildir(t, map[string]string{
+		"cur/1500000001.M1P1.host:2,S": "Subject: one\nX-Test-Run: abc\n\nbody\n",
+		"cur/1500000002.M1P1.host:2,S": "Subject: two\nX-Test-Run: def\n\nbody\n",
+	})
+	defer os.RemoveAll(dir)
+	cache, c := testCrawler(t, dir)
+	c.scan()
+	go c.run(nil, nil)
+	router := newHttpRouter(newHttpHandler(nil, cache, newConfig(), c, c.indexer))
+	request := func(method, url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, url, nil))
+		return w
+	}
+	key := func(w *httptest.ResponseRecorder) *jsonKey {
+		var k jsonKey
+		if err := json.NewDecoder(w.Body).Decode(&k); err != nil {
+			t.Fatal(err)
+		}
+		return &k
+	}
+
+	if w := request("GET", "/admin/keys/x-test-run"); w.Code != 404 {
+		t.Error("expected an unknown key, got ", w.Code)
+	}
+	if w := request("GET", "/x-test-run/abc/latest/0"); w.Code != 404 {
+		t.Error("expected no route for the key, got ", w.Code)
+	}
+
+	// Known messages are indexed in the background
+	w := request("PUT", "/admin/keys/X-Test-Run?type=part")
+	if w.Code != 202 {
+		t.Fatal("expected the key to be backfilled, got ", w.Code)
+	}
+	if k := key(w); k.Header != "x-test-run" || k.Type != "part" || k.Backfill == nil || k.Backfill.Total != 2 {
+		t.Errorf("unexpected key %+v", k)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		w := request("GET", "/admin/keys/x-test-run")
+		if w.Code != 200 {
+			t.Fatal("expected the added key, got ", w.Code)
+		}
+		if k := key(w); k.Backfill == nil || k.Backfill.Finished {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("backfill not finished")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if w := request("GET", "/x-test-run/abc/latest/0"); w.Code != 200 || !strings.Contains(w.Body.String(), "Subject: one") {
+		t.Errorf("expected the first message, got %d %s", w.Code, w.Body)
+	}
+	if w := request("GET", "/x-test-run/de/latest/0"); w.Code != 200 || !strings.Contains(w.Body.String(), "Subject: two") {
+		t.Errorf("expected the second message by part of the value, got %d %s", w.Code, w.Body)
+	}
+
+	// Already indexed: nothing to backfill
+	if w := request("PUT", "/admin/keys/x-test-run?type=part"); w.Code != 200 {
+		t.Error("expected the key to be unchanged, got ", w.Code)
+	}
+
+	if w := request("DELETE", "/admin/keys/x-test-run"); w.Code != 204 {
+		t.Error("expected the key to be removed, got ", w.Code)
+	}
+	if w := request("GET", "/admin/keys/x-test-run"); w.Code != 404 {
+		t.Error("expected the key to be removed, got ", w.Code)
+	}
+	if w := request("GET", "/x-test-run/abc/latest/0"); w.Code != 404 {
+		t.Error("expected the route of the key to be removed, got ", w.Code)
+	}
+
+	for url, method := range map[string]string{
+		"/admin/keys/x%20test":          "PUT",
+		"/admin/keys/x-test?type=fuzzy": "PUT",
+		"/admin/keys/from?type=part":    "PUT",
+		"/admin/keys/from":              "DELETE",
+	} {
+		if w := request(method, url); w.Code != 400 {
+			t.Errorf("%s %s: expected 400, got %d", method, url, w.Code)
+		}
+	}
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	errAuthRequired = errors.New("Authentication required")
+	errAuthFailed   = errors.New("Authentication failed")
+)
+
+// What a client can do, as a set of bits
+type authPerm int
+
+const (
+	authRead authPerm = 1 << iota
+	authWrite
+	authDelete
+	authMetrics
+	authAdmin // Implies all the others
+)
+
+var authPermNames = map[string]authPerm{
+	"read":    authRead,
+	"write":   authWrite,
+	"delete":  authDelete,
+	"metrics": authMetrics,
+	"admin":   authAdmin,
+}
+
+// A client in the "auth" list of the configuration file. Exactly one of
+// Token, User (with the bcrypt hash of the password) or Cert must be set.
+type authEntry struct {
+	Token     string            `json:"token,omitempty"`
+	User      string            `json:"user,omitempty"`
+	Password  string            `json:"password,omitempty"`
+	Cert      string            `json:"cert,omitempty"` // Common name or DNS name of a client certificate
+	Perms     []string          `json:"perms"`
+	Mailboxes []string          `json:"mailboxes,omitempty"` // Patterns of mailbox names, for path.Match
+	Headers   map[string]string `json:"headers,omitempty"`   // Header to pattern of its values
+}
+
+// What an authenticated client is allowed to do
+type authGrant struct {
+	name      string
+	perms     authPerm
+	mailboxes []string
+	headers   map[string]string
+}
+
+func newAuthGrant(name string, e *authEntry) (*authGrant, error) {
+	g := &authGrant{
+		name:      name,
+		mailboxes: e.Mailboxes,
+		headers:   make(map[string]string),
+	}
+	if len(e.Perms) == 0 {
+		return nil, fmt.Errorf("%s: no perms", name)
+	}
+	for _, p := range e.Perms {
+		perm, found := authPermNames[strings.ToLower(p)]
+		if !found {
+			return nil, fmt.Errorf("%s: unknown perm %s", name, p)
+		}
+		g.perms |= perm
+	}
+	for _, m := range e.Mailboxes {
+		if _, err := path.Match(m, ""); err != nil {
+			return nil, fmt.Errorf("%s: %s: %v", name, m, err)
+		}
+	}
+	for h, v := range e.Headers {
+		if _, err := path.Match(v, ""); err != nil {
+			return nil, fmt.Errorf("%s: %s: %v", name, v, err)
+		}
+		g.headers[strings.ToLower(h)] = v
+	}
+	return g, nil
+}
+
+func (g *authGrant) allows(p authPerm) bool {
+	return g.perms&authAdmin != 0 || g.perms&p == p
+}
+
+// Whether the grant is limited to some mailboxes or some header values
+func (g *authGrant) restricted() bool {
+	return len(g.mailboxes) > 0 || len(g.headers) > 0
+}
+
+// Mailboxes allowed include their folders: "work" allows "work.Sent"
+func (g *authGrant) allowsMailbox(name string) bool {
+	if len(g.mailboxes) == 0 {
+		return true
+	}
+	for {
+		for _, m := range g.mailboxes {
+			if ok, _ := path.Match(m, name); ok {
+				return true
+			}
+		}
+		i := strings.LastIndexByte(name, '.')
+		if i <= 0 {
+			return false
+		}
+		name = name[:i]
+	}
+}
+
+func (g *authGrant) allowsValue(header, value string, kt keyType) bool {
+	pattern, found := g.headers[header]
+	if !found {
+		return false
+	}
+	if kt == keyTypeAddr {
+		pattern, value = strings.ToLower(pattern), strings.ToLower(value)
+	}
+	ok, _ := path.Match(pattern, value)
+	return ok
+}
+
+// A way to identify clients. A request without credentials for this
+// method gets no grant and no error.
+type authenticator interface {
+	authenticate(r *http.Request) (*authGrant, error)
+	login(user, password string) *authGrant // For mail clients, nil if not valid
+}
+
+// Static tokens sent as "Authorization: Bearer TOKEN"
+type tokenAuth struct {
+	tokens [][]byte
+	grants []*authGrant
+}
+
+func (a *tokenAuth) authenticate(r *http.Request) (*authGrant, error) {
+	h := r.Header.Get("Authorization")
+	if len(h) < 7 || !strings.EqualFold(h[:7], "Bearer ") {
+		return nil, nil
+	}
+	grant := a.check([]byte(strings.TrimSpace(h[7:])))
+	if grant == nil {
+		return nil, errAuthFailed
+	}
+	return grant, nil
+}
+
+// Mail clients send the token as password, with any user name
+func (a *tokenAuth) login(user, password string) *authGrant {
+	return a.check([]byte(password))
+}
+
+func (a *tokenAuth) check(token []byte) *authGrant {
+	// Compare with all tokens, to take the same time whichever matches
+	var grant *authGrant
+	for i, t := range a.tokens {
+		if subtle.ConstantTimeCompare(t, token) == 1 {
+			grant = a.grants[i]
+		}
+	}
+	return grant
+}
+
+// HTTP basic authentication with bcrypt hashes of the passwords
+type basicAuth struct {
+	hashes map[string][]byte
+	grants map[string]*authGrant
+
+	mu       sync.Mutex
+	verified map[[sha256.Size]byte]bool // Credentials already checked, bcrypt is slow on purpose
+}
+
+func (a *basicAuth) authenticate(r *http.Request) (*authGrant, error) {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, nil
+	}
+	grant := a.login(user, password)
+	if grant == nil {
+		return nil, errAuthFailed
+	}
+	return grant, nil
+}
+
+func (a *basicAuth) login(user, password string) *authGrant {
+	hash, found := a.hashes[user]
+	if !found {
+		return nil
+	}
+
+	sum := sha256.Sum256([]byte(user + "\x00" + password))
+	a.mu.Lock()
+	verified := a.verified[sum]
+	a.mu.Unlock()
+	if !verified {
+		if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil {
+			return nil
+		}
+		a.mu.Lock()
+		a.verified[sum] = true
+		a.mu.Unlock()
+	}
+	return a.grants[user]
+}
+
+// Client certificates verified by the TLS server, by common or DNS name
+type certAuth struct {
+	grants map[string]*authGrant
+}
+
+func (a *certAuth) authenticate(r *http.Request) (*authGrant, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, nil
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	names := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	for _, name := range names {
+		if grant, found := a.grants[name]; found {
+			return grant, nil
+		}
+	}
+	return nil, errAuthFailed
+}
+
+// Mail clients cannot be identified by certificate
+func (a *certAuth) login(user, password string) *authGrant {
+	return nil
+}
+
+// All the ways clients can authenticate. Without any, all requests are allowed.
+type auth struct {
+	methods []authenticator
+	basic   bool // Ask browsers for a password
+}
+
+func newAuth(entries []authEntry) (*auth, error) {
+	var (
+		tokens = &tokenAuth{}
+		basic  = &basicAuth{
+			hashes:   make(map[string][]byte),
+			grants:   make(map[string]*authGrant),
+			verified: make(map[[sha256.Size]byte]bool),
+		}
+		certs = &certAuth{grants: make(map[string]*authGrant)}
+	)
+	for i := range entries {
+		e := &entries[i]
+		switch {
+		case e.Token != "" && e.User == "" && e.Cert == "":
+			g, err := newAuthGrant(fmt.Sprintf("token %d", i+1), e)
+			if err != nil {
+				return nil, err
+			}
+			tokens.tokens = append(tokens.tokens, []byte(e.Token))
+			tokens.grants = append(tokens.grants, g)
+		case e.User != "" && e.Token == "" && e.Cert == "":
+			if _, err := bcrypt.Cost([]byte(e.Password)); err != nil {
+				return nil, fmt.Errorf("user %s: password must be a bcrypt hash: %v", e.User, err)
+			}
+			g, err := newAuthGrant("user "+e.User, e)
+			if err != nil {
+				return nil, err
+			}
+			basic.hashes[e.User] = []byte(e.Password)
+			basic.grants[e.User] = g
+		case e.Cert != "" && e.Token == "" && e.User == "":
+			g, err := newAuthGrant("cert "+e.Cert, e)
+			if err != nil {
+				return nil, err
+			}
+			certs.grants[e.Cert] = g
+		default:
+			return nil, fmt.Errorf("auth entry %d: set one of token, user or cert", i+1)
+		}
+	}
+
+	a := &auth{}
+	if len(tokens.tokens) > 0 {
+		a.methods = append(a.methods, tokens)
+	}
+	if len(basic.hashes) > 0 {
+		a.methods = append(a.methods, basic)
+		a.basic = true
+	}
+	if len(certs.grants) > 0 {
+		a.methods = append(a.methods, certs)
+	}
+	return a, nil
+}
+
+func (a *auth) enabled() bool {
+	return len(a.methods) > 0
+}
+
+// The grant of the client making a request
+func (a *auth) authenticate(r *http.Request) (*authGrant, error) {
+	for _, m := range a.methods {
+		grant, err := m.authenticate(r)
+		if err != nil || grant != nil {
+			return grant, err
+		}
+	}
+	return nil, errAuthRequired
+}
+
+// The grant of a mail client logging in with user and password. Without
+// authentication configured, there is no grant and any login is accepted.
+func (a *auth) login(user, password string) (*authGrant, error) {
+	if !a.enabled() {
+		return nil, nil
+	}
+	for _, m := range a.methods {
+		if grant := m.login(user, password); grant != nil {
+			return grant, nil
+		}
+	}
+	return nil, errAuthFailed
+}
+
+// Permission needed for a request to a route
+func requiredPerm(route, method string) authPerm {
+	switch {
+	case route == "/metrics":
+		return authMetrics
+	case strings.HasPrefix(route, "/admin/"):
+		return authAdmin
+	case isJMAPRoute(route):
+		// Methods that change messages check the permissions themselves
+		return authRead
+	}
+	switch method {
+	case "GET", "HEAD":
+		return authRead
+	case "DELETE":
+		return authDelete
+	}
+	if strings.HasSuffix(route, "/move") {
+		// Removes the message from where it was
+		return authWrite | authDelete
+	}
+	return authWrite
+}
+
+func isJMAPRoute(route string) bool {
+	return route == "/.well-known/jmap" || strings.HasPrefix(route, "/jmap/")
+}
+
+// Header selected by a route like "/to/{value}/latest/{selector}"
+func routeKey(route string) string {
+	parts := strings.Split(route, "/")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] == "{value}" {
+			return parts[i-1]
+		}
+	}
+	return ""
+}
+
+// Check that a request can be made by a client. Returns the status code
+// to reply with if not.
+func (h *httpHandler) authorize(r *http.Request, route string, vars map[string]string) (int, error) {
+	a := h.config.auth
+	if a == nil || !a.enabled() {
+		return 0, nil
+	}
+	grant, err := a.authenticate(r)
+	if err != nil {
+		return 401, err
+	}
+	if route == "" {
+		// Not found anyway
+		return 0, nil
+	}
+	if !grant.allows(requiredPerm(route, r.Method)) {
+		return 403, fmt.Errorf("%s: permission denied", grant.name)
+	}
+	if !grant.restricted() || route == "/help" {
+		return 0, nil
+	}
+	if isJMAPRoute(route) {
+		// Only the mailboxes of the client are shown
+		if len(grant.headers) > 0 {
+			return 403, fmt.Errorf("%s: clients restricted by headers cannot use JMAP", grant.name)
+		}
+		return 0, nil
+	}
+	if !h.inScope(grant, r, route, vars) {
+		return 403, fmt.Errorf("%s: not allowed for this mailbox or header", grant.name)
+	}
+	return 0, nil
+}
+
+// Whether a request only selects messages a restricted client can access:
+// the ones in its mailboxes, selected by one of its headers.
+func (h *httpHandler) inScope(grant *authGrant, r *http.Request, route string, vars map[string]string) bool {
+	if id, found := vars["id"]; found {
+		file, err := h.findMessage(id)
+		if err != nil {
+			// The handler replies that it is not found
+			return true
+		}
+		if to := r.URL.Query().Get("to"); to != "" && !grant.allowsMailbox(to) {
+			return false
+		}
+		return grant.allowsMailbox(file.folder) && h.allowsMessage(grant, file)
+	}
+
+	if len(grant.mailboxes) > 0 {
+		mailbox, found := vars["mailbox"]
+		if !found || !grant.allowsMailbox(mailbox) {
+			return false
+		}
+	}
+	if len(grant.headers) > 0 {
+		key := routeKey(route)
+		if key == "" {
+			return false
+		}
+		kt := h.indexer.keys().keyType(key)
+		// A substring would select messages with values not matching
+		if kt == keyTypePart {
+			return false
+		}
+		return grant.allowsValue(key, vars["value"], kt)
+	}
+	return true
+}
+
+// Whether a message has a value allowed for one of the headers of grant
+func (h *httpHandler) allowsMessage(grant *authGrant, file mailFile) bool {
+	if len(grant.headers) == 0 {
+		return true
+	}
+	msg, err := h.indexer.parseHeader(file.filename())
+	if err != nil {
+		return false
+	}
+	indexed := h.indexer.keys()
+	keys := makeIndexKeys()
+	for header := range grant.headers {
+		keys[header] = indexed.keyType(header)
+	}
+	for _, e := range keys.cacheEntries(file, msg) {
+		if grant.allowsValue(e.name, e.key, keys[e.name]) {
+			return true
+		}
+	}
+	return false
+}
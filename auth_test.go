@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAuthGrant(t *testing.T) {
+	g, err := newAuthGrant("test", &authEntry{
+		Perms:     []string{"read", "delete"},
+		Mailboxes: []string{"team-*"},
+		Headers:   map[string]string{"To": "*@Team-A.test"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !g.allows(authRead) || !g.allows(authDelete) || g.allows(authWrite) || g.allows(authWrite|authDelete) {
+		t.Errorf("unexpected perms %b", g.perms)
+	}
+	for name, ok := range map[string]bool{"team-a": true, "team-a.Sent": true, "other": false, "other.team-a": false} {
+		if g.allowsMailbox(name) != ok {
+			t.Errorf("mailbox %s: expected %v", name, ok)
+		}
+	}
+	if !g.allowsValue("to", "bob@team-a.test", keyTypeAddr) || g.allowsValue("to", "bob@team-b.test", keyTypeAddr) {
+		t.Error("unexpected match of addresses")
+	}
+	if g.allowsValue("from", "bob@team-a.test", keyTypeAddr) {
+		t.Error("header not in the grant allowed")
+	}
+
+	if _, err := newAuthGrant("test", &authEntry{Perms: []string{"root"}}); err == nil {
+		t.Error("unknown perm accepted")
+	}
+	if _, err := newAuth([]authEntry{{Token: "x", User: "y", Perms: []string{"read"}}}); err == nil {
+		t.Error("entry with token and user accepted")
+	}
+	if _, err := newAuth([]authEntry{{User: "y", Password: "plain", Perms: []string{"read"}}}); err == nil {
+		t.Error("password that is not a bcrypt hash accepted")
+	}
+}
+
+func TestAuthToken(t *testing.T) {
+	a, err := newAuth([]authEntry{{Token: "secret", Perms: []string{"admin"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _ := http.NewRequest("GET", "/latest/0", nil)
+	if _, err := a.authenticate(r); err != errAuthRequired {
+		t.Errorf("expected %v, got %v", errAuthRequired, err)
+	}
+	r.Header.Set("Authorization", "Bearer wrong")
+	if _, err := a.authenticate(r); err != errAuthFailed {
+		t.Errorf("expected %v, got %v", errAuthFailed, err)
+	}
+	r.Header.Set("Authorization", "Bearer secret")
+	if g, err := a.authenticate(r); err != nil || !g.allows(authDelete) {
+		t.Errorf("token not accepted: %v", err)
+	}
+}
+
+func TestRequiredPerm(t *testing.T) {
+	tests := []struct {
+		route, method string
+		perm          authPerm
+	}{
+		{"/latest/{selector}", "GET", authRead},
+		{"/to/{value}/latest/{selector}", "DELETE", authDelete},
+		{"/msg/{id}", "PATCH", authWrite},
+		{"/msg/{id}/move", "POST", authWrite | authDelete},
+		{"/admin/keys/{header}", "GET", authAdmin},
+		{"/metrics", "GET", authMetrics},
+	}
+	for _, test := range tests {
+		if p := requiredPerm(test.route, test.method); p != test.perm {
+			t.Errorf("%s %s: expected %b, got %b", test.method, test.route, test.perm, p)
+		}
+	}
+	if k := routeKey("/mbox/{mailbox}/to/{value}/wait"); k != "to" {
+		t.Errorf("unexpected key %q", k)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"net/mail"
 	"sort"
 	"strings"
+	"time"
 )
 
 type cacheString map[string]mailFiles
@@ -14,23 +15,120 @@ type caches struct {
 	mailCh    chan cacheMail
 	listCh    chan *cacheListRequest
 	requestCh chan *cacheRequest
-	addCh     chan cacheEntry
+	findCh    chan *cacheFindRequest
+	mboxCh    chan *cacheMailboxesRequest
+	threadsCh chan *cacheThreadsRequest
+	waitCh    chan *cacheWait
+	cancelCh  chan *cacheWait
+	addCh     chan cacheMessage
 	removeCh  chan mailFiles
+	subCh     chan *cacheSubscriber
+	unsubCh   chan *cacheSubscriber
+	dumpCh    chan chan map[mailFile]cacheFile
+	keysCh    chan *cacheKeys
+	extendCh  chan cacheMessage
+	statsCh   chan *cacheStatsRequest
+	uidsCh    chan *cacheUIDRequest
+	changesCh chan *cacheChangesRequest
+	serial    uint64
+	epoch     uint32 // Serials and event ids are valid from this time until restarted
+	files     map[mailFile]*cacheFile
+	waiters   map[*cacheWait]struct{}
+	events    *cacheEvents
+	body      *bodyIndex
+	dates     *dateIndex
+	threads   *threadIndex
+	ids       map[string]mailFile
+}
+
+// What is known about each indexed message
+type cacheFile struct {
+	serial  uint64
+	entries []cacheEntry
+	body    []string
+	thread  threadRef
 }
 
 type cacheRequest struct {
-	header string
-	value  string
-	index  int
-	limit  int
-	oldest bool
-	match  keyType
-	data   chan mailFiles
+	mailbox string
+	header  string
+	value   string
+	index   int
+	limit   int
+	oldest  bool
+	match   keyType
+	query   searchNode // Select with a query instead of matching header and value
+	thread  string     // Select the messages of a thread instead
+	unread  bool       // Only messages without the seen flag
+	since   time.Time
+	until   time.Time
+	data    chan mailFiles
 }
 
 type cacheListRequest struct {
-	header string
-	data   chan []string
+	mailbox string
+	header  string
+	days    bool // List days with messages instead of header values
+	since   time.Time
+	until   time.Time
+	data    chan []string
+}
+
+// Number of messages in each mailbox
+type cacheMailboxesRequest struct {
+	data chan map[string]int
+}
+
+// Threads with messages, or the threads of some messages
+type cacheThreadsRequest struct {
+	mailbox string
+	since   time.Time
+	until   time.Time
+	files   mailFiles
+	data    chan []threadSummary
+}
+
+// How much each key is used
+type cacheStatsRequest struct {
+	data chan map[string]cacheKeyStats
+}
+
+type cacheKeyStats struct {
+	messages int // With at least one value
+	values   int
+}
+
+// Messages of a mailbox with their serial numbers, in the order they were indexed
+type cacheUIDRequest struct {
+	mailbox string
+	query   searchNode // Only the messages matching it, if set
+	data    chan *cacheUIDs
+}
+
+type cacheUID struct {
+	uid  uint64
+	file mailFile
+}
+
+type cacheUIDs struct {
+	files []cacheUID
+	next  uint64 // Serial of the next message indexed
+}
+
+// Events after a state of the caches, the id of the last event emitted
+type cacheChangesRequest struct {
+	since uint64
+	data  chan *cacheChanges
+}
+
+type cacheChanges struct {
+	events []*cacheEvent // Nil if they are not all in the history anymore
+	state  uint64
+}
+
+type cacheFindRequest struct {
+	id   string
+	data chan mailFile
 }
 
 type cacheEntry struct {
@@ -39,6 +137,41 @@ type cacheEntry struct {
 	value mailFile
 }
 
+// All index entries of one message
+type cacheMessage struct {
+	file    mailFile
+	entries []cacheEntry
+	body    []string // Words in the body, if indexed
+	thread  threadRef
+	prev    *mailFile // Indexed file this message replaces, if any
+}
+
+// Change of the indexed keys: values of removed keys are dropped,
+// added keys are filled in later with extendCh.
+type cacheKeys struct {
+	added   indexKey
+	removed indexKey
+}
+
+// Request to be notified when a matching message is indexed after cursor.
+type cacheWait struct {
+	mailbox string
+	header  string
+	value   string
+	match   keyType
+	since   time.Time
+	until   time.Time
+	after   uint64
+	latest  bool // Ignore after, wait for messages indexed from now
+	data    chan cacheWaitResult
+}
+
+type cacheWaitResult struct {
+	file   mailFile
+	found  bool
+	cursor uint64
+}
+
 type cacheMail struct {
 	id      mailFile
 	headers mail.Header
@@ -56,16 +189,83 @@ func newCacheListRequest() *cacheListRequest {
 	}
 }
 
-func newCaches(indexer *mailIndexer, root string) *caches {
+func newCacheThreadsRequest() *cacheThreadsRequest {
+	return &cacheThreadsRequest{
+		data: make(chan []threadSummary),
+	}
+}
+
+func newCacheFindRequest(id string) *cacheFindRequest {
+	return &cacheFindRequest{
+		id:   id,
+		data: make(chan mailFile),
+	}
+}
+
+func newCacheMailboxesRequest() *cacheMailboxesRequest {
+	return &cacheMailboxesRequest{
+		data: make(chan map[string]int),
+	}
+}
+
+func newCacheStatsRequest() *cacheStatsRequest {
+	return &cacheStatsRequest{
+		data: make(chan map[string]cacheKeyStats),
+	}
+}
+
+func newCacheUIDRequest(mailbox string) *cacheUIDRequest {
+	return &cacheUIDRequest{
+		mailbox: mailbox,
+		data:    make(chan *cacheUIDs),
+	}
+}
+
+func newCacheChangesRequest(since uint64) *cacheChangesRequest {
+	return &cacheChangesRequest{
+		since: since,
+		data:  make(chan *cacheChanges),
+	}
+}
+
+func newCacheWait() *cacheWait {
+	return &cacheWait{
+		// Exactly one result is sent for each wait
+		data: make(chan cacheWaitResult, 1),
+	}
+}
+
+func newCaches(indexer *mailIndexer) *caches {
 	c := &caches{
 		indexer:   indexer,
 		data:      make(map[string]cacheString),
 		listCh:    make(chan *cacheListRequest),
 		requestCh: make(chan *cacheRequest),
-		addCh:     make(chan cacheEntry),
+		findCh:    make(chan *cacheFindRequest),
+		mboxCh:    make(chan *cacheMailboxesRequest),
+		threadsCh: make(chan *cacheThreadsRequest),
+		waitCh:    make(chan *cacheWait),
+		cancelCh:  make(chan *cacheWait),
+		addCh:     make(chan cacheMessage),
 		removeCh:  make(chan mailFiles),
+		subCh:     make(chan *cacheSubscriber),
+		unsubCh:   make(chan *cacheSubscriber),
+		dumpCh:    make(chan chan map[mailFile]cacheFile),
+		keysCh:    make(chan *cacheKeys),
+		extendCh:  make(chan cacheMessage),
+		statsCh:   make(chan *cacheStatsRequest),
+		uidsCh:    make(chan *cacheUIDRequest),
+		changesCh: make(chan *cacheChangesRequest),
+		epoch:     uint32(time.Now().Unix()),
+		files:     make(map[mailFile]*cacheFile),
+		waiters:   make(map[*cacheWait]struct{}),
+		events:    newCacheEvents(),
+		body:      newBodyIndex(),
+		dates:     newDateIndex(),
+		threads:   newThreadIndex(),
+		ids:       make(map[string]mailFile),
 	}
-	for i := range indexer.keys {
+	for i := range indexer.keys() {
 		c.initCachesString(i)
 	}
 
@@ -76,23 +276,157 @@ func (c *caches) initCachesString(name string) {
 	c.data[name] = make(map[string]mailFiles)
 }
 
-func (c *caches) add(entry cacheEntry) {
-	name, key, value := entry.name, entry.key, entry.value
+func (c *caches) add(msg cacheMessage) {
+	prev := msg.file
+	if msg.prev != nil {
+		prev = *msg.prev
+	}
+	cf, known := c.files[prev]
+	if known {
+		c.unindex(prev, cf)
+		c.dates.remove(mailFiles{prev})
+		delete(c.files, prev)
+		c.files[msg.file] = cf
+		// Serials of the messages of a mailbox only grow, as IMAP UIDs must
+		if prev.folder != msg.file.folder {
+			c.serial++
+			cf.serial = c.serial
+		}
+	} else {
+		c.serial++
+		cf = &cacheFile{serial: c.serial}
+		c.files[msg.file] = cf
+	}
+	cf.entries = msg.entries
+	cf.body = msg.body
+	c.body.add(msg.file, msg.body)
+	c.dates.add(msg.file)
+	c.ids[msg.file.id()] = msg.file
+	cf.thread = msg.thread
+	c.threads.add(msg.file, msg.thread)
+
+	for _, entry := range msg.entries {
+		name, key, value := entry.name, entry.key, entry.value
+
+		if _, found := c.data[name][key]; !found {
+			c.data[name][key] = newMailFiles()
+		}
 
-	if _, found := c.data[name][key]; !found {
-		c.data[name][key] = newMailFiles()
+		c.data[name][key] = append(c.data[name][key], value)
 	}
 
-	c.data[name][key] = append(c.data[name][key], value)
+	if known {
+		c.events.emit(cacheEventUpdated, msg.file, cf.entries)
+		return
+	}
+	c.events.emit(cacheEventAdded, msg.file, cf.entries)
+	c.notifyWaiters(msg)
+}
+
+// Remove file from all the values it is indexed under, except the dates
+func (c *caches) unindex(file mailFile, cf *cacheFile) {
+	c.body.remove(file, cf.body)
+	if c.ids[file.id()] == file {
+		delete(c.ids, file.id())
+	}
+	c.threads.remove(file)
+
+	for _, e := range cf.entries {
+		files, found := c.data[e.name][e.key]
+		if !found {
+			continue
+		}
+		files = files.diff(mailFiles{file})
+		if len(files) == 0 {
+			delete(c.data[e.name], e.key)
+			continue
+		}
+		c.data[e.name][e.key] = files
+	}
 }
 
 func (c *caches) remove(files mailFiles) {
-	for name := range c.data {
-		for k := range c.data[name] {
-			sort.Sort(c.data[name][k])
-			c.data[name][k] = c.data[name][k].diff(files)
+	removed := newMailFiles()
+	for _, f := range files {
+		cf, found := c.files[f]
+		if !found {
+			continue
 		}
+		c.unindex(f, cf)
+		delete(c.files, f)
+		removed = append(removed, f)
+		c.events.emit(cacheEventRemoved, f, cf.entries)
 	}
+	c.dates.remove(removed)
+}
+
+func (e cacheEntry) matches(header, value string, match keyType) bool {
+	if e.name != header {
+		return false
+	}
+	switch match {
+	case keyTypeAddr:
+		return e.key == strings.ToLower(value)
+	case keyTypePart:
+		return strings.Contains(e.key, value)
+	}
+	return e.key == value
+}
+
+func (c *caches) notifyWaiters(msg cacheMessage) {
+	serial := c.files[msg.file].serial
+
+	for w := range c.waiters {
+		if serial <= w.after {
+			continue
+		}
+		if w.mailbox != "" && w.mailbox != msg.file.folder {
+			continue
+		}
+		if !msg.file.between(w.since, w.until) {
+			continue
+		}
+		for _, e := range msg.entries {
+			if e.matches(w.header, w.value, w.match) {
+				w.data <- cacheWaitResult{file: msg.file, found: true, cursor: serial}
+				delete(c.waiters, w)
+				break
+			}
+		}
+	}
+}
+
+func (c *caches) wait(w *cacheWait) {
+	if w.latest {
+		w.after = c.serial
+	}
+
+	// Maybe a matching message was already indexed: return the first one after the cursor
+	var (
+		first  mailFile
+		serial uint64
+	)
+	for _, f := range c.match(w.header, w.value, w.match).inMailbox(w.mailbox).between(w.since, w.until) {
+		s := c.files[f].serial
+		if s > w.after && (serial == 0 || s < serial) {
+			first, serial = f, s
+		}
+	}
+	if serial > 0 {
+		w.data <- cacheWaitResult{file: first, found: true, cursor: serial}
+		return
+	}
+
+	c.waiters[w] = struct{}{}
+}
+
+func (c *caches) cancel(w *cacheWait) {
+	// Already got its result
+	if _, found := c.waiters[w]; !found {
+		return
+	}
+	delete(c.waiters, w)
+	w.data <- cacheWaitResult{cursor: c.serial}
 }
 
 func (c *caches) match(header, value string, match keyType) mailFiles {
@@ -124,14 +458,44 @@ func (c *caches) match(header, value string, match keyType) mailFiles {
 	return results
 }
 
+// Messages matching query, dated from since and before until
+func (c *caches) search(query searchNode, since, until time.Time) mailFiles {
+	all := make(fileSet)
+	if since.IsZero() && until.IsZero() {
+		for f := range c.files {
+			all[f] = struct{}{}
+		}
+	} else {
+		for _, f := range c.dates.between(since, until) {
+			all[f] = struct{}{}
+		}
+	}
+	return query.eval(c, all).files().between(since, until)
+}
+
 func (c *caches) request(r *cacheRequest) {
-	c.requestCh <- r
+	metrics.cacheSend("request", func() { c.requestCh <- r })
 }
 
 func (c *caches) respond(r *cacheRequest) {
 	defer close(r.data)
 
-	files := c.match(r.header, r.value, r.match)
+	var files mailFiles
+	switch {
+	case r.query != nil:
+		files = c.search(r.query, r.since, r.until)
+	case r.thread != "":
+		files = c.threads.messages(r.thread).between(r.since, r.until)
+	case r.header == "" && !(r.since.IsZero() && r.until.IsZero()):
+		// All messages in a time range, without looking at the others
+		files = c.dates.between(r.since, r.until)
+	default:
+		files = c.match(r.header, r.value, r.match).between(r.since, r.until)
+	}
+	files = files.inMailbox(r.mailbox)
+	if r.unread {
+		files = files.unread()
+	}
 	lfiles := len(files)
 	if lfiles == 0 {
 		return
@@ -166,21 +530,172 @@ func (c *caches) respond(r *cacheRequest) {
 func (c *caches) list(r *cacheListRequest) {
 	defer close(r.data)
 
+	if r.days {
+		r.data <- c.dates.between(r.since, r.until).days(r.mailbox)
+		return
+	}
+
 	values, found := c.data[r.header]
 	if !found {
 		return
 	}
 
-	keys := make([]string, len(values))
-	i := 0
-	for k := range values {
-		keys[i] = k
-		i = i + 1
+	keys := make([]string, 0, len(values))
+	for k, files := range values {
+		if len(files.inMailbox(r.mailbox).between(r.since, r.until)) == 0 {
+			continue
+		}
+		keys = append(keys, k)
 	}
 
 	r.data <- keys
 }
 
+func (c *caches) mailboxes(r *cacheMailboxesRequest) {
+	counts := make(map[string]int)
+	for f := range c.files {
+		counts[f.folder]++
+	}
+	r.data <- counts
+}
+
+func (c *caches) listThreads(r *cacheThreadsRequest) {
+	defer close(r.data)
+
+	if r.files == nil {
+		r.data <- c.threads.list(r.mailbox, r.since, r.until)
+		return
+	}
+
+	threads := make([]threadSummary, len(r.files))
+	for i, f := range r.files {
+		threads[i].ID, _ = c.threads.thread(f)
+	}
+	r.data <- threads
+}
+
+func (c *caches) find(r *cacheFindRequest) {
+	defer close(r.data)
+
+	// File names with flags are accepted too
+	if f, found := c.ids[maildirUnique(r.id)]; found {
+		r.data <- f
+	}
+}
+
+// Copy what is known about all files. Entries and words are never
+// modified after being added, so they can be shared.
+func (c *caches) dump(data chan map[mailFile]cacheFile) {
+	files := make(map[mailFile]cacheFile, len(c.files))
+	for f, cf := range c.files {
+		files[f] = *cf
+	}
+	data <- files
+}
+
+func (c *caches) stats(r *cacheStatsRequest) {
+	stats := make(map[string]cacheKeyStats, len(c.data))
+	for name, values := range c.data {
+		if name != "" {
+			stats[name] = cacheKeyStats{values: len(values)}
+		}
+	}
+	seen := make(map[string]bool)
+	for _, cf := range c.files {
+		for _, e := range cf.entries {
+			if e.name == "" || seen[e.name] {
+				continue
+			}
+			seen[e.name] = true
+			s := stats[e.name]
+			s.messages++
+			stats[e.name] = s
+		}
+		for name := range seen {
+			delete(seen, name)
+		}
+	}
+	r.data <- stats
+}
+
+func (c *caches) uids(r *cacheUIDRequest) {
+	all := make(fileSet)
+	for f := range c.files {
+		if f.folder == r.mailbox {
+			all[f] = struct{}{}
+		}
+	}
+	if r.query != nil {
+		all = r.query.eval(c, all)
+	}
+
+	files := make([]cacheUID, 0, len(all))
+	for f := range all {
+		// Nodes could select messages of other mailboxes too
+		if f.folder == r.mailbox {
+			files = append(files, cacheUID{uid: c.files[f].serial, file: f})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].uid < files[j].uid })
+	r.data <- &cacheUIDs{files: files, next: c.serial + 1}
+}
+
+func (c *caches) changes(r *cacheChangesRequest) {
+	var events []*cacheEvent
+	if since := c.events.since(r.since); since != nil {
+		events = make([]*cacheEvent, len(since))
+		copy(events, since)
+	}
+	r.data <- &cacheChanges{events: events, state: c.events.lastID}
+}
+
+func (c *caches) setKeys(k *cacheKeys) {
+	for name := range k.removed {
+		delete(c.data, name)
+	}
+	if len(k.removed) > 0 {
+		for _, cf := range c.files {
+			entries := make([]cacheEntry, 0, len(cf.entries))
+			for _, e := range cf.entries {
+				if _, found := k.removed[e.name]; !found {
+					entries = append(entries, e)
+				}
+			}
+			cf.entries = entries
+		}
+	}
+	for name := range k.added {
+		c.initCachesString(name)
+	}
+}
+
+// Add entries of keys added after msg.file was indexed. Entries that the
+// file already has, because it was indexed again meanwhile, are skipped.
+func (c *caches) extend(msg cacheMessage) {
+	cf, found := c.files[msg.file]
+	if !found {
+		return
+	}
+	known := make(map[cacheEntry]bool, len(cf.entries))
+	for _, e := range cf.entries {
+		known[e] = true
+	}
+	entries := make([]cacheEntry, len(cf.entries), len(cf.entries)+len(msg.entries))
+	copy(entries, cf.entries)
+	for _, e := range msg.entries {
+		if known[e] {
+			continue
+		}
+		if _, found := c.data[e.name]; !found {
+			continue
+		}
+		known[e] = true
+		entries = append(entries, e)
+		c.data[e.name][e.key] = append(c.data[e.name][e.key], e.value)
+	}
+	cf.entries = entries
+}
+
 func (c *caches) run() {
 	for {
 		select {
@@ -188,10 +703,36 @@ func (c *caches) run() {
 			c.list(r)
 		case r := <-c.requestCh:
 			c.respond(r)
-		case entry := <-c.addCh:
-			c.add(entry)
+		case r := <-c.findCh:
+			c.find(r)
+		case r := <-c.mboxCh:
+			c.mailboxes(r)
+		case r := <-c.threadsCh:
+			c.listThreads(r)
+		case r := <-c.waitCh:
+			c.wait(r)
+		case r := <-c.cancelCh:
+			c.cancel(r)
+		case msg := <-c.addCh:
+			c.add(msg)
 		case files := <-c.removeCh:
 			c.remove(files)
+		case s := <-c.subCh:
+			c.subscribe(s)
+		case s := <-c.unsubCh:
+			c.unsubscribe(s)
+		case data := <-c.dumpCh:
+			c.dump(data)
+		case k := <-c.keysCh:
+			c.setKeys(k)
+		case msg := <-c.extendCh:
+			c.extend(msg)
+		case r := <-c.statsCh:
+			c.stats(r)
+		case r := <-c.uidsCh:
+			c.uids(r)
+		case r := <-c.changesCh:
+			c.changes(r)
 		}
 	}
 }
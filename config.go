@@ -1,8 +1,12 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"flag"
+	"fmt"
+	"log"
+	"os"
 	"strings"
 	"time"
 )
@@ -36,12 +40,57 @@ func (s *stringSlice) Set(n string) error {
 	return nil
 }
 
+// Settings that can be in the file passed with -config. Command line
+// flags take precedence; keys from both are indexed.
+type configFile struct {
+	Listen    string            `json:"listen"`
+	Agent     string            `json:"agent"`
+	Interval  string            `json:"interval"`
+	Keys      map[string]string `json:"keys"`      // Header name to "normal", "addr" or "part"
+	Mailboxes []string          `json:"mailboxes"` // "path" or "name=path", if none on the command line
+	Auth      []authEntry       `json:"auth"`      // Clients allowed, all if none
+}
+
+func readConfigFile(name string) (*configFile, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cf := &configFile{}
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cf); err != nil {
+		return nil, err
+	}
+	return cf, nil
+}
+
 type config struct {
-	keys     indexKey
-	listen   string
-	root     string
-	agent    string
-	interval duration
+	file      string
+	cmdline   *config // As set by the command line, to load the file again
+	flagKeys  indexKey
+	roots     []string
+	set       map[string]bool // Flags given on the command line
+	keys      indexKey
+	listen    string
+	mailboxes mailboxes
+	agent     string
+	interval  duration
+	smtp      string
+	smtpCert  string
+	smtpKey   string
+	imap      string
+	pop3      string
+	tlsCert   string
+	tlsKey    string
+	tlsCA     string
+	redirect  string
+	index     string
+	body      bool
+	retention *retention
+	auth      *auth
 }
 
 func newConfig() *config {
@@ -49,12 +98,23 @@ func newConfig() *config {
 	keys.add("", keyTypeNormal)
 	keys.add("from", keyTypeAddr)
 	keys.add("to", keyTypeAddr)
+	keys.add(flagKey, keyTypeNormal)
 
 	return &config{
-		keys:     keys,
-		root:     ".",
-		interval: duration(2 * time.Second),
+		keys:      keys,
+		interval:  duration(2 * time.Second),
+		retention: newRetention(),
+	}
+}
+
+// Add a key from a flag or from the configuration file
+func (c *config) addKey(key string, kt keyType) error {
+	key = strings.TrimSpace(key)
+	if err := validKey(key); err != nil {
+		return err
 	}
+	c.keys.add(key, kt)
+	return nil
 }
 
 func (c *config) parseFlags() {
@@ -67,18 +127,128 @@ func (c *config) parseFlags() {
 	flag.Var(&c.interval, "i", "Interval between runs of the crawler")
 	flag.StringVar(&c.listen, "s", "0.0.0.0:8888", "Where to listen from (default: 0.0.0.0:8888)")
 	flag.StringVar(&c.agent, "a", "MAILER-DAEMON-PERSO", "What to write after 'From ' in mbox format")
+	flag.StringVar(&c.smtp, "smtp", "", "Accept mail via SMTP on this address (eg: :2525)")
+	flag.StringVar(&c.smtpCert, "smtp-cert", "", "Certificate file to support STARTTLS in SMTP")
+	flag.StringVar(&c.smtpKey, "smtp-key", "", "Key file of the STARTTLS certificate")
+	flag.StringVar(&c.imap, "imap", "", "Serve the mailboxes read-only via IMAP on this address (eg: :1143)")
+	flag.StringVar(&c.pop3, "pop3", "", "Serve a mailbox via POP3 on this address (eg: :1110)")
+	flag.StringVar(&c.tlsCert, "tls-cert", "", "Serve HTTPS with this certificate file, loaded again when it changes")
+	flag.StringVar(&c.tlsKey, "tls-key", "", "Key file of the HTTPS certificate")
+	flag.StringVar(&c.tlsCA, "tls-client-ca", "", "Accept client certificates signed by the CAs in this file")
+	flag.StringVar(&c.redirect, "http-redirect", "", "Redirect plain HTTP requests on this address to HTTPS (eg: :80)")
+	flag.StringVar(&c.index, "index", "", "File where to save the index (default: next to the Maildir, empty to disable)")
+	flag.BoolVar(&c.body, "body", false, "Index the text in the body of messages for searching")
+	flag.Var(&retentionFlag{c.retention, setRetentionAge}, "retain", "Delete messages older than this (eg: 72h, or work=72h for one mailbox)")
+	flag.Var(&retentionFlag{c.retention, setRetentionMessages}, "max-messages", "Delete the oldest messages over this number (eg: 50000, or work=50000)")
+	flag.Var(&retentionFlag{c.retention, setRetentionBytes}, "max-bytes", "Delete the oldest messages over this size (eg: 2G, or work=2G)")
+	flag.StringVar(&c.retention.archive, "archive", "", "Save the messages deleted by -retain, -max-messages or -max-bytes in this directory")
+	flag.StringVar(&c.file, "config", "", "JSON configuration file, loaded again on SIGHUP")
 	flag.Parse()
 
-	// TODO: All these should be "normalized" and validated!
-	for i := range headers {
-		c.keys.add(headers[i], keyTypeNormal)
+	c.set = make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		c.set[f.Name] = true
+	})
+
+	c.flagKeys = makeIndexKeys()
+	for _, k := range headers {
+		c.flagKeys[k] = keyTypeNormal
 	}
-	for i := range addrs {
-		c.keys.add(addrs[i], keyTypeAddr)
+	for _, k := range addrs {
+		c.flagKeys[k] = keyTypeAddr
 	}
-	for i := range parts {
-		c.keys.add(parts[i], keyTypePart)
+	for _, k := range parts {
+		c.flagKeys[k] = keyTypePart
 	}
+	c.roots = flag.Args()
 
-	c.root = flag.Arg(0)
+	if (c.tlsCert == "") != (c.tlsKey == "") {
+		log.Fatal("-tls-cert and -tls-key must be used together")
+	}
+	if c.tlsCert == "" && (c.tlsCA != "" || c.redirect != "") {
+		log.Fatal("-tls-client-ca and -http-redirect need -tls-cert and -tls-key")
+	}
+
+	cmdline := *c
+	c.cmdline = &cmdline
+	c.keys = c.keys.copy()
+	if err := c.load(); err != nil {
+		log.Fatal(err)
+	}
+	c.retention.agent = c.agent
+}
+
+// Apply the configuration file, if any, then the command line
+func (c *config) load() error {
+	roots := c.roots
+	var auth []authEntry
+	if c.file != "" {
+		cf, err := readConfigFile(c.file)
+		if err != nil {
+			return fmt.Errorf("%s: %v", c.file, err)
+		}
+		if cf.Listen != "" && !c.set["s"] {
+			c.listen = cf.Listen
+		}
+		if cf.Agent != "" && !c.set["a"] {
+			c.agent = cf.Agent
+		}
+		if cf.Interval != "" && !c.set["i"] {
+			if err := c.interval.Set(cf.Interval); err != nil {
+				return fmt.Errorf("%s: interval: %v", c.file, err)
+			}
+		}
+		for k, t := range cf.Keys {
+			kt, err := parseKeyType(t)
+			if err != nil {
+				return fmt.Errorf("%s: %s: %v", c.file, k, err)
+			}
+			if err := c.addKey(k, kt); err != nil {
+				return fmt.Errorf("%s: %v", c.file, err)
+			}
+		}
+		if len(roots) == 0 {
+			roots = cf.Mailboxes
+		}
+		auth = cf.Auth
+	}
+	a, err := newAuth(auth)
+	if err != nil {
+		return fmt.Errorf("%s: %v", c.file, err)
+	}
+	c.auth = a
+	for k, kt := range c.flagKeys {
+		if err := c.addKey(k, kt); err != nil {
+			return err
+		}
+	}
+	if c.interval < 0 {
+		return errors.New("Negative interval")
+	}
+
+	if len(roots) == 0 {
+		roots = []string{"."}
+	}
+	for _, root := range roots {
+		if err := c.mailboxes.add(root); err != nil {
+			return err
+		}
+	}
+
+	if !c.set["index"] {
+		c.index = defaultIndexFile(c.mailboxes[0].path)
+	}
+	return nil
+}
+
+// Load the configuration file again
+func (c *config) reload() (*config, error) {
+	n := *c.cmdline
+	n.cmdline = c.cmdline
+	n.keys = c.cmdline.keys.copy()
+	n.mailboxes = nil
+	if err := n.load(); err != nil {
+		return nil, err
+	}
+	return &n, nil
 }
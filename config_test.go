@@ -0,0 +1,136 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Configuration as parseFlags leaves it, with only -config given
+func testConfig(file string) *config {
+	c := newConfig()
+	c.file = file
+	c.set = make(map[string]bool)
+	c.flagKeys = makeIndexKeys()
+	cmdline := *c
+	c.cmdline = &cmdline
+	c.keys = c.keys.copy()
+	return c
+}
+
+func writeTestConfig(t *testing.T, file, data string) {
+	if err := ioutil.WriteFile(file, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "perso-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "perso.json")
+
+	writeTestConfig(t, file, `{
+		"listen": "127.0.0.1:9999",
+		"agent": "TEST",
+		"interval": "5s",
+		"keys": {"Subject": "part", "X-Test": "addr"},
+		"mailboxes": ["work=`+dir+`"],
+		"auth": [{"token": "secret", "perms": ["read"]}]
+	}`)
+	c := testConfig(file)
+	if err := c.load(); err != nil {
+		t.Fatal(err)
+	}
+	if c.listen != "127.0.0.1:9999" || c.agent != "TEST" || time.Duration(c.interval) != 5*time.Second {
+		t.Error("Unexpected settings ", c.listen, c.agent, c.interval)
+	}
+	if c.keys.keyType("subject") != keyTypePart || c.keys.keyType("x-test") != keyTypeAddr || !c.keys.has("from") {
+		t.Error("Unexpected keys ", c.keys)
+	}
+	if len(c.mailboxes) != 1 || c.mailboxes[0].name != "work" || c.mailboxes[0].path != dir {
+		t.Error("Unexpected mailboxes ", c.mailboxes)
+	}
+	if !c.auth.enabled() {
+		t.Error("Clients not loaded")
+	}
+
+	// The command line takes precedence
+	c = testConfig(file)
+	c.listen = ":8888"
+	c.set["s"] = true
+	c.cmdline.listen, c.cmdline.set = c.listen, c.set
+	if err := c.load(); err != nil {
+		t.Fatal(err)
+	}
+	if c.listen != ":8888" {
+		t.Error("Listen address of the command line replaced by ", c.listen)
+	}
+
+	for name, data := range map[string]string{
+		"syntax":           `{"listen": `,
+		"unknown field":    `{"listne": ":80"}`,
+		"interval":         `{"interval": "soon"}`,
+		"negative":         `{"interval": "-1s"}`,
+		"key type":         `{"keys": {"Subject": "fuzzy"}}`,
+		"key name":         `{"keys": {"X Test": "normal"}}`,
+		"reserved key":     `{"keys": {"latest": "normal"}}`,
+		"client":           `{"auth": [{"token": "secret"}]}`,
+		"mailbox name":     `{"mailboxes": ["a/b=` + dir + `"]}`,
+		"mailbox repeated": `{"mailboxes": ["` + dir + `", "` + dir + `"]}`,
+	} {
+		writeTestConfig(t, file, data)
+		if err := testConfig(file).load(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestConfigReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "perso-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "perso.json")
+
+	writeTestConfig(t, file, `{"keys": {"Subject": "normal", "X-Old": "normal"}, "mailboxes": ["`+dir+`"]}`)
+	current := testConfig(file)
+	if err := current.load(); err != nil {
+		t.Fatal(err)
+	}
+	indexer := newMailIndexer(current.keys)
+
+	// A broken file leaves the current configuration as it is
+	writeTestConfig(t, file, `{"keys": {"Subject": "fuzzy"}}`)
+	if _, err := current.reload(); err == nil {
+		t.Fatal("expected an error")
+	}
+	if current.keys.keyType("subject") != keyTypeNormal || !current.keys.has("x-old") || len(current.mailboxes) != 1 {
+		t.Error("Configuration changed by an invalid file ", current.keys, current.mailboxes)
+	}
+
+	// The type of subject changes: removed as normal, added as part
+	writeTestConfig(t, file, `{"keys": {"Subject": "part", "X-New": "addr"}, "mailboxes": ["`+dir+`"]}`)
+	next, err := current.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(next.mailboxes) != 1 {
+		t.Error("Mailboxes added twice ", next.mailboxes)
+	}
+	added, removed := indexer.setKeys(next.keys)
+	if len(added) != 2 || added.keyType("subject") != keyTypePart || added.keyType("x-new") != keyTypeAddr {
+		t.Error("Unexpected added keys ", added)
+	}
+	if len(removed) != 2 || removed.keyType("subject") != keyTypeNormal || !removed.has("x-old") {
+		t.Error("Unexpected removed keys ", removed)
+	}
+	if indexer.keys().keyType("subject") != keyTypePart {
+		t.Error("Keys of the indexer not replaced")
+	}
+}
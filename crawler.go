@@ -4,6 +4,9 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -23,45 +26,115 @@ type fileMeta struct {
 }
 
 type crawler struct {
-	cache    *caches
-	root     string
-	files    map[string]*fileMeta
-	interval time.Duration
-	wakeup   chan struct{}
-	indexer  *mailIndexer
+	cache     *caches
+	mailboxes mailboxes
+	files     map[string]*fileMeta
+	interval  time.Duration
+	ticker    *time.Ticker
+	wakeup    chan struct{}
+	indexer   *mailIndexer
+	index     string // Where to persist the index, if anywhere
+	dirty     bool   // Files changed since the index was saved
+	saved     time.Time
+	saveCh    chan chan error
+	addCh     chan *crawlerAdd
+	renameCh  chan *crawlerRename
+	configCh  chan *crawlerConfig
+	filesCh   chan *crawlerFiles
+	uniques   map[string]string // Path of files by unique name, during a scan
+	renamed   string            // File renamed by the last event, until its new name is created
+	retention *retention
+	backfills int // Running backfills of added keys
+	filledCh  chan struct{}
+	fillMu    sync.Mutex // Protects filling, read by HTTP handlers
+	filling   map[string]*backfill
 }
 
-func newCrawler(indexer *mailIndexer, cache *caches, root string) *crawler {
+// New configuration, applied between two operations of the crawler
+type crawlerConfig struct {
+	keys      func(keys indexKey) indexKey
+	mailboxes mailboxes     // Unchanged if nil
+	interval  time.Duration // Unchanged if negative
+	data      chan *backfill
+}
+
+// Request to rename or copy a file. A renamed file keeps its place in the index.
+type crawlerRename struct {
+	file mailFile
+	to   string
+	copy bool
+	data chan crawlerRenameResult
+}
+
+type crawlerRenameResult struct {
+	file mailFile
+	err  error
+}
+
+// Request for the files of a mailbox, sorted by date
+type crawlerFiles struct {
+	mailbox string
+	data    chan []fileMeta
+}
+
+// Request to index files just delivered
+type crawlerAdd struct {
+	paths []string
+	data  chan mailFiles
+}
+
+func newCrawler(indexer *mailIndexer, cache *caches, mboxes mailboxes, index string) *crawler {
 	return &crawler{
-		cache:   cache,
-		root:    root,
-		files:   make(map[string]*fileMeta),
-		wakeup:  make(chan struct{}),
-		indexer: indexer,
+		cache:     cache,
+		mailboxes: mboxes,
+		files:     make(map[string]*fileMeta),
+		wakeup:    make(chan struct{}),
+		indexer:   indexer,
+		index:     index,
+		saved:     time.Now(),
+		saveCh:    make(chan chan error),
+		addCh:     make(chan *crawlerAdd),
+		renameCh:  make(chan *crawlerRename),
+		configCh:  make(chan *crawlerConfig),
+		filesCh:   make(chan *crawlerFiles),
+		filledCh:  make(chan struct{}),
+		filling:   make(map[string]*backfill),
 	}
 }
 
 func (c *crawler) markUpdated(file string, info os.FileInfo) {
+	c.dirty = true
 	c.files[file].status = fileStatusUpdated
 	c.files[file].info = info
 }
 
-func (c *crawler) markAdded(mfile mailFile, info os.FileInfo) {
+func (c *crawler) markAdded(mfile mailFile, info os.FileInfo) (mailFile, bool) {
 	file := mfile.filename()
-	msg, err := c.indexer.parse(file)
+	msg, body, err := c.indexer.parse(file)
 	if msg == nil && err != nil {
 		log.Print(file, ": error parsing ", err)
-		return
+		metrics.parseError()
+		// What was indexed before is not in the file anymore
+		if prev, found := c.files[file]; found {
+			metrics.cacheSend("remove", func() { c.cache.removeCh <- mailFiles{prev.mfile} })
+			delete(c.files, file)
+			c.dirty = true
+		}
+		return mfile, false
 	}
 	// Non fatal errors
 	if err != nil {
 		log.Print(file, ": error parsing ", err)
+		metrics.parseError()
 	}
 
 	if date, err := msg.Header.Date(); err == nil {
 		mfile.date = date
 	}
+	mfile.uid = messageUID(mfile, msg.Header)
 
+	c.dirty = true
+	prev, update := c.files[file]
 	c.files[file] = &fileMeta{
 		status: fileStatusAdded,
 		info:   info,
@@ -69,10 +142,17 @@ func (c *crawler) markAdded(mfile mailFile, info os.FileInfo) {
 	}
 
 	// Index this entry
-	entries := c.indexer.cacheEntries(mfile, msg)
-	for i := range entries {
-		c.cache.addCh <- entries[i]
+	cm := cacheMessage{
+		file:    mfile,
+		entries: c.indexer.cacheEntries(mfile, msg),
+		body:    body,
+		thread:  makeThreadRef(msg.Header),
+	}
+	if update {
+		cm.prev = &prev.mfile
 	}
+	metrics.cacheSend("add", func() { c.cache.addCh <- cm })
+	return mfile, true
 }
 
 func (c *crawler) markUnchanged(file string) {
@@ -94,12 +174,18 @@ func (c *crawler) markFile(mfile mailFile, finfo os.FileInfo) {
 	file := mfile.filename()
 	entry, found := c.files[file]
 	if !found {
+		// Flags changed, or moved from new/ to cur/
+		if old, found := c.uniques[mfile.mailbox+mfile.unique()]; found && old != file {
+			if _, err := os.Lstat(old); os.IsNotExist(err) {
+				c.moved(old, file)
+			}
+		}
 		c.markAdded(mfile, finfo)
 		return
 	}
 
 	if entry.info.Size() != finfo.Size() ||
-		entry.info.ModTime() != finfo.ModTime() {
+		!entry.info.ModTime().Equal(finfo.ModTime()) {
 		c.markUpdated(file, finfo)
 		return
 	}
@@ -122,56 +208,467 @@ func (c *crawler) filesByStatus(status fileStatus) (mailFiles, []os.FileInfo) {
 }
 
 func (c *crawler) remove(files mailFiles) {
+	if len(files) > 0 {
+		c.dirty = true
+	}
 	for _, f := range files {
 		delete(c.files, f.filename())
 	}
 }
 
-func (c *crawler) walk() {
-	filepath.Walk(c.root, func(path string, f os.FileInfo, err error) error {
-		if err != nil || f.IsDir() {
-			return err
-		}
+func (c *crawler) mailFile(path string) (mailFile, error) {
+	file, err := makeMailFile(path)
+	if err != nil {
+		return file, err
+	}
+	file.folder = c.mailboxes.name(file.mailbox)
+	return file, nil
+}
 
-		file, err := makeMailFile(path)
-		if err != nil {
-			log.Print(path, ": error parsing file ", err)
-			return nil
-		}
+// Mark all files found in the mailboxes, returning how many there are
+func (c *crawler) walk() int {
+	files := 0
+	for _, root := range c.mailboxes.paths() {
+		filepath.Walk(root, func(path string, f os.FileInfo, err error) error {
+			if err != nil || f.IsDir() {
+				return err
+			}
+			files++
 
-		c.markFile(file, f)
-		return err
-	})
+			file, err := c.mailFile(path)
+			if err != nil {
+				log.Print(path, ": error parsing file ", err)
+				return nil
+			}
+
+			c.markFile(file, f)
+			return err
+		})
+	}
+	return files
 }
 
 func (c *crawler) scan() {
+	start := time.Now()
 	// Initially, set all files as to be removed
 	c.markAllDeleted()
 
-	c.walk()
+	c.uniques = make(map[string]string, len(c.files))
+	for file, meta := range c.files {
+		c.uniques[meta.mfile.mailbox+meta.mfile.unique()] = file
+	}
+	files := c.walk()
+	c.uniques = nil
+	c.renamed = ""
 
 	// Remove removed files
 	filesDel, _ := c.filesByStatus(fileStatusDeleted)
-	c.cache.removeCh <- filesDel
+	metrics.cacheSend("remove", func() { c.cache.removeCh <- filesDel })
 	c.remove(filesDel)
 
-	// Remove and add again updated files
+	// Index again updated files
 	filesUp, infosUp := c.filesByStatus(fileStatusUpdated)
-	c.cache.removeCh <- filesUp
-
 	for i := 0; i < len(filesUp); i++ {
 		// XXX: Probably should only mark in markAdded,
 		// then select by status and add in a new function.
 		c.markAdded(filesUp[i], infosUp[i])
 	}
+	metrics.crawled(files, time.Since(start))
+}
+
+// Load the index saved by a previous run: only files changed since
+// then will need to be parsed again by scan.
+func (c *crawler) restore() {
+	if c.index == "" {
+		return
+	}
+
+	snap, err := loadIndex(c.index, indexSignature(c.indexer, c.mailboxes))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Print(c.index, ": cannot use saved index, indexing all messages: ", err)
+		}
+		return
+	}
+
+	for i := range snap.Files {
+		f := &snap.Files[i]
+		mfile := f.mailFile()
+		c.files[mfile.filename()] = &fileMeta{
+			status: fileStatusUnchanged,
+			info: &indexFileInfo{
+				name:    filepath.Base(mfile.file),
+				size:    f.Size,
+				modTime: f.ModTime,
+			},
+			mfile: mfile,
+		}
+		cm := cacheMessage{
+			file:    mfile,
+			entries: f.cacheEntries(),
+			body:    f.Body,
+			thread:  f.threadRef(),
+		}
+		metrics.cacheSend("add", func() { c.cache.addCh <- cm })
+	}
+	log.Printf("%s: loaded index of %d messages", c.index, len(snap.Files))
+}
+
+func (c *crawler) save() error {
+	// While keys are backfilled the index is incomplete: the one saved
+	// before has other keys and will not be used.
+	if c.index == "" || !c.dirty || c.backfills > 0 {
+		return nil
+	}
+
+	data := make(chan map[mailFile]cacheFile)
+	metrics.cacheSend("dump", func() { c.cache.dumpCh <- data })
+	cached := <-data
+
+	snap := &indexSnapshot{
+		Version: indexVersion,
+		Keys:    indexSignature(c.indexer, c.mailboxes),
+		Files:   make([]indexFile, 0, len(c.files)),
+	}
+	for _, meta := range c.files {
+		f := indexFile{
+			ID:      meta.mfile.uid,
+			Mailbox: meta.mfile.mailbox,
+			Folder:  meta.mfile.folder,
+			File:    meta.mfile.file,
+			Date:    meta.mfile.date,
+			Size:    meta.info.Size(),
+			ModTime: meta.info.ModTime(),
+		}
+		cf := cached[meta.mfile]
+		for _, e := range cf.entries {
+			f.Entries = append(f.Entries, indexEntry{Name: e.name, Key: e.key})
+		}
+		f.Body = cf.body
+		f.MessageID = cf.thread.messageID
+		f.References = cf.thread.references
+		f.Subject = cf.thread.subject
+		snap.Files = append(snap.Files, f)
+	}
+
+	if err := snap.save(c.index); err != nil {
+		return err
+	}
+	c.dirty = false
+	c.saved = time.Now()
+	return nil
+}
+
+// Save the index if changed, but not too often
+func (c *crawler) maybeSave() {
+	if time.Since(c.saved) < indexSaveInterval {
+		return
+	}
+	if err := c.save(); err != nil {
+		log.Print(c.index, ": cannot save index: ", err)
+	}
+}
+
+// Save the index before exiting
+func (c *crawler) shutdown() error {
+	done := make(chan error)
+	c.saveCh <- done
+	return <-done
+}
+
+// A file was renamed: the next time it is indexed, it replaces the old one
+func (c *crawler) moved(from, to string) {
+	if meta, found := c.files[from]; found {
+		delete(c.files, from)
+		c.files[to] = meta
+	}
+}
+
+// Rename or copy a file and index it under the new name
+func (c *crawler) rename(r *crawlerRename) {
+	from := r.file.filename()
+	if err := maildirMake(filepath.Dir(filepath.Dir(r.to))); err != nil {
+		r.data <- crawlerRenameResult{err: err}
+		return
+	}
+
+	var err error
+	switch {
+	case r.copy:
+		err = maildirCopy(from, r.to)
+	case filepath.Dir(filepath.Dir(from)) != filepath.Dir(filepath.Dir(r.to)):
+		err = maildirMove(from, r.to)
+	default:
+		// Same Maildir: a plain rename is atomic and looks like one to others
+		if _, err = os.Lstat(r.to); err == nil {
+			err = os.ErrExist
+		} else {
+			err = os.Rename(from, r.to)
+		}
+	}
+	if err != nil {
+		r.data <- crawlerRenameResult{err: err}
+		return
+	}
+	info, err := os.Stat(r.to)
+	if err != nil {
+		r.data <- crawlerRenameResult{err: err}
+		return
+	}
+	file, err := c.mailFile(r.to)
+	if err != nil {
+		r.data <- crawlerRenameResult{err: err}
+		return
+	}
+	if !r.copy {
+		c.moved(from, r.to)
+	}
+	file, ok := c.markAdded(file, info)
+	if !ok {
+		r.data <- crawlerRenameResult{err: errInvalidPath}
+		return
+	}
+	r.data <- crawlerRenameResult{file: file}
+}
+
+// Rename the file of a message, for example to change its flags
+// or to move it to another mailbox
+func (c *crawler) renameFile(file mailFile, to string) (mailFile, error) {
+	return c.transfer(&crawlerRename{file: file, to: to})
+}
+
+// Copy a message to the path to
+func (c *crawler) copyFile(file mailFile, to string) (mailFile, error) {
+	return c.transfer(&crawlerRename{file: file, to: to, copy: true})
+}
+
+func (c *crawler) transfer(r *crawlerRename) (mailFile, error) {
+	r.data = make(chan crawlerRenameResult)
+	c.renameCh <- r
+	res := <-r.data
+	return res.file, res.err
+}
+
+// Information about path if it is indexed and unchanged since
+func (c *crawler) indexed(path string, info os.FileInfo) (*fileMeta, bool) {
+	meta, found := c.files[path]
+	if !found || !meta.info.ModTime().Equal(info.ModTime()) || meta.info.Size() != info.Size() {
+		return nil, false
+	}
+	return meta, true
+}
+
+// Index files just written, without waiting for the next scan. Returns
+// the indexed files once the caches have them.
+func (c *crawler) deliver(paths []string) mailFiles {
+	r := &crawlerAdd{
+		paths: paths,
+		data:  make(chan mailFiles),
+	}
+	c.addCh <- r
+	return <-r.data
+}
+
+func (c *crawler) add(r *crawlerAdd) {
+	files := newMailFiles()
+	for _, path := range r.paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			log.Print(path, ": cannot index delivered file: ", err)
+			continue
+		}
+		// Maybe noticed by inotify already
+		if meta, found := c.indexed(path, info); found {
+			files = append(files, meta.mfile)
+			continue
+		}
+		file, err := c.mailFile(path)
+		if err != nil {
+			log.Print(path, ": cannot index delivered file: ", err)
+			continue
+		}
+		if file, ok := c.markAdded(file, info); ok {
+			files = append(files, file)
+		}
+	}
+	r.data <- files
+}
+
+// Files of a mailbox as the crawler knows them, without its folders
+func (c *crawler) mailboxFiles(mailbox string) []fileMeta {
+	r := &crawlerFiles{
+		mailbox: mailbox,
+		data:    make(chan []fileMeta),
+	}
+	c.filesCh <- r
+	return <-r.data
+}
+
+func (c *crawler) listFiles(r *crawlerFiles) {
+	metas := make([]fileMeta, 0)
+	for _, meta := range c.files {
+		if meta.mfile.folder == r.mailbox {
+			metas = append(metas, *meta)
+		}
+	}
+	sort.Slice(metas, func(i, j int) bool { return metas[i].mfile.before(metas[j].mfile) })
+	r.data <- metas
+}
+
+// Change the indexed keys, the mailboxes and the interval between scans.
+// Returns once the keys and mailboxes are in use; values of added keys are
+// added to the caches in the background.
+func (c *crawler) reconfigure(keys indexKey, mboxes mailboxes, interval time.Duration) *backfill {
+	return c.apply(&crawlerConfig{
+		keys: func(indexKey) indexKey {
+			return keys
+		},
+		mailboxes: mboxes,
+		interval:  interval,
+	})
+}
+
+// Change the indexed keys: fn gets the keys in use and returns the new ones
+func (c *crawler) changeKeys(fn func(keys indexKey) indexKey) *backfill {
+	return c.apply(&crawlerConfig{keys: fn, interval: -1})
+}
+
+func (c *crawler) apply(r *crawlerConfig) *backfill {
+	r.data = make(chan *backfill)
+	c.configCh <- r
+	return <-r.data
+}
+
+func (c *crawler) configure(r *crawlerConfig) {
+	if r.interval >= 0 && r.interval != c.interval {
+		c.setInterval(r.interval)
+	}
+
+	added, removed := c.indexer.setKeys(r.keys(c.indexer.keys()))
+	if len(added) > 0 || len(removed) > 0 {
+		metrics.cacheSend("keys", func() { c.cache.keysCh <- &cacheKeys{added: added, removed: removed} })
+		c.dirty = true
+	}
+	c.fillMu.Lock()
+	for key := range removed {
+		delete(c.filling, key)
+	}
+	c.fillMu.Unlock()
+
+	var b *backfill
+	if len(added) > 0 {
+		files := newMailFiles()
+		for _, meta := range c.files {
+			files = append(files, meta.mfile)
+		}
+		b = newBackfill(added, files)
+		c.fillMu.Lock()
+		for key := range added {
+			c.filling[key] = b
+		}
+		c.fillMu.Unlock()
+		c.backfills++
+		go c.backfill(b)
+	}
+
+	if r.mailboxes != nil {
+		c.mailboxes = r.mailboxes
+		// Files in removed mailboxes, or in mailboxes that changed name,
+		// are removed now and indexed again by the scan if still there.
+		stale := newMailFiles()
+		for _, meta := range c.files {
+			if c.mailboxes.name(meta.mfile.mailbox) != meta.mfile.folder {
+				stale = append(stale, meta.mfile)
+			}
+		}
+		if len(stale) > 0 {
+			metrics.cacheSend("remove", func() { c.cache.removeCh <- stale })
+			c.remove(stale)
+		}
+		c.scan()
+	}
+	r.data <- b
+}
+
+// Progress of indexing keys added after messages were indexed
+type backfill struct {
+	keys    indexKey
+	files   mailFiles
+	done    int64 // Files read, updated atomically
+	started time.Time
+}
+
+func newBackfill(keys indexKey, files mailFiles) *backfill {
+	return &backfill{
+		keys:    keys,
+		files:   files,
+		started: time.Now(),
+	}
+}
+
+// Number of files read and to read
+func (b *backfill) progress() (int, int) {
+	return int(atomic.LoadInt64(&b.done)), len(b.files)
+}
+
+// Latest backfill of a key, if any
+func (c *crawler) backfillOf(key string) *backfill {
+	c.fillMu.Lock()
+	defer c.fillMu.Unlock()
+	return c.filling[key]
+}
+
+// Index keys added after files were indexed. Runs in its own goroutine,
+// as all files have to be read again.
+func (c *crawler) backfill(b *backfill) {
+	for _, f := range b.files {
+		msg, err := c.indexer.parseHeader(f.filename())
+		// Otherwise removed meanwhile, or reported when indexed
+		if err == nil {
+			cm := cacheMessage{
+				file:    f,
+				entries: b.keys.cacheEntries(f, msg),
+			}
+			metrics.cacheSend("extend", func() { c.cache.extendCh <- cm })
+		}
+		atomic.AddInt64(&b.done, 1)
+	}
+	log.Printf("indexed %d new keys in %d messages in %s", len(b.keys), len(b.files), time.Since(b.started))
+	c.filledCh <- struct{}{}
+}
+
+func (c *crawler) setInterval(interval time.Duration) {
+	if c.ticker != nil {
+		c.ticker.Stop()
+		c.ticker = nil
+	}
+	c.interval = interval
+	if interval > 0 {
+		c.ticker = time.NewTicker(interval)
+	}
 }
 
 func (c *crawler) rescan() {
 	c.wakeup <- struct{}{}
 }
 
-func (c *crawler) run(events <-chan *event, errors <-chan error, tick <-chan time.Time) {
+func (c *crawler) run(events <-chan *event, errors <-chan error) {
+	c.setInterval(c.interval)
+
+	var purge <-chan time.Time
+	if c.retention != nil && c.retention.enabled() {
+		c.purge()
+		t := time.NewTicker(retentionInterval)
+		defer t.Stop()
+		purge = t.C
+	}
+
 	for {
+		var tick <-chan time.Time
+		if c.ticker != nil {
+			tick = c.ticker.C
+		}
+
 		select {
 		case e := <-events:
 			e.handle(c)
@@ -179,8 +676,26 @@ func (c *crawler) run(events <-chan *event, errors <-chan error, tick <-chan tim
 			log.Print(err)
 		case <-c.wakeup:
 			c.scan()
+		case r := <-c.addCh:
+			c.add(r)
+		case r := <-c.renameCh:
+			c.rename(r)
+		case <-purge:
+			c.purge()
 		case <-tick:
 			c.scan()
+		case r := <-c.configCh:
+			c.configure(r)
+		case <-c.filledCh:
+			c.backfills--
+			c.dirty = true
+		case done := <-c.saveCh:
+			done <- c.save()
+			continue
+		case r := <-c.filesCh:
+			c.listFiles(r)
+			continue
 		}
+		c.maybeSave()
 	}
 }
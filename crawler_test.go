@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A Maildir in a temporary directory with the messages, by file name
+// under cur/ or new/
+func testMaildir(t *testing.T, msgs map[string]string) string {
+	dir, err := ioutil.TempDir("", "perso-maildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := maildirMake(dir); err != nil {
+		t.Fatal(err)
+	}
+	for name, msg := range msgs {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(msg), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// Caches and a crawler for the mailboxes, not running
+func testCrawler(t *testing.T, roots ...string) (*caches, *crawler) {
+	var mboxes mailboxes
+	for _, root := range roots {
+		if err := mboxes.add(root); err != nil {
+			t.Fatal(err)
+		}
+	}
+	indexer := newMailIndexer(newConfig().keys)
+	cache := newCaches(indexer)
+	go cache.run()
+	return cache, newCrawler(indexer, cache, mboxes, "")
+}
+
+func TestCrawlerCurrentDir(t *testing.T) {
+	dir := testMaildir(t, map[string]string{
+		"cur/1500000000.M1P1.host:2,S": "Subject: here\n\nbody\n",
+	})
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	_, c := testCrawler(t, ".")
+	c.scan()
+	if len(c.files) != 1 {
+		t.Fatalf("expected one message, got %d", len(c.files))
+	}
+	for _, meta := range c.files {
+		if meta.mfile.folder != filepath.Base(dir) {
+			t.Error("Unexpected mailbox ", meta.mfile.folder)
+		}
+		if _, err := os.Stat(meta.mfile.filename()); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestMakeMailFile(t *testing.T) {
+	for path, mailbox := range map[string]string{
+		"cur/1.host:2,S":        "",
+		"/mail/new/1.host":      "/mail/",
+		"work/.Sent/cur/1.host": "work/.Sent/",
+	} {
+		file, err := makeMailFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if file.mailbox != mailbox || file.filename() != path {
+			t.Errorf("%s: unexpected mailbox %q, file name %q", path, file.mailbox, file.filename())
+		}
+	}
+	if _, err := makeMailFile("tmp/1.host"); err == nil {
+		t.Error("expected an error outside of cur/ and new/")
+	}
+}
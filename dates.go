@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+var errInvalidTime = errors.New("Invalid time: use RFC 3339, a date (YYYY-MM-DD) or a duration (-15m)")
+
+const dayFormat = "2006-01-02"
+
+// Parse an absolute time or a duration relative to now, like "-15m"
+func parseTime(s string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation(dayFormat, s, time.Local); err == nil {
+		return t, nil
+	}
+	if strings.HasPrefix(s, "-") || strings.HasPrefix(s, "+") {
+		if d, err := time.ParseDuration(s); err == nil {
+			return now.Add(d), nil
+		}
+	}
+	return time.Time{}, errInvalidTime
+}
+
+// All messages sorted by date, to find the ones in a time range without
+// looking at all of them. Only used from the caches goroutine.
+//
+// Files added are only sorted in when the index is next used: one at a
+// time for a single delivery, all at once after loading a Maildir or a
+// saved index.
+type dateIndex struct {
+	files mailFiles
+	added mailFiles // Not yet sorted in files
+}
+
+func newDateIndex() *dateIndex {
+	return &dateIndex{
+		files: newMailFiles(),
+		added: newMailFiles(),
+	}
+}
+
+// Position of f, or where it would be inserted
+func (d *dateIndex) search(f mailFile) int {
+	return sort.Search(len(d.files), func(i int) bool {
+		return !d.files[i].before(f)
+	})
+}
+
+func (d *dateIndex) add(f mailFile) {
+	d.added = append(d.added, f)
+}
+
+// Sort the added files in
+func (d *dateIndex) sort() {
+	switch len(d.added) {
+	case 0:
+		return
+	case 1:
+		d.insert(d.added[0])
+	default:
+		d.files = append(d.files, d.added...)
+		sort.Slice(d.files, func(i, j int) bool {
+			return d.files[i].before(d.files[j])
+		})
+		// Files added twice
+		n := 0
+		for i, f := range d.files {
+			if i == 0 || f != d.files[n-1] {
+				d.files[n] = f
+				n++
+			}
+		}
+		d.files = d.files[:n]
+	}
+	d.added = d.added[:0]
+}
+
+func (d *dateIndex) insert(f mailFile) {
+	i := d.search(f)
+	if i < len(d.files) && d.files[i] == f {
+		return
+	}
+	d.files = append(d.files, mailFile{})
+	copy(d.files[i+1:], d.files[i:])
+	d.files[i] = f
+}
+
+// Remove files, several of them in one pass
+func (d *dateIndex) remove(files mailFiles) {
+	switch len(files) {
+	case 0:
+		return
+	case 1:
+		d.sort()
+		f := files[0]
+		i := d.search(f)
+		if i >= len(d.files) || d.files[i] != f {
+			return
+		}
+		d.files = append(d.files[:i], d.files[i+1:]...)
+		return
+	}
+	d.sort()
+	set := make(map[mailFile]struct{}, len(files))
+	for _, f := range files {
+		set[f] = struct{}{}
+	}
+	n := 0
+	for _, f := range d.files {
+		if _, found := set[f]; !found {
+			d.files[n] = f
+			n++
+		}
+	}
+	d.files = d.files[:n]
+}
+
+// Copy of the files dated from since and before until. Zero times are no limit.
+func (d *dateIndex) between(since, until time.Time) mailFiles {
+	d.sort()
+	start, end := 0, len(d.files)
+	if !since.IsZero() {
+		start = sort.Search(len(d.files), func(i int) bool {
+			return !d.files[i].date.Before(since)
+		})
+	}
+	if !until.IsZero() {
+		end = sort.Search(len(d.files), func(i int) bool {
+			return !d.files[i].date.Before(until)
+		})
+	}
+	if end < start {
+		end = start
+	}
+	files := make(mailFiles, end-start)
+	copy(files, d.files[start:end])
+	return files
+}
+
+// Days with at least one message, in local time. Files must be sorted.
+func (ms mailFiles) days(mailbox string) []string {
+	days := make([]string, 0)
+	last := ""
+	for _, f := range ms {
+		if mailbox != "" && f.folder != mailbox {
+			continue
+		}
+		if f.date.IsZero() {
+			continue
+		}
+		if day := f.date.In(time.Local).Format(dayFormat); day != last {
+			days = append(days, day)
+			last = day
+		}
+	}
+	return days
+}
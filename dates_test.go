@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestDateIndex(t *testing.T) {
+	base := time.Date(2017, 7, 17, 10, 0, 0, 0, time.UTC)
+	d := newDateIndex()
+	for _, i := range []int{3, 0, 4, 1, 2} {
+		d.add(mailFile{file: string(rune('a' + i)), date: base.Add(time.Duration(i) * time.Hour)})
+	}
+	d.remove(mailFiles{mailFile{file: "c", date: base.Add(2 * time.Hour)}})
+
+	files := d.between(base.Add(time.Hour), base.Add(4*time.Hour))
+	if len(files) != 2 || files[0].file != "b" || files[1].file != "d" {
+		t.Errorf("unexpected files in range: %v", files)
+	}
+	if files := d.between(time.Time{}, time.Time{}); len(files) != 4 {
+		t.Errorf("expected all four files, got %v", files)
+	}
+	if files := d.between(base.Add(time.Hour), base); len(files) != 0 {
+		t.Errorf("expected an empty range, got %v", files)
+	}
+}
+
+func TestDateIndexLoad(t *testing.T) {
+	base := time.Date(2017, 7, 17, 10, 0, 0, 0, time.UTC)
+	file := func(i int) mailFile {
+		return mailFile{file: string(rune('a' + i)), date: base.Add(time.Duration(i) * time.Hour)}
+	}
+	d := newDateIndex()
+	for _, i := range []int{7, 2, 9, 0, 5, 2} {
+		d.add(file(i))
+	}
+	if files := d.between(time.Time{}, time.Time{}); len(files) != 5 || !sort.IsSorted(files) {
+		t.Errorf("expected five sorted files, got %v", files)
+	}
+	// Single deliveries, the second already known
+	for _, i := range []int{3, 0} {
+		d.add(file(i))
+		files := d.between(time.Time{}, time.Time{})
+		if len(files) != 6 || files[2] != file(3) || !sort.IsSorted(files) {
+			t.Errorf("expected six sorted files, got %v", files)
+		}
+	}
+
+	// Removed at once, with files not in the index
+	d.remove(mailFiles{file(9), file(1), file(0), file(5)})
+	files := d.between(time.Time{}, time.Time{})
+	if len(files) != 3 || files[0] != file(2) || files[1] != file(3) || files[2] != file(7) {
+		t.Errorf("expected three files left, got %v", files)
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	now := time.Date(2017, 7, 17, 10, 0, 0, 0, time.UTC)
+	tests := map[string]time.Time{
+		"2017-07-17T09:00:00Z": now.Add(-time.Hour),
+		"-15m":                 now.Add(-15 * time.Minute),
+		"+1h":                  now.Add(time.Hour),
+		"2017-07-16":           time.Date(2017, 7, 16, 0, 0, 0, 0, time.Local),
+	}
+	for s, want := range tests {
+		got, err := parseTime(s, now)
+		if err != nil {
+			t.Errorf("%s: %v", s, err)
+			continue
+		}
+		if !got.Equal(want) {
+			t.Errorf("%s: got %v, want %v", s, got, want)
+		}
+	}
+	for _, s := range []string{"", "15m", "yesterday"} {
+		if _, err := parseTime(s, now); err == nil {
+			t.Errorf("%s: expected an error", s)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type cacheEventType int
+
+const (
+	cacheEventAdded cacheEventType = iota
+	cacheEventUpdated
+	cacheEventRemoved
+)
+
+func (t cacheEventType) String() string {
+	switch t {
+	case cacheEventAdded:
+		return "added"
+	case cacheEventUpdated:
+		return "updated"
+	case cacheEventRemoved:
+		return "removed"
+	}
+	return "unknown"
+}
+
+type cacheEvent struct {
+	id      uint64
+	kind    cacheEventType
+	file    mailFile
+	entries []cacheEntry
+}
+
+func (e *cacheEvent) matches(header, value string, match keyType) bool {
+	for _, entry := range e.entries {
+		if entry.matches(header, value, match) {
+			return true
+		}
+	}
+	return false
+}
+
+type jsonEvent struct {
+	ID      string              `json:"id"`
+	Mailbox string              `json:"mailbox"`
+	File    string              `json:"file"`
+	Date    time.Time           `json:"date"`
+	Headers map[string][]string `json:"headers"`
+}
+
+// Write the event in Server-Sent Events format, with the id as a cursor
+func (e *cacheEvent) writeTo(w io.Writer, c *caches) error {
+	je := &jsonEvent{
+		ID:      e.file.id(),
+		Mailbox: e.file.folder,
+		File:    e.file.file,
+		Date:    e.file.date,
+		Headers: make(map[string][]string),
+	}
+	for _, entry := range e.entries {
+		if entry.name == "" {
+			continue
+		}
+		je.Headers[entry.name] = append(je.Headers[entry.name], entry.key)
+	}
+	data, err := json.Marshal(je)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", c.formatCursor(e.id), e.kind, data)
+	return err
+}
+
+var (
+	errInvalidCursor = errors.New("Invalid cursor")
+	errStaleCursor   = errors.New("Cursor from before a restart")
+)
+
+// Ids of events and serials of messages start again when perso restarts.
+// Given to clients, they start with the time the caches started: "k2j5qo-42".
+func (c *caches) formatCursor(n uint64) string {
+	return strconv.FormatUint(uint64(c.epoch), 36) + "-" + strconv.FormatUint(n, 10)
+}
+
+// Id or serial of a cursor, if given since the caches started
+func (c *caches) parseCursor(s string) (uint64, error) {
+	i := strings.IndexByte(s, '-')
+	if i < 0 {
+		// Given before cursors had the time in them
+		if _, err := strconv.ParseUint(s, 10, 64); err == nil {
+			return 0, errStaleCursor
+		}
+		return 0, errInvalidCursor
+	}
+	n, err := strconv.ParseUint(s[i+1:], 10, 64)
+	if err != nil {
+		return 0, errInvalidCursor
+	}
+	if s[:i] != strconv.FormatUint(uint64(c.epoch), 36) {
+		return 0, errStaleCursor
+	}
+	return n, nil
+}
+
+// Number of past events kept to resume interrupted streams
+const cacheEventsHistory = 1024
+
+// Live subscribers are dropped if they fall this much behind
+const cacheSubscriberBuffer = 256
+
+// Recent events and current subscribers. Only used from the caches goroutine.
+type cacheEvents struct {
+	lastID      uint64
+	history     []*cacheEvent
+	subscribers map[*cacheSubscriber]struct{}
+}
+
+func newCacheEvents() *cacheEvents {
+	return &cacheEvents{
+		history:     make([]*cacheEvent, 0),
+		subscribers: make(map[*cacheSubscriber]struct{}),
+	}
+}
+
+func (ce *cacheEvents) emit(kind cacheEventType, file mailFile, entries []cacheEntry) {
+	ce.lastID++
+	e := &cacheEvent{id: ce.lastID, kind: kind, file: file, entries: entries}
+
+	ce.history = append(ce.history, e)
+	if len(ce.history) > cacheEventsHistory {
+		ce.history = ce.history[len(ce.history)-cacheEventsHistory:]
+	}
+
+	for s := range ce.subscribers {
+		if !s.wants(e) {
+			continue
+		}
+		select {
+		case s.events <- e:
+		default:
+			// Too slow: the client can reconnect and resume
+			delete(ce.subscribers, s)
+			close(s.events)
+		}
+	}
+}
+
+// Events after id, or nil if some of them are not in the history anymore.
+func (ce *cacheEvents) since(id uint64) []*cacheEvent {
+	if id > ce.lastID {
+		return nil
+	}
+	if id == ce.lastID {
+		return []*cacheEvent{}
+	}
+	if ce.history[0].id > id+1 {
+		return nil
+	}
+	return ce.history[id+1-ce.history[0].id:]
+}
+
+type cacheSubscriber struct {
+	mailbox string
+	header  string
+	value   string
+	match   keyType
+	resume  bool
+	lastID  uint64
+	replay  chan []*cacheEvent
+	events  chan *cacheEvent
+}
+
+func newCacheSubscriber() *cacheSubscriber {
+	return &cacheSubscriber{
+		replay: make(chan []*cacheEvent, 1),
+		events: make(chan *cacheEvent, cacheSubscriberBuffer),
+	}
+}
+
+func (s *cacheSubscriber) wants(e *cacheEvent) bool {
+	if s.mailbox != "" && s.mailbox != e.file.folder {
+		return false
+	}
+	if s.header == "" {
+		return true
+	}
+	return e.matches(s.header, s.value, s.match)
+}
+
+// Register a subscriber, first sending the events it missed if it is
+// resuming. A nil replay means that the missed events are not known anymore.
+func (c *caches) subscribe(s *cacheSubscriber) {
+	var replay []*cacheEvent
+	if s.resume {
+		if events := c.events.since(s.lastID); events != nil {
+			replay = make([]*cacheEvent, 0)
+			for _, e := range events {
+				if s.wants(e) {
+					replay = append(replay, e)
+				}
+			}
+		}
+	} else {
+		replay = make([]*cacheEvent, 0)
+	}
+	s.replay <- replay
+	c.events.subscribers[s] = struct{}{}
+}
+
+func (c *caches) unsubscribe(s *cacheSubscriber) {
+	if _, found := c.events.subscribers[s]; !found {
+		return
+	}
+	delete(c.events.subscribers, s)
+	close(s.events)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCacheEventsSince(t *testing.T) {
+	ce := newCacheEvents()
+	if since := ce.since(0); since == nil || len(since) != 0 {
+		t.Error("expected no events before the first one, got ", since)
+	}
+	for i := 0; i < 10; i++ {
+		ce.emit(cacheEventAdded, mailFile{}, nil)
+	}
+	since := ce.since(7)
+	if len(since) != 3 || since[0].id != 8 || since[2].id != 10 {
+		t.Error("expected events 8 to 10, got ", since)
+	}
+	if since := ce.since(10); since == nil || len(since) != 0 {
+		t.Error("expected no events after the last one, got ", since)
+	}
+	if ce.since(11) != nil {
+		t.Error("expected a reset for an id in the future")
+	}
+
+	for i := 0; i < cacheEventsHistory; i++ {
+		ce.emit(cacheEventAdded, mailFile{}, nil)
+	}
+	if ce.since(9) != nil {
+		t.Error("expected a reset for events not in the history")
+	}
+	if since := ce.since(10); len(since) != cacheEventsHistory {
+		t.Errorf("expected %d events, got %d", cacheEventsHistory, len(since))
+	}
+}
+
+// First lines of the event stream, until count events or a reset are read
+func testEvents(t *testing.T, h *httpHandler, lastID string, count int) []string {
+	srv := httptest.NewServer(http.HandlerFunc(h.events("")))
+	defer srv.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastID != "" {
+		req.Header.Set("Last-Event-ID", lastID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return []string{resp.Status}
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(resp.Body)
+	for count > 0 && scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "event: reset":
+			return append(lines, line)
+		case strings.HasPrefix(line, "id: "):
+			count--
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func TestEventsResume(t *testing.T) {
+	dir := testMaildir(t, map[string]string{
+		"cur/1500000001.M1P1.host:2,S": "Subject: one\n\nbody\n",
+		"cur/1500000002.M1P1.host:2,S": "Subject: two\n\nbody\n",
+		"cur/1500000003.M1P1.host:2,S": "Subject: three\n\nbody\n",
+	})
+	defer os.RemoveAll(dir)
+	cache, c := testCrawler(t, dir)
+	c.scan()
+	h := newHttpHandler(nil, cache, newConfig(), c, c.indexer)
+
+	first := cache.formatCursor(1)
+	if lines := testEvents(t, h, first, 2); len(lines) != 2 ||
+		lines[0] != "id: "+cache.formatCursor(2) || lines[1] != "id: "+cache.formatCursor(3) {
+		t.Error("expected the events after the first, got ", lines)
+	}
+
+	// Ids from before a restart, or from the future, are not resumed
+	restarted := &caches{epoch: cache.epoch - 1}
+	for _, id := range []string{restarted.formatCursor(1), "1", cache.formatCursor(10)} {
+		if lines := testEvents(t, h, id, 1); len(lines) != 1 || lines[0] != "event: reset" {
+			t.Errorf("%s: expected a reset, got %v", id, lines)
+		}
+	}
+	if lines := testEvents(t, h, "one", 1); len(lines) != 1 || !strings.HasPrefix(lines[0], "400") {
+		t.Error("expected an invalid id, got ", lines)
+	}
+}
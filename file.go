@@ -12,9 +12,11 @@ import (
 )
 
 type mailFile struct {
-	mailbox string
+	mailbox string // Directory containing cur/ and new/
+	folder  string // Name of the mailbox
 	file    string
 	date    time.Time
+	uid     string // Stable identifier, see id()
 }
 
 var errInvalidPath = errors.New("Invalid Path")
@@ -31,8 +33,13 @@ func makeMailFile(filename string) (mailFile, error) {
 		return mailFile{}, errInvalidPath
 	}
 
+	// Relative to the current directory, like "cur/x", if no directory is left
+	var mailbox string
+	if len(parts) > 2 {
+		mailbox = strings.Join(parts[0:len(parts)-2], "/") + "/"
+	}
 	return mailFile{
-		mailbox: strings.Join(parts[0:len(parts)-2], "/") + "/",
+		mailbox: mailbox,
 		file:    strings.Join(parts[len(parts)-2:], "/"),
 	}, nil
 }
@@ -45,20 +52,41 @@ func (m mailFile) filename() string {
 	return m.mailbox + m.file
 }
 
-func (m mailFile) writeTo(w io.Writer, c *config) error {
+// Write the message in mbox format, agent is written after "From "
+func (m mailFile) writeTo(w io.Writer, agent string) error {
 	r, err := os.Open(m.filename())
 	if err != nil {
 		return err
 	}
 	defer r.Close()
 
-	if _, err := fmt.Fprintf(w, "From %s %s\n", c.agent, m.date.Format(time.UnixDate)); err != nil {
+	if _, err := fmt.Fprintf(w, "From %s %s\n", agent, m.date.Format(time.UnixDate)); err != nil {
 		return err
 	}
 	_, err = io.Copy(w, r)
 	return err
 }
 
+// Order of messages: by date, then by file name
+func (m mailFile) before(o mailFile) bool {
+	if m.date != o.date {
+		return m.date.Before(o.date)
+	}
+
+	if m.mailbox == o.mailbox {
+		return m.file < o.file
+	}
+
+	return m.mailbox < o.mailbox
+}
+
+func (m mailFile) between(since, until time.Time) bool {
+	if !since.IsZero() && m.date.Before(since) {
+		return false
+	}
+	return until.IsZero() || m.date.Before(until)
+}
+
 type mailFiles []mailFile
 
 func newMailFiles() mailFiles {
@@ -67,18 +95,51 @@ func newMailFiles() mailFiles {
 
 func (ms mailFiles) writeTo(w io.Writer, c *config) {
 	for _, m := range ms {
-		if err := m.writeTo(w, c); err != nil {
+		if err := m.writeTo(w, c.agent); err != nil {
 			log.Print("could not write ", m, ": ", err)
 		}
 	}
 }
 
-func (ms mailFiles) delete() {
+// Remove the files, returning the ones that could not be removed
+func (ms mailFiles) delete() mailFiles {
+	failed := newMailFiles()
 	for _, m := range ms {
 		if err := os.Remove(m.filename()); err != nil {
 			log.Print("cannot remove ", m.filename(), ": ", err)
+			failed = append(failed, m)
+		}
+	}
+	metrics.deleted(len(ms) - len(failed))
+	return failed
+}
+
+// Only the files in the mailbox called name, all of them if name is empty
+func (ms mailFiles) inMailbox(name string) mailFiles {
+	if name == "" {
+		return ms
+	}
+	r := newMailFiles()
+	for _, m := range ms {
+		if m.folder == name {
+			r = append(r, m)
+		}
+	}
+	return r
+}
+
+// Only the files dated from since and before until. Zero times are no limit.
+func (ms mailFiles) between(since, until time.Time) mailFiles {
+	if since.IsZero() && until.IsZero() {
+		return ms
+	}
+	r := newMailFiles()
+	for _, m := range ms {
+		if m.between(since, until) {
+			r = append(r, m)
 		}
 	}
+	return r
 }
 
 func (ms mailFiles) contains(m mailFile) bool {
@@ -107,15 +168,7 @@ func (p mailFiles) Len() int {
 }
 
 func (p mailFiles) Less(i, j int) bool {
-	if p[i].date != p[j].date {
-		return p[i].date.Before(p[j].date)
-	}
-
-	if p[i].mailbox == p[j].mailbox {
-		return p[i].file < p[j].file
-	}
-
-	return p[i].mailbox < p[j].mailbox
+	return p[i].before(p[j])
 }
 
 func (p mailFiles) Swap(i, j int) {
@@ -12,6 +12,22 @@ var helpPage1 string = `<h1>Perso - Maildir to REST daemon</h1>
 var helpPage2 string = `</li>
 	<li>N can be: (1) a number (ex: "1", "2", "135"), (2) a range (eg: "1-5", "8-9"), (3) a number with limit (eg "1,2": from the first, two elements; "6,3": from the sixth, three elements)
 	</li>
+	<li>Add "?unread=1" to select only messages without the seen flag; PATCH "/msg/ID" with {"add": ["seen"]} or {"remove": [...]} to change flags
+	</li>
+	<li>POST "/msg/ID/move?to=NAME" or "/msg/ID/copy?to=NAME" to move or copy a message to another mailbox
+	</li>
+	<li>Add "?since=T" and "?until=T" to select only messages dated in a range; T can be RFC 3339, YYYY-MM-DD or relative to now, like "-15m"
+	</li>
+	<li>PUT "/admin/keys/HEADER?type=normal|addr|part" to index one more header, DELETE it to stop; GET shows the progress of indexing existing messages
+	</li>
+	<li>All URLs selecting messages can be prefixed with "/mbox/NAME" to only select messages in that mailbox
+	</li>
+	<li>POST one message, or several in mbox format, to "/messages" or "/mbox/NAME/messages" to deliver them
+	</li>
+	<li>Messages are returned in mbox format; add "?format=json" or send "Accept: application/json" to get JSON instead
+	</li>
+	<li>JMAP clients find the session resource at "/.well-known/jmap"
+	</li>
 </ul>
 <body>
 </html>`
@@ -19,11 +35,13 @@ var helpPage2 string = `</li>
 type help struct {
 	data []byte
 	keys indexKey
+	body bool
 }
 
-func newHelp(keys indexKey) *help {
+func newHelp(keys indexKey, body bool) *help {
 	return &help{
 		keys: keys,
+		body: body,
 	}
 }
 
@@ -31,6 +49,25 @@ func (h *help) reverseURLs() []string {
 	urls := make([]string, 0)
 
 	urls = append(urls, "/help")
+	urls = append(urls, "/mailboxes")
+	urls = append(urls, "/mbox/NAME/latest/N")
+	urls = append(urls, "/wait")
+	urls = append(urls, "/events")
+	urls = append(urls, "/msg/ID")
+	urls = append(urls, "/msg/ID/parts")
+	urls = append(urls, "/msg/ID/parts/PATH")
+	urls = append(urls, "/query/latest/N?HEADER=VALUE&HEADER~=PARTIAL-VALUE")
+	urls = append(urls, "/threads")
+	urls = append(urls, "/threads/ID/oldest/N")
+	urls = append(urls, "/date")
+	urls = append(urls, "/date/YYYY-MM-DD/latest/N")
+	urls = append(urls, "/metrics")
+	urls = append(urls, "/admin/keys")
+	urls = append(urls, "/admin/keys/HEADER")
+	if h.body {
+		urls = append(urls, "/search/latest/N?q=WORDS")
+		urls = append(urls, "/search/oldest/N?q=WORDS")
+	}
 
 	for k, t := range h.keys {
 		if k == "" {
@@ -59,6 +96,8 @@ func (h *help) reverseURLs() []string {
 		}
 		urls = append(urls, url+"/latest/N")
 		urls = append(urls, url+"/oldest/N")
+		urls = append(urls, url+"/wait")
+		urls = append(urls, url+"/events")
 	}
 
 	return urls
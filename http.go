@@ -1,10 +1,23 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -17,12 +30,16 @@ func (e errorNotFound) Error() string {
 
 var errNotFound = errorNotFound("Not found")
 
+// Maximum size of the messages delivered in one request
+const httpMaxDelivery = 64 << 20
+
 type httpHandler struct {
 	helpTmpl *help
 	cache    *caches
 	config   *config
 	crawler  *crawler
 	indexer  *mailIndexer
+	routes   *httpRouter
 	paths    []string
 }
 
@@ -37,17 +54,134 @@ func newHttpHandler(help *help, cache *caches, config *config, crawler *crawler,
 	}
 }
 
-func (h *httpHandler) run(srv *http.Server) error {
+// Serves requests with the routes of the latest configuration. Replacing
+// them does not affect requests in progress or open connections.
+type httpRouter struct {
+	mu      sync.Mutex   // Serializes changes of the routes
+	current atomic.Value // *httpRoutes
+}
+
+// Routes and the handler they were built from
+type httpRoutes struct {
+	handler *httpHandler
+	router  *mux.Router
+}
+
+func newHttpRouter(h *httpHandler) *httpRouter {
+	r := &httpRouter{}
+	r.set(h)
+	return r
+}
+
+func (r *httpRouter) set(h *httpHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	h.routes = r
+	r.current.Store(&httpRoutes{handler: h, router: h.router()})
+}
+
+// Register the routes again after the indexed keys changed
+func (r *httpRouter) refresh() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	h := *r.current.Load().(*httpRoutes).handler
+	h.helpTmpl = newHelp(h.indexer.keys(), h.indexer.body)
+	r.current.Store(&httpRoutes{handler: &h, router: h.router()})
+}
+
+func (r *httpRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	routes := r.current.Load().(*httpRoutes)
+
+	// Metrics are by route, not by URL, not to have a series for each message
+	var (
+		route string
+		match mux.RouteMatch
+	)
+	if routes.router.Match(req, &match) && match.Route != nil {
+		if tmpl, err := match.Route.GetPathTemplate(); err == nil {
+			route = tmpl
+		}
+	}
+
+	sw := &statusWriter{ResponseWriter: w, code: 200}
+	if code, err := routes.handler.authorize(req, route, match.Vars); err != nil {
+		log.Print(req.RemoteAddr, " ", req.URL.Path, ": ", err)
+		if code == 401 {
+			if routes.handler.config.auth.basic {
+				sw.Header().Set("WWW-Authenticate", `Basic realm="perso"`)
+			} else {
+				sw.Header().Set("WWW-Authenticate", `Bearer realm="perso"`)
+			}
+		}
+		http.Error(sw, err.Error(), code)
+	} else {
+		routes.router.ServeHTTP(sw, req)
+	}
+
+	if route == "" {
+		route = "none"
+	}
+	metrics.request(route, req.Method, sw.code, time.Since(start))
+}
+
+func (h *httpHandler) router() *mux.Router {
 	r := mux.NewRouter()
 	r.HandleFunc("/", h.forward("latest/0"))
 	r.HandleFunc("/help", h.help)
-	r.HandleFunc("/latest/{selector}", h.messages("", false))
-	r.HandleFunc("/oldest/{selector}", h.messages("", true))
-	for key := range h.config.keys {
+	r.HandleFunc("/mailboxes", h.mailboxes())
+	r.HandleFunc("/msg/{id}", h.message())
+	r.HandleFunc("/msg/{id}/move", h.transfer(false))
+	r.HandleFunc("/msg/{id}/copy", h.transfer(true))
+	r.HandleFunc("/msg/{id}/parts", h.parts())
+	r.HandleFunc("/msg/{id}/parts/{path}", h.part())
+	r.HandleFunc("/mbox/{mailbox}", h.forward("/latest/0"))
+	r.HandleFunc("/metrics", h.metrics())
+	r.HandleFunc("/admin/keys", h.adminKeys())
+	r.HandleFunc("/admin/keys/{header}", h.adminKey())
+	r.HandleFunc("/.well-known/jmap", h.jmapSession())
+	r.HandleFunc("/jmap/api", h.jmapAPI())
+	r.HandleFunc("/jmap/download/{account}/{blob}/{name}", h.jmapDownload())
+	r.HandleFunc("/jmap/upload/{account}", h.jmapUpload())
+	r.HandleFunc("/jmap/eventsource", h.jmapEventSource())
+	h.messageRoutes(r, "")
+	h.messageRoutes(r, "/mbox/{mailbox}")
+	return r
+}
+
+// Register routes selecting messages under base. Routes under "/mbox/{mailbox}"
+// only select messages in that mailbox, the others select from all mailboxes.
+func (h *httpHandler) messageRoutes(r *mux.Router, base string) {
+	r.HandleFunc(base+"/latest/{selector}", h.messages("", false))
+	r.HandleFunc(base+"/oldest/{selector}", h.messages("", true))
+	r.HandleFunc(base+"/wait", h.wait(""))
+	r.HandleFunc(base+"/messages", h.deliver())
+	r.HandleFunc(base+"/events", h.events(""))
+	if h.indexer.body {
+		r.HandleFunc(base+"/search", h.forward("/latest/0"))
+		r.HandleFunc(base+"/search/latest/{selector}", h.search(false))
+		r.HandleFunc(base+"/search/oldest/{selector}", h.search(true))
+	}
+	r.HandleFunc(base+"/query", h.forward("/latest/0"))
+	r.HandleFunc(base+"/query/latest/{selector}", h.query(false))
+	r.HandleFunc(base+"/query/oldest/{selector}", h.query(true))
+	r.HandleFunc(base+"/threads", h.threads())
+	r.HandleFunc(base+"/threads/", h.forward(""))
+	r.HandleFunc(base+"/threads/{thread}", h.forward("/latest/0"))
+	r.HandleFunc(base+"/threads/{thread}/latest/{selector}", h.thread(false))
+	r.HandleFunc(base+"/threads/{thread}/oldest/{selector}", h.thread(true))
+	if !h.indexer.keys().has("date") {
+		r.HandleFunc(base+"/date", h.days())
+		r.HandleFunc(base+"/date/", h.forward(""))
+		r.HandleFunc(base+"/date/{day}", h.forward("/latest/0"))
+		r.HandleFunc(base+"/date/{day}/latest/{selector}", h.day(false))
+		r.HandleFunc(base+"/date/{day}/oldest/{selector}", h.day(true))
+	}
+	for key := range h.indexer.keys() {
 		if key == "" {
 			continue
 		}
-		prefix := "/" + key
+		prefix := base + "/" + key
 		r.HandleFunc(prefix, h.list(key))
 		r.HandleFunc(prefix+"/", h.forward(""))
 		r.HandleFunc(prefix+"/{value}", h.forward("/latest/0"))
@@ -55,14 +189,26 @@ func (h *httpHandler) run(srv *http.Server) error {
 		r.HandleFunc(prefix+"/{value}/oldest", h.forward("/0"))
 		r.HandleFunc(prefix+"/{value}/latest/{selector}", h.messages(key, false))
 		r.HandleFunc(prefix+"/{value}/oldest/{selector}", h.messages(key, true))
+		r.HandleFunc(prefix+"/{value}/wait", h.wait(key))
+		r.HandleFunc(prefix+"/{value}/events", h.events(key))
 	}
-	srv.Handler = r
-	return srv.ListenAndServe()
+}
+
+// Mailbox selected in the URL, if any. Returns errNotFound for unknown mailboxes.
+func (h *httpHandler) mailbox(r *http.Request) (string, error) {
+	name := mux.Vars(r)["mailbox"]
+	if name != "" && !h.config.mailboxes.exists(name) {
+		return "", errNotFound
+	}
+	return name, nil
 }
 
 func (httpHandler) forward(url string) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		url = strings.TrimRight(r.URL.Path+url, "/")
+		url := strings.TrimRight(r.URL.Path+url, "/")
+		if r.URL.RawQuery != "" {
+			url = url + "?" + r.URL.RawQuery
+		}
 		// TODO: Is this the right code for POST/DELETE requests?
 		http.Redirect(w, r, url, 307)
 	}
@@ -83,11 +229,16 @@ func (h *httpHandler) help(w http.ResponseWriter, r *http.Request) {
 func (h *httpHandler) messages(key string, oldest bool) func(w http.ResponseWriter, r *http.Request) {
 	return h.handler(func(h *httpHandler, w http.ResponseWriter, r *http.Request) error {
 		vars := mux.Vars(r)
+		mailbox, err := h.mailbox(r)
+		if err != nil {
+			return err
+		}
 		cr := newCacheRequest()
+		cr.mailbox = mailbox
 		cr.oldest = oldest
 		cr.header = key
 		cr.value = vars["value"]
-		if !h.indexer.keys.has(cr.header) {
+		if !h.indexer.keys().has(cr.header) {
 			return errNotFound
 		}
 		if vars["selector"] == "" {
@@ -96,30 +247,803 @@ func (h *httpHandler) messages(key string, oldest bool) func(w http.ResponseWrit
 		if err := selector(vars["selector"]).parse(cr); err != nil {
 			return errNotFound // XXX: bad request
 		}
+		if err = requestFilters(r, cr); err != nil {
+			http.Error(w, err.Error(), 400)
+			return nil
+		}
+		if r.Method == "DELETE" {
+			w.Header().Set("Content-Type", "text/plain")
+			return h.deleteMessages(cr)
+		}
+		return h.writeMessages(cr, w, r)
+	})
+}
+
+// Messages with words in the body matching the query in parameter "q"
+func (h *httpHandler) search(oldest bool) func(w http.ResponseWriter, r *http.Request) {
+	return h.handler(func(h *httpHandler, w http.ResponseWriter, r *http.Request) error {
+		query, err := parseSearchQuery(r.URL.Query().Get("q"))
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return nil
+		}
+		return h.queryMessages(query, oldest, w, r)
+	})
+}
+
+// Messages matching all the headers in the query string
+func (h *httpHandler) query(oldest bool) func(w http.ResponseWriter, r *http.Request) {
+	return h.handler(func(h *httpHandler, w http.ResponseWriter, r *http.Request) error {
+		query, err := parseHeaderQuery(r.URL.Query(), h.indexer)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return nil
+		}
+		return h.queryMessages(query, oldest, w, r)
+	})
+}
+
+func (h *httpHandler) queryMessages(query searchNode, oldest bool, w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" && r.Method != "DELETE" {
+		http.Error(w, "Method not supported", 405)
+		return nil
+	}
+	mailbox, err := h.mailbox(r)
+	if err != nil {
+		return err
+	}
+
+	cr := newCacheRequest()
+	cr.mailbox = mailbox
+	cr.oldest = oldest
+	cr.query = query
+	if err := selector(mux.Vars(r)["selector"]).parse(cr); err != nil {
+		return errNotFound // XXX: bad request
+	}
+	if err = requestFilters(r, cr); err != nil {
+		http.Error(w, err.Error(), 400)
+		return nil
+	}
+	if r.Method == "DELETE" {
 		w.Header().Set("Content-Type", "text/plain")
+		return h.deleteMessages(cr)
+	}
+	return h.writeMessages(cr, w, r)
+}
+
+// Messages dated on a day, in local time
+func (h *httpHandler) day(oldest bool) func(w http.ResponseWriter, r *http.Request) {
+	return h.handler(func(h *httpHandler, w http.ResponseWriter, r *http.Request) error {
+		day, err := time.ParseInLocation(dayFormat, mux.Vars(r)["day"], time.Local)
+		if err != nil {
+			return errNotFound
+		}
+		mailbox, err := h.mailbox(r)
+		if err != nil {
+			return err
+		}
+
+		cr := newCacheRequest()
+		cr.mailbox = mailbox
+		cr.oldest = oldest
+		if err := selector(mux.Vars(r)["selector"]).parse(cr); err != nil {
+			return errNotFound // XXX: bad request
+		}
+		if err = requestFilters(r, cr); err != nil {
+			http.Error(w, err.Error(), 400)
+			return nil
+		}
+		// Parameters can only restrict the day further
+		if cr.since.Before(day) {
+			cr.since = day
+		}
+		if end := day.AddDate(0, 0, 1); cr.until.IsZero() || cr.until.After(end) {
+			cr.until = end
+		}
+		if r.Method == "DELETE" {
+			w.Header().Set("Content-Type", "text/plain")
+			return h.deleteMessages(cr)
+		}
+		return h.writeMessages(cr, w, r)
+	})
+}
+
+// Threads with messages, the most recently active first
+func (h *httpHandler) threads() func(w http.ResponseWriter, r *http.Request) {
+	return h.handler(func(h *httpHandler, w http.ResponseWriter, r *http.Request) error {
+		if r.Method != "GET" {
+			http.Error(w, "Method not supported", 405)
+			return nil
+		}
+		mailbox, err := h.mailbox(r)
+		if err != nil {
+			return err
+		}
+		tr := newCacheThreadsRequest()
+		tr.mailbox = mailbox
+		if tr.since, tr.until, err = timeRange(r); err != nil {
+			http.Error(w, err.Error(), 400)
+			return nil
+		}
+		metrics.cacheSend("threads", func() { h.cache.threadsCh <- tr })
+		threads := <-tr.data
+
+		if wantsJSON(r) {
+			w.Header().Set("Content-Type", "application/json")
+			return json.NewEncoder(w).Encode(threads)
+		}
+		tw := newThreadsTemplate(threads)
+		if mailbox != "" {
+			tw.prefix = "/mbox/" + url.PathEscape(mailbox)
+		}
+		tmpl := newTemplate()
+		w.Header().Set("Content-Type", "text/html")
+		return tmpl.render(w, tw)
+	})
+}
+
+// Messages in a thread, in order of date
+func (h *httpHandler) thread(oldest bool) func(w http.ResponseWriter, r *http.Request) {
+	return h.handler(func(h *httpHandler, w http.ResponseWriter, r *http.Request) error {
+		mailbox, err := h.mailbox(r)
+		if err != nil {
+			return err
+		}
+
+		cr := newCacheRequest()
+		cr.mailbox = mailbox
+		cr.oldest = oldest
+		cr.thread = mux.Vars(r)["thread"]
+		if err := selector(mux.Vars(r)["selector"]).parse(cr); err != nil {
+			return errNotFound // XXX: bad request
+		}
+		if err = requestFilters(r, cr); err != nil {
+			http.Error(w, err.Error(), 400)
+			return nil
+		}
 		if r.Method == "DELETE" {
+			w.Header().Set("Content-Type", "text/plain")
 			return h.deleteMessages(cr)
 		}
-		return h.writeMessages(cr, w)
+		return h.writeMessages(cr, w, r)
+	})
+}
+
+// Parameters restricting the messages selected by cr
+func requestFilters(r *http.Request, cr *cacheRequest) (err error) {
+	if cr.since, cr.until, err = timeRange(r); err != nil {
+		return err
+	}
+	if unread := r.URL.Query().Get("unread"); unread != "" {
+		if cr.unread, err = strconv.ParseBool(unread); err != nil {
+			return errors.New("Invalid unread parameter")
+		}
+	}
+	return nil
+}
+
+// Time range of the "since" and "until" parameters; zero times are no limit
+func timeRange(r *http.Request) (since, until time.Time, err error) {
+	query := r.URL.Query()
+	now := time.Now()
+	if s := query.Get("since"); s != "" {
+		if since, err = parseTime(s, now); err != nil {
+			return
+		}
+	}
+	if s := query.Get("until"); s != "" {
+		if until, err = parseTime(s, now); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Deliver the messages in the body of the request to the mailbox. The body
+// is one RFC 822 message or several in mbox format. Responds with the ids
+// of the new messages once they are indexed.
+func (h *httpHandler) deliver() func(w http.ResponseWriter, r *http.Request) {
+	return h.handler(func(h *httpHandler, w http.ResponseWriter, r *http.Request) error {
+		if r.Method != "POST" {
+			http.Error(w, "Method not supported", 405)
+			return nil
+		}
+		mailbox, err := h.mailbox(r)
+		if err != nil {
+			return err
+		}
+		dir := h.config.mailboxes[0].path
+		if mailbox != "" {
+			if dir, err = h.config.mailboxes.dir(mailbox); err != nil {
+				return errNotFound
+			}
+		}
+
+		data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, httpMaxDelivery))
+		if err != nil {
+			http.Error(w, err.Error(), 413)
+			return nil
+		}
+		msgs := [][]byte{data}
+		if isMbox(data) {
+			msgs = splitMbox(data)
+		}
+		if len(msgs) == 0 || len(data) == 0 {
+			http.Error(w, "No message", 400)
+			return nil
+		}
+		for i, msg := range msgs {
+			if _, err := mail.ReadMessage(bytes.NewReader(msg)); err != nil {
+				http.Error(w, fmt.Sprintf("Message %d: %s", i+1, err), 400)
+				return nil
+			}
+		}
+
+		// All messages or none, so that clients can send them again. Until
+		// all are written in tmp/, nobody else sees any of them.
+		tmps := make([]string, 0, len(msgs))
+		rollback := func(paths []string) {
+			for _, p := range paths {
+				if err := os.Remove(p); err != nil {
+					log.Print("cannot remove partial delivery ", p, ": ", err)
+				}
+			}
+		}
+		for _, msg := range msgs {
+			tmp, err := maildirWrite(dir, bytes.NewReader(msg))
+			if err != nil {
+				rollback(tmps)
+				return err
+			}
+			tmps = append(tmps, tmp)
+		}
+		paths := make([]string, 0, len(msgs))
+		for i, tmp := range tmps {
+			path, err := maildirPublish(tmp)
+			if err != nil {
+				rollback(tmps[i+1:])
+				rollback(paths)
+				// Messages seen in new/ in the meantime are removed from the index
+				h.crawler.rescan()
+				return err
+			}
+			paths = append(paths, path)
+		}
+
+		files := h.crawler.deliver(paths)
+		ids := make([]string, len(files))
+		for i, f := range files {
+			ids[i] = f.id()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		return json.NewEncoder(w).Encode(ids)
+	})
+}
+
+// Changes to the flags of a message, by name (like "seen")
+type flagsPatch struct {
+	Flags  *[]string `json:"flags"` // Replace all flags
+	Add    []string  `json:"add"`
+	Remove []string  `json:"remove"`
+}
+
+// Letters of the flags of file after applying the patch. Unknown
+// letters already in the file name are kept.
+func (p *flagsPatch) apply(file mailFile) (string, error) {
+	set := make(map[byte]bool)
+	for _, f := range []byte(file.info()) {
+		_, known := maildirFlags[f]
+		set[f] = p.Flags == nil || !known
+	}
+	change := func(names []string, value bool) error {
+		for _, name := range names {
+			f, found := maildirFlag(name)
+			if !found {
+				return fmt.Errorf("Unknown flag: %s", name)
+			}
+			set[f] = value
+		}
+		return nil
+	}
+	if p.Flags != nil {
+		if err := change(*p.Flags, true); err != nil {
+			return "", err
+		}
+	}
+	if err := change(p.Add, true); err != nil {
+		return "", err
+	}
+	if err := change(p.Remove, false); err != nil {
+		return "", err
+	}
+
+	info := make([]byte, 0, len(set))
+	for f, on := range set {
+		if on {
+			info = append(info, f)
+		}
+	}
+	return string(info), nil
+}
+
+// A message by id: GET returns it (raw, as mbox or JSON), PATCH changes
+// its flags and DELETE removes it.
+func (h *httpHandler) message() func(w http.ResponseWriter, r *http.Request) {
+	return h.handler(func(h *httpHandler, w http.ResponseWriter, r *http.Request) error {
+		file, err := h.findMessage(mux.Vars(r)["id"])
+		if err != nil {
+			return err
+		}
+
+		switch r.Method {
+		case "GET":
+			return h.writeMessage(file, w, r)
+		case "PATCH":
+			return h.patchFlags(file, w, r)
+		case "DELETE":
+			failed := mailFiles{file}.delete()
+			h.crawler.rescan()
+			if len(failed) > 0 {
+				return errors.New("Cannot remove message")
+			}
+			w.Header().Set("Content-Type", "text/plain")
+			return nil
+		}
+		http.Error(w, "Method not supported", 405)
+		return nil
+	})
+}
+
+// Move or copy a message to the mailbox in parameter "to"
+func (h *httpHandler) transfer(copy bool) func(w http.ResponseWriter, r *http.Request) {
+	return h.handler(func(h *httpHandler, w http.ResponseWriter, r *http.Request) error {
+		if r.Method != "POST" {
+			http.Error(w, "Method not supported", 405)
+			return nil
+		}
+		file, err := h.findMessage(mux.Vars(r)["id"])
+		if err != nil {
+			return err
+		}
+
+		mailbox := r.URL.Query().Get("to")
+		if mailbox == "" {
+			http.Error(w, "Missing destination mailbox", 400)
+			return nil
+		}
+		if !h.config.mailboxes.exists(mailbox) {
+			http.Error(w, "Unknown mailbox: "+mailbox, 404)
+			return nil
+		}
+		if !copy && mailbox == file.folder {
+			http.Error(w, "Message already in mailbox "+mailbox, 409)
+			return nil
+		}
+		dir, err := h.config.mailboxes.dir(mailbox)
+		if err != nil {
+			return err
+		}
+
+		// Keep new/ or cur/ and the flags
+		name := filepath.Base(file.file)
+		if copy {
+			name = maildirUniqueName() + name[len(file.unique()):]
+		}
+		to := filepath.Join(dir, filepath.Dir(file.file), name)
+
+		if copy {
+			file, err = h.crawler.copyFile(file, to)
+		} else {
+			file, err = h.crawler.renameFile(file, to)
+		}
+		switch {
+		case os.IsExist(err):
+			http.Error(w, "A message with the same name is already in mailbox "+mailbox, 409)
+			return nil
+		case os.IsNotExist(err):
+			return errNotFound
+		case err != nil:
+			return err
+		}
+		if copy {
+			return h.writeMessageJSONStatus(file, w, http.StatusCreated)
+		}
+		return h.writeMessageJSON(file, w)
+	})
+}
+
+func (h *httpHandler) writeMessage(file mailFile, w http.ResponseWriter, r *http.Request) error {
+	if wantsJSON(r) {
+		return h.writeMessageJSON(file, w)
+	}
+	if r.URL.Query().Get("format") == "mbox" {
+		return h.writeFiles(mailFiles{file}, w, r)
+	}
+
+	f, err := os.Open(file.filename())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return errNotFound
+		}
+		return err
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "text/plain")
+	_, err = io.Copy(w, f)
+	return err
+}
+
+func (h *httpHandler) writeMessageJSON(file mailFile, w http.ResponseWriter) error {
+	return h.writeMessageJSONStatus(file, w, http.StatusOK)
+}
+
+// The JSON is written in full before the status, so that errors reading
+// the message can still be reported
+func (h *httpHandler) writeMessageJSONStatus(file mailFile, w http.ResponseWriter, status int) error {
+	tr := newCacheThreadsRequest()
+	tr.files = mailFiles{file}
+	metrics.cacheSend("threads", func() { h.cache.threadsCh <- tr })
+	threads := <-tr.data
+
+	var buf bytes.Buffer
+	if err := file.writeJSON(&buf, h.indexer.keys(), threads[0].ID); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// Change the flags of a message, renaming its file
+func (h *httpHandler) patchFlags(file mailFile, w http.ResponseWriter, r *http.Request) error {
+	var patch flagsPatch
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), 400)
+		return nil
+	}
+	info, err := patch.apply(file)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return nil
+	}
+
+	if to := file.withInfo(info); to != file.filename() {
+		if file, err = h.crawler.renameFile(file, to); err != nil {
+			if os.IsExist(err) {
+				http.Error(w, "Message file already exists", 409)
+				return nil
+			}
+			if os.IsNotExist(err) {
+				return errNotFound
+			}
+			return err
+		}
+	}
+	return h.writeMessageJSON(file, w)
+}
+
+func (h *httpHandler) findMessage(id string) (mailFile, error) {
+	cr := newCacheFindRequest(id)
+	metrics.cacheSend("find", func() { h.cache.findCh <- cr })
+	m, ok := <-cr.data
+	if !ok {
+		return m, errNotFound
+	}
+	return m, nil
+}
+
+func (h *httpHandler) parts() func(w http.ResponseWriter, r *http.Request) {
+	return h.handler(func(h *httpHandler, w http.ResponseWriter, r *http.Request) error {
+		if r.Method != "GET" {
+			http.Error(w, "Method not supported", 405)
+			return nil
+		}
+		m, err := h.findMessage(mux.Vars(r)["id"])
+		if err != nil {
+			return err
+		}
+		jm, err := newJSONMessage(m, h.indexer.keys())
+		if err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(jm.Parts)
+	})
+}
+
+func (h *httpHandler) part() func(w http.ResponseWriter, r *http.Request) {
+	return h.handler(func(h *httpHandler, w http.ResponseWriter, r *http.Request) error {
+		if r.Method != "GET" {
+			http.Error(w, "Method not supported", 405)
+			return nil
+		}
+		vars := mux.Vars(r)
+		m, err := h.findMessage(vars["id"])
+		if err != nil {
+			return err
+		}
+		return findPart(m.filename(), vars["path"], func(p *mimePart, body io.Reader) error {
+			w.Header().Set("Content-Type", p.mediaType())
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			w.Header().Set("Content-Security-Policy", "sandbox")
+			if cd := p.contentDisposition(); cd != "" {
+				w.Header().Set("Content-Disposition", cd)
+			}
+			_, err := io.Copy(w, body)
+			return err
+		})
+	})
+}
+
+const (
+	waitDefaultTimeout = 30 * time.Second
+	waitMaxTimeout     = 10 * time.Minute
+)
+
+// Block until a message matching key and value is indexed after the cursor
+// passed as "after" (or after the request arrived), or until the timeout.
+func (h *httpHandler) wait(key string) func(w http.ResponseWriter, r *http.Request) {
+	return h.handler(func(h *httpHandler, w http.ResponseWriter, r *http.Request) error {
+		if r.Method != "GET" {
+			http.Error(w, "Method not supported", 405)
+			return nil
+		}
+		if !h.indexer.keys().has(key) {
+			return errNotFound
+		}
+
+		mailbox, err := h.mailbox(r)
+		if err != nil {
+			return err
+		}
+
+		cw := newCacheWait()
+		cw.mailbox = mailbox
+		cw.header = key
+		cw.value = mux.Vars(r)["value"]
+		cw.match = h.indexer.keys().keyType(key)
+		if cw.since, cw.until, err = timeRange(r); err != nil {
+			http.Error(w, err.Error(), 400)
+			return nil
+		}
+
+		query := r.URL.Query()
+		timeout := waitDefaultTimeout
+		if t := query.Get("timeout"); t != "" {
+			var err error
+			if timeout, err = time.ParseDuration(t); err != nil || timeout < 0 {
+				http.Error(w, "Invalid timeout", 400)
+				return nil
+			}
+		}
+		if timeout > waitMaxTimeout {
+			timeout = waitMaxTimeout
+		}
+		if after := query.Get("after"); after != "" {
+			var err error
+			switch cw.after, err = h.cache.parseCursor(after); err {
+			case nil:
+			case errStaleCursor:
+				// Serials start again: the client must get a new cursor
+				http.Error(w, err.Error(), 409)
+				return nil
+			default:
+				http.Error(w, err.Error(), 400)
+				return nil
+			}
+		} else {
+			cw.latest = true
+		}
+
+		// Lift the server write timeout for this request
+		rc := http.NewResponseController(w)
+		if err := rc.SetWriteDeadline(time.Now().Add(timeout + 15*time.Second)); err != nil {
+			log.Print(r.URL.Path, ": cannot extend write deadline: ", err)
+		}
+
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+		metrics.cacheSend("wait", func() { h.cache.waitCh <- cw })
+		var res cacheWaitResult
+		select {
+		case res = <-cw.data:
+		case <-timer.C:
+			metrics.cacheSend("cancel", func() { h.cache.cancelCh <- cw })
+			res = <-cw.data
+		case <-r.Context().Done():
+			metrics.cacheSend("cancel", func() { h.cache.cancelCh <- cw })
+			res = <-cw.data
+		}
+
+		w.Header().Set("X-Perso-Cursor", h.cache.formatCursor(res.cursor))
+		if !res.found {
+			w.WriteHeader(http.StatusNoContent)
+			return nil
+		}
+		return h.writeFiles(mailFiles{res.file}, w, r)
+	})
+}
+
+// Interval between comments sent to keep idle event streams open
+const eventsKeepalive = 15 * time.Second
+
+// Stream changes to the index as Server-Sent Events
+func (h *httpHandler) events(key string) func(w http.ResponseWriter, r *http.Request) {
+	return h.handler(func(h *httpHandler, w http.ResponseWriter, r *http.Request) error {
+		if r.Method != "GET" {
+			http.Error(w, "Method not supported", 405)
+			return nil
+		}
+		if !h.indexer.keys().has(key) {
+			return errNotFound
+		}
+
+		mailbox, err := h.mailbox(r)
+		if err != nil {
+			return err
+		}
+
+		s := newCacheSubscriber()
+		s.mailbox = mailbox
+		s.header = key
+		s.value = mux.Vars(r)["value"]
+		s.match = h.indexer.keys().keyType(key)
+
+		lastID := r.Header.Get("Last-Event-ID")
+		if lastID == "" {
+			lastID = r.URL.Query().Get("lastEventId")
+		}
+		// Ids from before a restart are not known anymore: start again
+		var stale bool
+		if lastID != "" {
+			var err error
+			switch s.lastID, err = h.cache.parseCursor(lastID); err {
+			case nil:
+				s.resume = true
+			case errStaleCursor:
+				stale = true
+			default:
+				http.Error(w, "Invalid event ID", 400)
+				return nil
+			}
+		}
+
+		rc := http.NewResponseController(w)
+		if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+			log.Print(r.URL.Path, ": cannot disable write deadline: ", err)
+		}
+
+		metrics.cacheSend("sub", func() { h.cache.subCh <- s })
+		defer func() {
+			metrics.cacheSend("unsub", func() { h.cache.unsubCh <- s })
+		}()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(200)
+
+		replay := <-s.replay
+		if replay == nil || stale {
+			if _, err := io.WriteString(w, "event: reset\ndata: {}\n\n"); err != nil {
+				return nil
+			}
+		}
+		for _, e := range replay {
+			if err := e.writeTo(w, h.cache); err != nil {
+				return nil
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return nil
+		}
+
+		keepalive := time.NewTicker(eventsKeepalive)
+		defer keepalive.Stop()
+
+		for {
+			select {
+			case e, ok := <-s.events:
+				if !ok {
+					return nil
+				}
+				if err := e.writeTo(w, h.cache); err != nil {
+					return nil
+				}
+			case <-keepalive.C:
+				if _, err := io.WriteString(w, ": keepalive\n\n"); err != nil {
+					return nil
+				}
+			case <-r.Context().Done():
+				return nil
+			}
+			if err := rc.Flush(); err != nil {
+				return nil
+			}
+		}
 	})
 }
 
 func (h *httpHandler) list(k string) func(w http.ResponseWriter, r *http.Request) {
 	return h.handler(func(h *httpHandler, w http.ResponseWriter, r *http.Request) error {
+		mailbox, err := h.mailbox(r)
+		if err != nil {
+			return err
+		}
 		cr, err := makeCacheListRequest(k)
 		if err != nil {
 			return err
 		}
-		h.cache.listCh <- cr
-		data := <-cr.data
-		if data == nil || len(data) == 0 {
-			return errNotFound
+		cr.mailbox = mailbox
+		if cr.since, cr.until, err = timeRange(r); err != nil {
+			http.Error(w, err.Error(), 400)
+			return nil
 		}
-		tmpl := newTemplate()
-		tw := newListTemplate(cr.header, data)
+		return h.writeList(cr, w)
+	})
+}
+
+// Days with messages, linking to the messages of each day
+func (h *httpHandler) days() func(w http.ResponseWriter, r *http.Request) {
+	return h.handler(func(h *httpHandler, w http.ResponseWriter, r *http.Request) error {
+		mailbox, err := h.mailbox(r)
+		if err != nil {
+			return err
+		}
+		cr := newCacheListRequest()
+		cr.mailbox = mailbox
+		cr.header = "date"
+		cr.days = true
+		if cr.since, cr.until, err = timeRange(r); err != nil {
+			http.Error(w, err.Error(), 400)
+			return nil
+		}
+		return h.writeList(cr, w)
+	})
+}
+
+func (h *httpHandler) writeList(cr *cacheListRequest, w http.ResponseWriter) error {
+	metrics.cacheSend("list", func() { h.cache.listCh <- cr })
+	data := <-cr.data
+	if data == nil || len(data) == 0 {
+		return errNotFound
+	}
+	tmpl := newTemplate()
+	tw := newListTemplate(cr.header, data)
+	if cr.mailbox != "" {
+		tw.prefix = "/mbox/" + url.PathEscape(cr.mailbox)
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	return tmpl.render(w, tw)
+}
 
+func (h *httpHandler) mailboxes() func(w http.ResponseWriter, r *http.Request) {
+	return h.handler(func(h *httpHandler, w http.ResponseWriter, r *http.Request) error {
+		if r.Method != "GET" {
+			http.Error(w, "Method not supported", 405)
+			return nil
+		}
+		cr := newCacheMailboxesRequest()
+		metrics.cacheSend("mailboxes", func() { h.cache.mboxCh <- cr })
+		counts := <-cr.data
+		for _, name := range h.config.mailboxes.names() {
+			if _, found := counts[name]; !found {
+				counts[name] = 0
+			}
+		}
+
+		if wantsJSON(r) {
+			w.Header().Set("Content-Type", "application/json")
+			return json.NewEncoder(w).Encode(counts)
+		}
+		tmpl := newTemplate()
 		w.Header().Set("Content-Type", "text/html")
-		return tmpl.render(w, tw)
+		return tmpl.render(w, newMailboxesTemplate(counts))
 	})
 }
 
@@ -139,31 +1063,72 @@ func (h *httpHandler) handler(fn func(h *httpHandler, w http.ResponseWriter, r *
 	}
 }
 
-func (h *httpHandler) writeMessages(cr *cacheRequest, w io.Writer) error {
-	cr.match = h.indexer.keys.keyType(cr.header)
+// Clients can ask for JSON instead of mbox with the "format" parameter
+// or via the Accept header.
+func wantsJSON(r *http.Request) bool {
+	switch r.URL.Query().Get("format") {
+	case "json":
+		return true
+	case "mbox":
+		return false
+	}
+	for _, accept := range r.Header["Accept"] {
+		for _, t := range strings.Split(accept, ",") {
+			if mt := strings.TrimSpace(strings.SplitN(t, ";", 2)[0]); mt == "application/json" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (h *httpHandler) writeMessages(cr *cacheRequest, w http.ResponseWriter, r *http.Request) error {
+	cr.match = h.indexer.keys().keyType(cr.header)
 
-	h.cache.requestCh <- cr
+	metrics.cacheSend("request", func() { h.cache.requestCh <- cr })
 	data := <-cr.data
 
 	if data == nil || len(data) == 0 {
 		return errNotFound
 	}
 
+	return h.writeFiles(data, w, r)
+}
+
+func (h *httpHandler) writeFiles(data mailFiles, w http.ResponseWriter, r *http.Request) error {
+	if wantsJSON(r) {
+		return h.writeJSON(data, w)
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
 	data.writeTo(w, h.config)
 	return nil
 }
 
+func (h *httpHandler) writeJSON(data mailFiles, w http.ResponseWriter) error {
+	tr := newCacheThreadsRequest()
+	tr.files = data
+	metrics.cacheSend("threads", func() { h.cache.threadsCh <- tr })
+	threads := <-tr.data
+
+	w.Header().Set("Content-Type", "application/json")
+	return data.writeJSON(w, h.indexer.keys(), threads)
+}
+
 func (h *httpHandler) deleteMessages(cr *cacheRequest) error {
-	cr.match = h.indexer.keys.keyType(cr.header)
+	cr.match = h.indexer.keys().keyType(cr.header)
 
-	h.cache.requestCh <- cr
+	metrics.cacheSend("request", func() { h.cache.requestCh <- cr })
 	msgs := <-cr.data
 
 	if msgs == nil || len(msgs) == 0 {
 		return errNotFound
 	}
 
-	msgs.delete()
+	failed := msgs.delete()
 	h.crawler.rescan()
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d messages not removed", len(failed), len(msgs))
+	}
 	return nil
 }
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// Response of the wait handler, with the cursor it gave
+func testWait(h *httpHandler, query string) (int, string, string) {
+	w := httptest.NewRecorder()
+	h.wait("")(w, httptest.NewRequest("GET", "/wait?"+query, nil))
+	return w.Code, w.Header().Get("X-Perso-Cursor"), w.Body.String()
+}
+
+func TestWaitAfter(t *testing.T) {
+	dir := testMaildir(t, map[string]string{
+		"cur/1500000001.M1P1.host:2,S": "Subject: one\n\nbody\n",
+		"cur/1500000002.M1P1.host:2,S": "Subject: two\n\nbody\n",
+	})
+	defer os.RemoveAll(dir)
+	cache, c := testCrawler(t, dir)
+	c.scan()
+	h := newHttpHandler(nil, cache, newConfig(), c, c.indexer)
+
+	code, latest, _ := testWait(h, "timeout=0")
+	if code != 204 || latest != cache.formatCursor(2) {
+		t.Fatalf("expected no message and the latest cursor, got %d %s", code, latest)
+	}
+
+	// Messages are returned in the order they were indexed
+	code, cursor, body := testWait(h, "timeout=0&after="+cache.formatCursor(0))
+	if code != 200 || cursor != cache.formatCursor(1) {
+		t.Fatalf("expected the first message, got %d %s", code, cursor)
+	}
+	first := body
+	code, cursor, body = testWait(h, "timeout=0&after="+cursor)
+	if code != 200 || cursor != latest || body == first {
+		t.Fatalf("expected the second message, got %d %s", code, cursor)
+	}
+
+	// A message indexed while waiting
+	done := make(chan string)
+	go func() {
+		code, cursor, body := testWait(h, "timeout=10s&after="+latest)
+		if code != 200 || cursor != cache.formatCursor(3) {
+			t.Errorf("expected the third message, got %d %s", code, cursor)
+		}
+		done <- body
+	}()
+	file := filepath.Join(dir, "new", "1500000003.M1P1.host")
+	if err := ioutil.WriteFile(file, []byte("Subject: three\n\nbody\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c.scan()
+	if body := <-done; !strings.Contains(body, "Subject: three") {
+		t.Error("unexpected message ", body)
+	}
+
+	// Cursors from before a restart are refused
+	restarted := &caches{epoch: cache.epoch - 1}
+	for query, expected := range map[string]int{
+		"after=" + restarted.formatCursor(1): 409,
+		"after=1":                            409,
+		"after=one":                          400,
+		"after=" + strings.SplitN(latest, "-", 2)[0] + "-x": 400,
+	} {
+		if code, _, _ := testWait(h, "timeout=0&"+query); code != expected {
+			t.Errorf("%s: expected %d, got %d", query, expected, code)
+		}
+	}
+}
+
+func TestDeleteMessage(t *testing.T) {
+	dir := testMaildir(t, map[string]string{
+		"cur/1500000001.M1P1.host:2,S": "Subject: one\n\nbody\n",
+		"cur/1500000002.M1P1.host:2,S": "Subject: two\n\nbody\n",
+	})
+	defer os.RemoveAll(dir)
+	cache, c := testCrawler(t, dir)
+	c.scan()
+	go c.run(nil, nil)
+	h := newHttpHandler(nil, cache, newConfig(), c, c.indexer)
+	router := mux.NewRouter()
+	router.HandleFunc("/msg/{id}", h.message())
+
+	files := make(map[string]mailFile)
+	for file := range testDump(cache) {
+		files[filepath.Base(file.filename())] = file
+	}
+	one, two := files["1500000001.M1P1.host:2,S"], files["1500000002.M1P1.host:2,S"]
+
+	// Removed by someone else in the meantime: not deleted by this request
+	if err := os.Remove(two.filename()); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("DELETE", "/msg/"+two.id(), nil))
+	if w.Code != 500 {
+		t.Error("expected an error, got ", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("DELETE", "/msg/"+one.id(), nil))
+	if w.Code != 200 {
+		t.Error("expected the message to be deleted, got ", w.Code)
+	}
+	if _, err := os.Stat(one.filename()); !os.IsNotExist(err) {
+		t.Error("message not removed ", err)
+	}
+}
+
+func TestFlagsPatch(t *testing.T) {
+	flags := func(names ...string) *[]string { return &names }
+	tests := []struct {
+		path     string
+		patch    flagsPatch
+		expected string
+	}{
+		{"/mail/new/1.host", flagsPatch{Add: []string{"seen"}}, "S"},
+		{"/mail/cur/1.host:2,S", flagsPatch{Add: []string{"seen"}}, "S"},
+		{"/mail/cur/1.host:2,S", flagsPatch{Add: []string{"flagged", "replied"}, Remove: []string{"seen"}}, "FR"},
+		{"/mail/cur/1.host:2,F", flagsPatch{Remove: []string{"seen"}}, "F"},
+		{"/mail/cur/1.host:2,FS", flagsPatch{Flags: flags()}, ""},
+		{"/mail/cur/1.host:2,Sa", flagsPatch{Flags: flags("flagged")}, "Fa"},
+		{"/mail/cur/1.host:2,Sa", flagsPatch{Flags: flags("draft", "seen"), Add: []string{"trashed"}}, "DSTa"},
+	}
+	for _, test := range tests {
+		file, err := makeMailFile(test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := test.patch.apply(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		letters := []byte(info)
+		sort.Slice(letters, func(i, j int) bool { return letters[i] < letters[j] })
+		if string(letters) != test.expected {
+			t.Errorf("%s with %+v: expected %q, got %q", test.path, test.patch, test.expected, letters)
+		}
+	}
+
+	file, _ := makeMailFile("/mail/cur/1.host:2,S")
+	if _, err := (&flagsPatch{Add: []string{"important"}}).apply(file); err == nil {
+		t.Error("expected an error for an unknown flag")
+	}
+}
+
+func TestTransferMessage(t *testing.T) {
+	dir := testMaildir(t, map[string]string{
+		"cur/1500000001.M1P1.host:2,S": "Subject: one\n\nbody\n",
+		"cur/1500000002.M1P1.host:2,S": "Subject: two\n\nbody\n",
+	})
+	defer os.RemoveAll(dir)
+	other := testMaildir(t, map[string]string{
+		"cur/1500000002.M1P1.host:2,S": "Subject: other\n\nbody\n",
+	})
+	defer os.RemoveAll(other)
+	cache, c := testCrawler(t, "box="+dir, "other="+other)
+	c.scan()
+	go c.run(nil, nil)
+	conf := newConfig()
+	conf.mailboxes = c.mailboxes
+	h := newHttpHandler(nil, cache, conf, c, c.indexer)
+	router := mux.NewRouter()
+	router.HandleFunc("/msg/{id}/move", h.transfer(false))
+	router.HandleFunc("/msg/{id}/copy", h.transfer(true))
+	post := func(url string) int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", url, nil))
+		return w.Code
+	}
+
+	one, two := "/msg/1500000001.M1P1.host", "/msg/1500000002.M1P1.host"
+	for url, expected := range map[string]int{
+		one + "/move?to=nowhere":     404,
+		one + "/copy?to=nowhere":     404,
+		one + "/move":                400,
+		one + "/move?to=box":         409,
+		two + "/move?to=other":       409,
+		"/msg/unknown/move?to=other": 404,
+	} {
+		if code := post(url); code != expected {
+			t.Errorf("%s: expected %d, got %d", url, expected, code)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "cur", "1500000002.M1P1.host:2,S")); err != nil {
+		t.Error("message moved over another one ", err)
+	}
+
+	if code := post(one + "/copy?to=box"); code != 201 {
+		t.Error("expected a copy in the same mailbox, got ", code)
+	}
+	if code := post(one + "/move?to=other"); code != 200 {
+		t.Error("expected the message to be moved, got ", code)
+	}
+	if _, err := os.Stat(filepath.Join(other, "cur", "1500000001.M1P1.host:2,S")); err != nil {
+		t.Error("message not moved ", err)
+	}
+	if code := post(one + "/copy?to=box"); code != 201 {
+		t.Error("expected a copy back, got ", code)
+	}
+	if copies, _ := filepath.Glob(filepath.Join(dir, "cur", "*")); len(copies) != 3 {
+		t.Error("expected two copies and the second message, got ", copies)
+	}
+}
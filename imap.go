@@ -0,0 +1,1001 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	imapIdleTimeout = 30 * time.Minute // Minimum autologout timer (RFC 3501, 5.4)
+	imapMaxLine     = 64 << 10
+	imapMaxLiteral  = 64 << 10 // Only small literals are expected, like passwords
+	imapDelimiter   = "."      // Separates the folders in mailbox names
+)
+
+// Flags of messages and their Maildir letters
+var imapFlags = []struct {
+	name   string
+	letter byte
+}{
+	{`\Answered`, 'R'},
+	{`\Flagged`, 'F'},
+	{`\Deleted`, 'T'},
+	{`\Seen`, 'S'},
+	{`\Draft`, 'D'},
+	{`$Forwarded`, 'P'},
+}
+
+var errIMAPLiteral = errors.New("Literal too large")
+
+// Read-only IMAP server (RFC 3501) for the indexed mailboxes. The first
+// mailbox on the command line is INBOX.
+type imapServer struct {
+	listen   string
+	cache    *caches
+	indexer  *mailIndexer
+	tls      *tls.Config
+	validity uint32       // UIDs are serials of the caches, valid until restarted
+	conf     atomic.Value // *config, replaced when reloaded
+}
+
+func newIMAPServer(listen string, cache *caches, indexer *mailIndexer, conf *config, tlsConf *tls.Config) *imapServer {
+	s := &imapServer{
+		listen:   listen,
+		cache:    cache,
+		indexer:  indexer,
+		tls:      tlsConf,
+		validity: uint32(time.Now().Unix()),
+	}
+	s.setConfig(conf)
+	return s
+}
+
+func (s *imapServer) config() *config {
+	return s.conf.Load().(*config)
+}
+
+// Use the mailboxes and clients of a new configuration for new commands
+func (s *imapServer) setConfig(conf *config) {
+	s.conf.Store(conf)
+}
+
+func (s *imapServer) run() error {
+	ln, err := net.Listen("tcp", s.listen)
+	if err != nil {
+		return err
+	}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Print("imap: accept: ", err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go newIMAPSession(s, conn).serve()
+	}
+}
+
+// Name of a mailbox in IMAP: the first root and its folders are in INBOX
+func (s *imapServer) imapName(conf *config, folder string) string {
+	inbox := conf.mailboxes[0].name
+	if folder == inbox {
+		return "INBOX"
+	}
+	if strings.HasPrefix(folder, inbox+imapDelimiter) {
+		return "INBOX" + folder[len(inbox):]
+	}
+	return folder
+}
+
+// Name of the mailbox for an IMAP name
+func (s *imapServer) folder(conf *config, name string) string {
+	inbox := conf.mailboxes[0].name
+	if strings.EqualFold(name, "INBOX") {
+		return inbox
+	}
+	if len(name) > 5 && strings.EqualFold(name[:6], "INBOX"+imapDelimiter) {
+		return inbox + name[5:]
+	}
+	return name
+}
+
+// An argument of a command: an atom, a string or a list
+type imapArg struct {
+	value  string
+	quoted bool // A quoted string or a literal, not an atom
+	list   []imapArg
+	isList bool
+}
+
+// A command read from the client: text before and after each literal
+type imapLine struct {
+	text     []string
+	literals []string
+}
+
+// Split a command in arguments. Atoms like BODY[HEADER.FIELDS (FROM)]<0.10>
+// keep what is between brackets.
+type imapLexer struct {
+	line *imapLine
+	part int
+	pos  int
+}
+
+var errIMAPSyntax = errors.New("Syntax error")
+
+func parseIMAPLine(line *imapLine) ([]imapArg, error) {
+	l := &imapLexer{line: line}
+	args, err := l.parseList(false)
+	if err != nil {
+		return nil, err
+	}
+	return args, nil
+}
+
+func (l *imapLexer) text() string {
+	return l.line.text[l.part]
+}
+
+func (l *imapLexer) parseList(nested bool) ([]imapArg, error) {
+	args := make([]imapArg, 0)
+	for {
+		text := l.text()
+		for l.pos < len(text) && text[l.pos] == ' ' {
+			l.pos++
+		}
+		if l.pos >= len(text) {
+			if nested {
+				return nil, errIMAPSyntax
+			}
+			return args, nil
+		}
+
+		switch text[l.pos] {
+		case '(':
+			l.pos++
+			list, err := l.parseList(true)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, imapArg{list: list, isList: true})
+		case ')':
+			if !nested {
+				return nil, errIMAPSyntax
+			}
+			l.pos++
+			return args, nil
+		case '"':
+			s, err := l.quoted()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, imapArg{value: s, quoted: true})
+		case '{':
+			// Literals are always at the end of a part of the line
+			end := strings.IndexByte(text[l.pos:], '}')
+			if end < 0 || l.pos+end != len(text)-1 || l.part >= len(l.line.literals) {
+				return nil, errIMAPSyntax
+			}
+			args = append(args, imapArg{value: l.line.literals[l.part], quoted: true})
+			l.part++
+			l.pos = 0
+		default:
+			args = append(args, imapArg{value: l.atom()})
+		}
+	}
+}
+
+func (l *imapLexer) quoted() (string, error) {
+	text := l.text()
+	var b strings.Builder
+	for i := l.pos + 1; i < len(text); i++ {
+		switch c := text[i]; c {
+		case '\\':
+			i++
+			if i >= len(text) {
+				return "", errIMAPSyntax
+			}
+			b.WriteByte(text[i])
+		case '"':
+			l.pos = i + 1
+			return b.String(), nil
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", errIMAPSyntax
+}
+
+func (l *imapLexer) atom() string {
+	text := l.text()
+	start, depth := l.pos, 0
+	for ; l.pos < len(text); l.pos++ {
+		switch text[l.pos] {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ' ', '(', ')':
+			if depth <= 0 {
+				return text[start:l.pos]
+			}
+		}
+	}
+	return text[start:]
+}
+
+// Ranges of numbers like "1:4,7,9:*"
+type imapSeqSet []struct {
+	from, to uint64 // Zero is "*"
+}
+
+func parseIMAPSeqSet(s string) (imapSeqSet, error) {
+	if s == "" {
+		return nil, errIMAPSyntax
+	}
+	set := make(imapSeqSet, 0)
+	for _, r := range strings.Split(s, ",") {
+		from, to := r, r
+		if i := strings.IndexByte(r, ':'); i >= 0 {
+			from, to = r[:i], r[i+1:]
+		}
+		var (
+			n   [2]uint64
+			err error
+		)
+		for i, v := range []string{from, to} {
+			if v == "*" {
+				continue
+			}
+			if n[i], err = strconv.ParseUint(v, 10, 32); err != nil || n[i] == 0 {
+				return nil, errIMAPSyntax
+			}
+		}
+		set = append(set, struct{ from, to uint64 }{n[0], n[1]})
+	}
+	return set, nil
+}
+
+// Whether n is in the set, max is the value of "*"
+func (set imapSeqSet) contains(n, max uint64) bool {
+	for _, r := range set {
+		from, to := r.from, r.to
+		if from == 0 {
+			from = max
+		}
+		if to == 0 {
+			to = max
+		}
+		if from > to {
+			from, to = to, from
+		}
+		if n >= from && n <= to {
+			return true
+		}
+	}
+	return false
+}
+
+// Format a string as a quoted string, or as a literal if it cannot be quoted
+func imapString(s string) string {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c == '\r' || c == '\n' || c == 0 || c > '~' {
+			return fmt.Sprintf("{%d}\r\n%s", len(s), s)
+		}
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+func imapNString(s string) string {
+	if s == "" {
+		return "NIL"
+	}
+	return imapString(s)
+}
+
+// Flags of a message in IMAP
+func imapMessageFlags(file mailFile) string {
+	info := file.info()
+	flags := make([]string, 0)
+	for _, f := range imapFlags {
+		if strings.IndexByte(info, f.letter) >= 0 {
+			flags = append(flags, f.name)
+		}
+	}
+	return "(" + strings.Join(flags, " ") + ")"
+}
+
+type imapSession struct {
+	server  *imapServer
+	conn    net.Conn
+	r       *bufio.Reader
+	w       *bufio.Writer
+	isTLS   bool
+	logged  bool
+	grant   *authGrant // Nil if all is allowed
+	folder  string     // Selected mailbox, if any
+	msgs    []cacheUID // Messages of the selected mailbox, by sequence number
+	fetched *imapMessage
+}
+
+func newIMAPSession(s *imapServer, conn net.Conn) *imapSession {
+	return &imapSession{
+		server: s,
+		conn:   conn,
+		r:      bufio.NewReader(conn),
+		w:      bufio.NewWriter(conn),
+	}
+}
+
+func (s *imapSession) capabilities() string {
+	caps := "IMAP4rev1 IDLE UNSELECT"
+	if s.server.tls != nil && !s.isTLS {
+		// Passwords are only sent encrypted when possible
+		caps += " STARTTLS LOGINDISABLED"
+	}
+	return caps
+}
+
+func (s *imapSession) untagged(format string, args ...interface{}) error {
+	_, err := fmt.Fprintf(s.w, "* "+format+"\r\n", args...)
+	return err
+}
+
+func (s *imapSession) reply(tag, status, format string, args ...interface{}) error {
+	if _, err := fmt.Fprintf(s.w, "%s %s %s\r\n", tag, status, fmt.Sprintf(format, args...)); err != nil {
+		return err
+	}
+	return s.flush()
+}
+
+func (s *imapSession) flush() error {
+	s.conn.SetWriteDeadline(time.Now().Add(imapIdleTimeout))
+	return s.w.Flush()
+}
+
+func (s *imapSession) readLine() (string, error) {
+	s.conn.SetReadDeadline(time.Now().Add(imapIdleTimeout))
+	var line []byte
+	for {
+		chunk, more, err := s.r.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		line = append(line, chunk...)
+		if len(line) > imapMaxLine {
+			return "", errIMAPSyntax
+		}
+		if !more {
+			return string(line), nil
+		}
+	}
+}
+
+// Size of the literal announced at the end of text, like "{12}", if any
+func imapLiteralSize(text string) (int, bool, bool) {
+	if !strings.HasSuffix(text, "}") {
+		return 0, false, false
+	}
+	start := strings.LastIndexByte(text, '{')
+	if start < 0 {
+		return 0, false, false
+	}
+	size := text[start+1 : len(text)-1]
+	sync := true
+	if strings.HasSuffix(size, "+") {
+		size, sync = size[:len(size)-1], false
+	}
+	n, err := strconv.Atoi(size)
+	if err != nil || n < 0 {
+		return 0, false, false
+	}
+	return n, sync, true
+}
+
+// Read a command with its literals. Returns errIMAPLiteral, with the
+// text read so far, if a literal is too large or not wanted.
+func (s *imapSession) readCommand() (*imapLine, error) {
+	line := &imapLine{}
+	for {
+		text, err := s.readLine()
+		if err != nil {
+			return nil, err
+		}
+		line.text = append(line.text, text)
+
+		n, sync, found := imapLiteralSize(text)
+		if !found {
+			return line, nil
+		}
+		if n > imapMaxLiteral {
+			return line, errIMAPLiteral
+		}
+		if strings.EqualFold(imapCommandName(line.text[0]), "APPEND") && sync {
+			// Do not ask for a message that cannot be stored
+			return line, errIMAPLiteral
+		}
+		if sync {
+			if _, err := io.WriteString(s.w, "+ Ready for literal data\r\n"); err != nil {
+				return nil, err
+			}
+			if err := s.flush(); err != nil {
+				return nil, err
+			}
+		}
+		data := make([]byte, n)
+		if _, err := io.ReadFull(s.r, data); err != nil {
+			return nil, err
+		}
+		line.literals = append(line.literals, string(data))
+	}
+}
+
+// Tag and name of a command from its first line, even if it cannot be parsed
+func imapCommandTag(text string) string {
+	if i := strings.IndexByte(text, ' '); i >= 0 {
+		return text[:i]
+	}
+	return text
+}
+
+func imapCommandName(text string) string {
+	fields := strings.SplitN(text, " ", 3)
+	if len(fields) < 2 {
+		return ""
+	}
+	return fields[1]
+}
+
+func (s *imapSession) serve() {
+	defer s.conn.Close()
+
+	if err := s.untagged("OK [CAPABILITY %s] perso IMAP ready", s.capabilities()); err != nil {
+		return
+	}
+	if err := s.flush(); err != nil {
+		return
+	}
+
+	for {
+		line, err := s.readCommand()
+		if err == errIMAPLiteral {
+			tag := imapCommandTag(line.text[0])
+			if strings.EqualFold(imapCommandName(line.text[0]), "APPEND") {
+				err = s.reply(tag, "NO", "[READ-ONLY] Mailboxes are read-only")
+			} else {
+				err = s.reply(tag, "BAD", "Literal too large")
+			}
+			if err != nil {
+				return
+			}
+			// Non-synchronizing literals are sent anyway, skip to the end of the command
+			if n, sync, _ := imapLiteralSize(line.text[len(line.text)-1]); !sync {
+				if _, err := io.CopyN(ioutil.Discard, s.r, int64(n)); err != nil {
+					return
+				}
+				if _, err := s.readLine(); err != nil {
+					return
+				}
+			}
+			continue
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Print("imap: ", s.conn.RemoteAddr(), ": ", err)
+			}
+			return
+		}
+
+		args, err := parseIMAPLine(line)
+		if err != nil || len(args) < 2 || args[0].quoted || args[0].isList || args[1].isList {
+			if err := s.reply(imapCommandTag(line.text[0]), "BAD", "Syntax error"); err != nil {
+				return
+			}
+			continue
+		}
+
+		tag, cmd := args[0].value, strings.ToUpper(args[1].value)
+		quit, err := s.command(tag, cmd, args[2:])
+		if err != nil {
+			log.Print("imap: ", s.conn.RemoteAddr(), ": ", err)
+			return
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+func (s *imapSession) command(tag, cmd string, args []imapArg) (bool, error) {
+	// Commands in any state
+	switch cmd {
+	case "CAPABILITY":
+		if err := s.untagged("CAPABILITY %s", s.capabilities()); err != nil {
+			return false, err
+		}
+		return false, s.reply(tag, "OK", "CAPABILITY completed")
+	case "NOOP", "CHECK":
+		if err := s.refresh(); err != nil {
+			return false, err
+		}
+		return false, s.reply(tag, "OK", "%s completed", cmd)
+	case "LOGOUT":
+		if err := s.untagged("BYE Logging out"); err != nil {
+			return true, err
+		}
+		return true, s.reply(tag, "OK", "LOGOUT completed")
+	case "STARTTLS":
+		return false, s.cmdStartTLS(tag)
+	case "LOGIN":
+		return false, s.cmdLogin(tag, args)
+	case "AUTHENTICATE":
+		return false, s.reply(tag, "NO", "Use LOGIN")
+	}
+
+	if !s.logged {
+		return false, s.reply(tag, "NO", "Log in first")
+	}
+
+	// Commands once logged in
+	switch cmd {
+	case "SELECT", "EXAMINE":
+		return false, s.cmdSelect(tag, cmd, args)
+	case "LIST", "LSUB":
+		return false, s.cmdList(tag, cmd, args)
+	case "STATUS":
+		return false, s.cmdStatus(tag, args)
+	case "SUBSCRIBE", "UNSUBSCRIBE":
+		// All mailboxes are always listed
+		return false, s.reply(tag, "OK", "%s completed", cmd)
+	case "CREATE", "DELETE", "RENAME", "APPEND":
+		return false, s.reply(tag, "NO", "[READ-ONLY] Mailboxes are read-only")
+	}
+
+	if s.folder == "" {
+		return false, s.reply(tag, "BAD", "No mailbox selected")
+	}
+
+	// Commands on the selected mailbox
+	uid := false
+	if cmd == "UID" {
+		if len(args) == 0 || args[0].isList {
+			return false, s.reply(tag, "BAD", "Command expected after UID")
+		}
+		uid, cmd, args = true, "UID "+strings.ToUpper(args[0].value), args[1:]
+	}
+	switch cmd {
+	case "CLOSE", "UNSELECT":
+		// Nothing to expunge, the mailbox is read-only
+		s.folder, s.msgs, s.fetched = "", nil, nil
+		return false, s.reply(tag, "OK", "%s completed", cmd)
+	case "IDLE":
+		return false, s.cmdIdle(tag)
+	case "FETCH", "UID FETCH":
+		return false, s.cmdFetch(tag, args, uid)
+	case "SEARCH", "UID SEARCH":
+		return false, s.cmdSearch(tag, args, uid)
+	case "STORE", "COPY", "MOVE", "EXPUNGE", "UID STORE", "UID COPY", "UID MOVE", "UID EXPUNGE":
+		return false, s.reply(tag, "NO", "[READ-ONLY] Mailbox is read-only")
+	}
+	return false, s.reply(tag, "BAD", "Command not recognized")
+}
+
+func (s *imapSession) cmdStartTLS(tag string) error {
+	if s.server.tls == nil || s.isTLS {
+		return s.reply(tag, "BAD", "TLS not available")
+	}
+	if err := s.reply(tag, "OK", "Begin TLS negotiation now"); err != nil {
+		return err
+	}
+
+	conn := tls.Server(s.conn, s.server.tls)
+	conn.SetDeadline(time.Now().Add(imapIdleTimeout))
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	s.conn = conn
+	s.r = bufio.NewReader(conn)
+	s.w = bufio.NewWriter(conn)
+	s.isTLS = true
+	return nil
+}
+
+func (s *imapSession) cmdLogin(tag string, args []imapArg) error {
+	if s.logged {
+		return s.reply(tag, "BAD", "Already logged in")
+	}
+	if s.server.tls != nil && !s.isTLS {
+		return s.reply(tag, "NO", "[PRIVACYREQUIRED] Use STARTTLS first")
+	}
+	if len(args) != 2 || args[0].isList || args[1].isList {
+		return s.reply(tag, "BAD", "Syntax: LOGIN user password")
+	}
+	user, password := args[0].value, args[1].value
+
+	grant, err := s.server.config().auth.login(user, password)
+	if err != nil {
+		log.Print("imap: ", s.conn.RemoteAddr(), ": ", user, ": ", err)
+		return s.reply(tag, "NO", "[AUTHENTICATIONFAILED] Invalid credentials")
+	}
+	if grant != nil && !grant.allows(authRead) {
+		return s.reply(tag, "NO", "[AUTHORIZATIONFAILED] Permission denied")
+	}
+	if grant != nil && len(grant.headers) > 0 {
+		// Would need to check the headers of every message
+		return s.reply(tag, "NO", "[AUTHORIZATIONFAILED] Clients restricted by headers cannot use IMAP")
+	}
+	s.logged, s.grant = true, grant
+	return s.reply(tag, "OK", "[CAPABILITY %s] LOGIN completed", s.capabilities())
+}
+
+// Whether the client can see a mailbox
+func (s *imapSession) allowed(folder string) bool {
+	return s.grant == nil || s.grant.allowsMailbox(folder)
+}
+
+// Mailboxes with messages and the roots, even if empty
+func (s *imapSession) folders(conf *config) []string {
+	mr := newCacheMailboxesRequest()
+	metrics.cacheSend("mailboxes", func() { s.server.cache.mboxCh <- mr })
+	counts := <-mr.data
+
+	for _, m := range conf.mailboxes {
+		if _, found := counts[m.name]; !found {
+			counts[m.name] = 0
+		}
+	}
+	folders := make([]string, 0, len(counts))
+	for f := range counts {
+		if s.allowed(f) {
+			folders = append(folders, f)
+		}
+	}
+	sort.Strings(folders)
+	return folders
+}
+
+// Match a mailbox name with a LIST pattern: "*" matches anything,
+// "%" anything but the hierarchy delimiter
+func imapMatch(pattern, name string) bool {
+	if pattern == "" {
+		return name == ""
+	}
+	switch pattern[0] {
+	case '*', '%':
+		for i := 0; i <= len(name); i++ {
+			if imapMatch(pattern[1:], name[i:]) {
+				return true
+			}
+			if i < len(name) && pattern[0] == '%' && name[i] == imapDelimiter[0] {
+				return false
+			}
+		}
+		return false
+	}
+	if name == "" || pattern[0] != name[0] {
+		return false
+	}
+	return imapMatch(pattern[1:], name[1:])
+}
+
+func (s *imapSession) cmdList(tag, cmd string, args []imapArg) error {
+	if len(args) != 2 || args[0].isList || args[1].isList {
+		return s.reply(tag, "BAD", "Syntax: %s reference pattern", cmd)
+	}
+	ref, pattern := args[0].value, args[1].value
+	if pattern == "" {
+		// Only the delimiter and the root of the hierarchy
+		if err := s.untagged(`%s (\Noselect) "%s" ""`, cmd, imapDelimiter); err != nil {
+			return err
+		}
+		return s.reply(tag, "OK", "%s completed", cmd)
+	}
+	pattern = ref + pattern
+	if strings.HasPrefix(strings.ToUpper(pattern), "INBOX") {
+		pattern = "INBOX" + pattern[5:]
+	}
+
+	conf := s.server.config()
+	folders := s.folders(conf)
+	for _, f := range folders {
+		name := s.server.imapName(conf, f)
+		if !imapMatch(pattern, name) {
+			continue
+		}
+		attr := `\HasNoChildren`
+		for _, o := range folders {
+			if strings.HasPrefix(o, f+imapDelimiter) {
+				attr = `\HasChildren`
+				break
+			}
+		}
+		if err := s.untagged(`%s (%s) "%s" %s`, cmd, attr, imapDelimiter, imapString(name)); err != nil {
+			return err
+		}
+	}
+	return s.reply(tag, "OK", "%s completed", cmd)
+}
+
+// Messages of a mailbox, or errNotFound if it does not exist
+func (s *imapSession) messages(folder string) (*cacheUIDs, error) {
+	r := newCacheUIDRequest(folder)
+	metrics.cacheSend("uids", func() { s.server.cache.uidsCh <- r })
+	uids := <-r.data
+	if len(uids.files) == 0 && !s.server.config().mailboxes.exists(folder) {
+		return nil, errNotFound
+	}
+	return uids, nil
+}
+
+func (s *imapSession) mailboxArg(args []imapArg) (string, bool) {
+	if len(args) == 0 || args[0].isList {
+		return "", false
+	}
+	return s.server.folder(s.server.config(), args[0].value), true
+}
+
+func imapUnseen(msgs []cacheUID) int {
+	n := 0
+	for _, m := range msgs {
+		if strings.IndexByte(m.file.info(), 'S') < 0 {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *imapSession) cmdSelect(tag, cmd string, args []imapArg) error {
+	// Any selected mailbox is closed, even if the new one is not found
+	s.folder, s.msgs, s.fetched = "", nil, nil
+
+	folder, ok := s.mailboxArg(args)
+	if !ok || len(args) != 1 {
+		return s.reply(tag, "BAD", "Syntax: %s mailbox", cmd)
+	}
+	if !s.allowed(folder) {
+		return s.reply(tag, "NO", "[NOPERM] Permission denied")
+	}
+	uids, err := s.messages(folder)
+	if err != nil {
+		return s.reply(tag, "NO", "[NONEXISTENT] No such mailbox")
+	}
+	s.folder, s.msgs = folder, uids.files
+
+	names := make([]string, len(imapFlags))
+	for i, f := range imapFlags {
+		names[i] = f.name
+	}
+	lines := []string{
+		fmt.Sprintf("FLAGS (%s)", strings.Join(names, " ")),
+		"OK [PERMANENTFLAGS ()] Read-only mailbox",
+		fmt.Sprintf("%d EXISTS", len(s.msgs)),
+		"0 RECENT",
+	}
+	for i, m := range s.msgs {
+		if strings.IndexByte(m.file.info(), 'S') < 0 {
+			lines = append(lines, fmt.Sprintf("OK [UNSEEN %d] First unseen message", i+1))
+			break
+		}
+	}
+	lines = append(lines,
+		fmt.Sprintf("OK [UIDVALIDITY %d] UIDs valid", s.server.validity),
+		fmt.Sprintf("OK [UIDNEXT %d] Predicted next UID", uids.next),
+	)
+	for _, l := range lines {
+		if err := s.untagged("%s", l); err != nil {
+			return err
+		}
+	}
+	return s.reply(tag, "OK", "[READ-ONLY] %s completed", cmd)
+}
+
+func (s *imapSession) cmdStatus(tag string, args []imapArg) error {
+	folder, ok := s.mailboxArg(args)
+	if !ok || len(args) != 2 || !args[1].isList {
+		return s.reply(tag, "BAD", "Syntax: STATUS mailbox (items)")
+	}
+	if !s.allowed(folder) {
+		return s.reply(tag, "NO", "[NOPERM] Permission denied")
+	}
+	uids, err := s.messages(folder)
+	if err != nil {
+		return s.reply(tag, "NO", "[NONEXISTENT] No such mailbox")
+	}
+
+	items := make([]string, 0, len(args[1].list))
+	for _, a := range args[1].list {
+		var n uint64
+		switch item := strings.ToUpper(a.value); item {
+		case "MESSAGES":
+			n = uint64(len(uids.files))
+		case "RECENT":
+			n = 0
+		case "UIDNEXT":
+			n = uids.next
+		case "UIDVALIDITY":
+			n = uint64(s.server.validity)
+		case "UNSEEN":
+			n = uint64(imapUnseen(uids.files))
+		default:
+			return s.reply(tag, "BAD", "Unknown status item %s", a.value)
+		}
+		items = append(items, fmt.Sprintf("%s %d", strings.ToUpper(a.value), n))
+	}
+	if err := s.untagged("STATUS %s (%s)", imapString(s.server.imapName(s.server.config(), folder)), strings.Join(items, " ")); err != nil {
+		return err
+	}
+	return s.reply(tag, "OK", "STATUS completed")
+}
+
+// Tell the client about messages removed, added or with changed flags
+// since the last time
+func (s *imapSession) refresh() error {
+	if s.folder == "" {
+		return nil
+	}
+	r := newCacheUIDRequest(s.folder)
+	metrics.cacheSend("uids", func() { s.server.cache.uidsCh <- r })
+	uids := (<-r.data).files
+
+	current := make(map[uint64]mailFile, len(uids))
+	for _, m := range uids {
+		current[m.uid] = m.file
+	}
+	// From the last, not to change the sequence numbers still to send
+	for i := len(s.msgs) - 1; i >= 0; i-- {
+		if _, found := current[s.msgs[i].uid]; found {
+			continue
+		}
+		if err := s.untagged("%d EXPUNGE", i+1); err != nil {
+			return err
+		}
+		s.msgs = append(s.msgs[:i], s.msgs[i+1:]...)
+	}
+
+	// Messages are sorted by UID, new ones have higher UIDs
+	for i, m := range s.msgs {
+		file := current[m.uid]
+		if file.info() != m.file.info() {
+			if err := s.untagged("%d FETCH (UID %d FLAGS %s)", i+1, m.uid, imapMessageFlags(file)); err != nil {
+				return err
+			}
+		}
+	}
+	if len(uids) != len(s.msgs) {
+		if err := s.untagged("%d EXISTS", len(uids)); err != nil {
+			return err
+		}
+		if err := s.untagged("0 RECENT"); err != nil {
+			return err
+		}
+	}
+	s.msgs = uids
+	s.fetched = nil
+	return nil
+}
+
+// Send changes to the mailbox as they happen, until the client sends DONE
+func (s *imapSession) cmdIdle(tag string) error {
+	sub := newCacheSubscriber()
+	sub.mailbox = s.folder
+	metrics.cacheSend("sub", func() { s.server.cache.subCh <- sub })
+	<-sub.replay
+	defer func() {
+		metrics.cacheSend("unsub", func() { s.server.cache.unsubCh <- sub })
+	}()
+
+	if _, err := io.WriteString(s.w, "+ idling\r\n"); err != nil {
+		return err
+	}
+	if err := s.refresh(); err != nil {
+		return err
+	}
+	if err := s.flush(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		line, err := s.readLine()
+		if err == nil && !strings.EqualFold(line, "DONE") {
+			err = errIMAPSyntax
+		}
+		done <- err
+	}()
+
+	events := sub.events
+	for {
+		select {
+		case err := <-done:
+			if err == errIMAPSyntax {
+				return s.reply(tag, "BAD", "Expected DONE")
+			}
+			if err != nil {
+				return err
+			}
+			return s.reply(tag, "OK", "IDLE terminated")
+		case _, ok := <-events:
+			if !ok {
+				// Dropped for being too slow: the next refresh catches up
+				events = nil
+			}
+			// Wait for more events of the same delivery
+			time.Sleep(10 * time.Millisecond)
+			for drained := false; !drained && events != nil; {
+				select {
+				case _, ok := <-events:
+					if !ok {
+						events = nil
+					}
+				default:
+					drained = true
+				}
+			}
+			if err := s.refresh(); err != nil {
+				return err
+			}
+			if err := s.flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Messages selected by a sequence set, of sequence numbers or of UIDs
+func (s *imapSession) selected(arg imapArg, uid bool) ([]int, error) {
+	if arg.isList || arg.quoted {
+		return nil, errIMAPSyntax
+	}
+	set, err := parseIMAPSeqSet(arg.value)
+	if err != nil {
+		return nil, err
+	}
+	indexes := make([]int, 0)
+	if len(s.msgs) == 0 {
+		return indexes, nil
+	}
+	max := uint64(len(s.msgs))
+	if uid {
+		max = s.msgs[len(s.msgs)-1].uid
+	}
+	for i, m := range s.msgs {
+		n := uint64(i + 1)
+		if uid {
+			n = m.uid
+		}
+		if set.contains(n, max) {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes, nil
+}
+
+// Sequence number of a message by UID, zero if not known to the client
+func (s *imapSession) seq(uid uint64) int {
+	i := sort.Search(len(s.msgs), func(i int) bool { return s.msgs[i].uid >= uid })
+	if i < len(s.msgs) && s.msgs[i].uid == uid {
+		return i + 1
+	}
+	return 0
+}
+
+// Write a response with literals, that was built in a buffer
+func (s *imapSession) write(b *bytes.Buffer) error {
+	_, err := s.w.Write(b.Bytes())
+	return err
+}
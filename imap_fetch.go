@@ -0,0 +1,645 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Levels of messages attached to messages that are parsed
+const imapMaxDepth = 8
+
+// A message or a part of it, split in raw header and body
+type imapPart struct {
+	header  []byte // With the empty line that ends it
+	body    []byte
+	mime    *mimePart   // Fields of the header, without the subparts
+	parts   []*imapPart // Of multipart parts
+	message *imapPart   // Of message/rfc822 parts
+}
+
+// Message with lines ending in CRLF, as IMAP clients expect them
+type imapMessage struct {
+	uid  uint64
+	file mailFile
+	date time.Time // INTERNALDATE
+	data []byte
+	root *imapPart
+}
+
+// Convert bare LF line endings to CRLF
+func imapCRLF(data []byte) []byte {
+	n := bytes.Count(data, []byte("\n")) - bytes.Count(data, []byte("\r\n"))
+	if n == 0 {
+		return data
+	}
+	out := make([]byte, 0, len(data)+n)
+	for i, c := range data {
+		if c == '\n' && (i == 0 || data[i-1] != '\r') {
+			out = append(out, '\r')
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+func newIMAPPart(data []byte, depth int) *imapPart {
+	p := &imapPart{}
+	switch i := bytes.Index(data, []byte("\r\n\r\n")); {
+	case bytes.HasPrefix(data, []byte("\r\n")):
+		p.header, p.body = data[:2], data[2:]
+	case i < 0:
+		p.header = data
+	default:
+		p.header, p.body = data[:i+4], data[i+4:]
+	}
+
+	// Malformed lines are skipped, with what follows them
+	header, _ := textproto.NewReader(bufio.NewReader(bytes.NewReader(p.header))).ReadMIMEHeader()
+	if header == nil {
+		header = make(textproto.MIMEHeader)
+	}
+	p.mime = newMimePart("", header)
+
+	if depth >= imapMaxDepth {
+		return p
+	}
+	switch {
+	case p.mime.isMultipart():
+		for _, part := range imapSplitMultipart(p.body, p.mime.params["boundary"]) {
+			p.parts = append(p.parts, newIMAPPart(part, depth+1))
+		}
+	case p.mime.contentType == "message/rfc822":
+		p.message = newIMAPPart(p.body, depth+1)
+	}
+	return p
+}
+
+// Parts of a multipart body, without the delimiters
+func imapSplitMultipart(body []byte, boundary string) [][]byte {
+	delim := []byte("\r\n--" + boundary)
+	// The first delimiter can be at the very beginning
+	b := append([]byte("\r\n"), body...)
+
+	parts := make([][]byte, 0)
+	start := -1
+	for i := 0; i < len(b); {
+		j := bytes.Index(b[i:], delim)
+		if j < 0 {
+			break
+		}
+		j += i
+		k := j + len(delim)
+		last := bytes.HasPrefix(b[k:], []byte("--"))
+		eol := bytes.Index(b[k:], []byte("\r\n"))
+		if !last && eol >= 0 && len(bytes.TrimSpace(b[k:k+eol])) > 0 {
+			// A line starting like the delimiter
+			i = k
+			continue
+		}
+		if start >= 0 {
+			parts = append(parts, b[start:j])
+		}
+		if last || eol < 0 {
+			return parts
+		}
+		start = k + eol + 2
+		i = start
+	}
+	if start >= 0 {
+		// No closing delimiter
+		parts = append(parts, b[start:])
+	}
+	return parts
+}
+
+// Load a message, following it if it was renamed meanwhile
+func (s *imapSession) load(m cacheUID) (*imapMessage, error) {
+	if s.fetched != nil && s.fetched.uid == m.uid {
+		return s.fetched, nil
+	}
+
+	file := m.file
+	data, err := ioutil.ReadFile(file.filename())
+	if os.IsNotExist(err) {
+		cr := newCacheFindRequest(file.id())
+		metrics.cacheSend("find", func() { s.server.cache.findCh <- cr })
+		if f, ok := <-cr.data; ok && f.folder == file.folder {
+			file = f
+			data, err = ioutil.ReadFile(file.filename())
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &imapMessage{
+		uid:  m.uid,
+		file: file,
+		date: file.date,
+		data: imapCRLF(data),
+	}
+	if msg.date.IsZero() {
+		if info, err := os.Stat(file.filename()); err == nil {
+			msg.date = info.ModTime()
+		}
+	}
+	msg.root = newIMAPPart(msg.data, 0)
+	s.fetched = msg
+	return msg, nil
+}
+
+// Part of a FETCH: the section of BODY[section]
+type imapSection struct {
+	parts  []int
+	spec   string // "", HEADER, HEADER.FIELDS, HEADER.FIELDS.NOT, TEXT or MIME
+	fields []string
+}
+
+func parseIMAPSection(s string) (*imapSection, error) {
+	sec := &imapSection{}
+	rest := s
+	for rest != "" && rest[0] >= '0' && rest[0] <= '9' {
+		num := rest
+		if i := strings.IndexByte(rest, '.'); i >= 0 {
+			num, rest = rest[:i], rest[i+1:]
+		} else {
+			rest = ""
+		}
+		n, err := strconv.Atoi(num)
+		if err != nil || n == 0 {
+			return nil, errIMAPSyntax
+		}
+		sec.parts = append(sec.parts, n)
+	}
+
+	sec.spec = rest
+	if i := strings.IndexByte(rest, ' '); i >= 0 {
+		list := strings.TrimSpace(rest[i+1:])
+		if !strings.HasPrefix(list, "(") || !strings.HasSuffix(list, ")") {
+			return nil, errIMAPSyntax
+		}
+		for _, f := range strings.Fields(list[1 : len(list)-1]) {
+			sec.fields = append(sec.fields, strings.Trim(f, `"`))
+		}
+		sec.spec = rest[:i]
+	}
+	sec.spec = strings.ToUpper(sec.spec)
+
+	switch sec.spec {
+	case "", "HEADER", "TEXT":
+	case "MIME":
+		if len(sec.parts) == 0 {
+			return nil, errIMAPSyntax
+		}
+	case "HEADER.FIELDS", "HEADER.FIELDS.NOT":
+		if len(sec.fields) == 0 {
+			return nil, errIMAPSyntax
+		}
+		return sec, nil
+	default:
+		return nil, errIMAPSyntax
+	}
+	if len(sec.fields) > 0 {
+		return nil, errIMAPSyntax
+	}
+	return sec, nil
+}
+
+// Contents of a section of the message, false if there is no such part
+func (m *imapMessage) section(sec *imapSection) ([]byte, bool) {
+	p := m.root
+	if len(sec.parts) == 0 && sec.spec == "" {
+		return m.data, true
+	}
+	for i, n := range sec.parts {
+		// Numbers after the one of an attached message are of its parts
+		if i > 0 && p.message != nil {
+			p = p.message
+		}
+		if len(p.parts) == 0 {
+			// A single part has only part 1, itself
+			if n != 1 {
+				return nil, false
+			}
+			continue
+		}
+		if n > len(p.parts) {
+			return nil, false
+		}
+		p = p.parts[n-1]
+	}
+
+	switch sec.spec {
+	case "":
+		return p.body, true
+	case "MIME":
+		return p.header, true
+	}
+	if len(sec.parts) > 0 {
+		// Header and text of an attached message
+		if p.message == nil {
+			return nil, false
+		}
+		p = p.message
+	}
+	switch sec.spec {
+	case "HEADER":
+		return p.header, true
+	case "TEXT":
+		return p.body, true
+	}
+	return imapHeaderFields(p.header, sec.fields, sec.spec == "HEADER.FIELDS.NOT"), true
+}
+
+// Only the fields of header in names, or not in names
+func imapHeaderFields(header []byte, names []string, not bool) []byte {
+	want := make(map[string]bool, len(names))
+	for _, n := range names {
+		want[strings.ToLower(n)] = true
+	}
+
+	var b bytes.Buffer
+	keep := false
+	for _, line := range bytes.SplitAfter(header, []byte("\r\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		// Continuation lines go with the field before them
+		if line[0] != ' ' && line[0] != '\t' {
+			name := line
+			if i := bytes.IndexByte(line, ':'); i >= 0 {
+				name = line[:i]
+			}
+			keep = want[strings.ToLower(string(bytes.TrimSpace(name)))] != not
+		}
+		if keep {
+			b.Write(line)
+		}
+	}
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
+
+// An item of FETCH
+type imapFetchItem struct {
+	name    string // Of the item in the response
+	section *imapSection
+	peek    bool
+	partial bool
+	offset  int
+	length  int
+}
+
+var imapFetchMacros = map[string][]string{
+	"ALL":  {"FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE"},
+	"FAST": {"FLAGS", "INTERNALDATE", "RFC822.SIZE"},
+	"FULL": {"FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE", "BODY"},
+}
+
+func parseIMAPFetch(arg imapArg) ([]*imapFetchItem, error) {
+	if !arg.isList {
+		if macro, found := imapFetchMacros[strings.ToUpper(arg.value)]; found {
+			arg = imapArg{isList: true}
+			for _, name := range macro {
+				arg.list = append(arg.list, imapArg{value: name})
+			}
+		} else {
+			arg = imapArg{isList: true, list: []imapArg{arg}}
+		}
+	}
+
+	items := make([]*imapFetchItem, 0, len(arg.list))
+	for _, a := range arg.list {
+		if a.isList || a.quoted {
+			return nil, errIMAPSyntax
+		}
+		item, err := parseIMAPFetchItem(a.value)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func parseIMAPFetchItem(s string) (*imapFetchItem, error) {
+	upper := strings.ToUpper(s)
+	switch upper {
+	case "UID", "FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE", "BODY", "BODYSTRUCTURE":
+		return &imapFetchItem{name: upper}, nil
+	case "RFC822":
+		return &imapFetchItem{name: upper, section: &imapSection{}}, nil
+	case "RFC822.HEADER":
+		return &imapFetchItem{name: upper, section: &imapSection{spec: "HEADER"}, peek: true}, nil
+	case "RFC822.TEXT":
+		return &imapFetchItem{name: upper, section: &imapSection{spec: "TEXT"}}, nil
+	}
+
+	item := &imapFetchItem{}
+	switch {
+	case strings.HasPrefix(upper, "BODY["):
+		s = s[len("BODY["):]
+	case strings.HasPrefix(upper, "BODY.PEEK["):
+		s, item.peek = s[len("BODY.PEEK["):], true
+	default:
+		return nil, errIMAPSyntax
+	}
+	end := strings.LastIndexByte(s, ']')
+	if end < 0 {
+		return nil, errIMAPSyntax
+	}
+	sec, err := parseIMAPSection(s[:end])
+	if err != nil {
+		return nil, err
+	}
+	item.section = sec
+	item.name = "BODY[" + strings.ToUpper(s[:end]) + "]"
+
+	if partial := s[end+1:]; partial != "" {
+		if !strings.HasPrefix(partial, "<") || !strings.HasSuffix(partial, ">") {
+			return nil, errIMAPSyntax
+		}
+		dot := strings.IndexByte(partial, '.')
+		if dot < 0 {
+			return nil, errIMAPSyntax
+		}
+		offset, err := strconv.Atoi(partial[1:dot])
+		if err != nil || offset < 0 {
+			return nil, errIMAPSyntax
+		}
+		length, err := strconv.Atoi(partial[dot+1 : len(partial)-1])
+		if err != nil || length <= 0 {
+			return nil, errIMAPSyntax
+		}
+		item.partial, item.offset, item.length = true, offset, length
+		item.name += "<" + strconv.Itoa(offset) + ">"
+	}
+	return item, nil
+}
+
+// Whether the item is only about the name of the file
+func (item *imapFetchItem) needsMessage() bool {
+	return item.name != "UID" && item.name != "FLAGS"
+}
+
+func (s *imapSession) cmdFetch(tag string, args []imapArg, uid bool) error {
+	cmd := "FETCH"
+	if uid {
+		cmd = "UID FETCH"
+	}
+	if len(args) != 2 {
+		return s.reply(tag, "BAD", "Syntax: %s set items", cmd)
+	}
+	indexes, err := s.selected(args[0], uid)
+	if err != nil {
+		return s.reply(tag, "BAD", "Invalid sequence set")
+	}
+	items, err := parseIMAPFetch(args[1])
+	if err != nil {
+		return s.reply(tag, "BAD", "Invalid items to fetch")
+	}
+	if uid {
+		// Always in the responses of UID FETCH
+		hasUID := false
+		for _, item := range items {
+			hasUID = hasUID || item.name == "UID"
+		}
+		if !hasUID {
+			items = append([]*imapFetchItem{{name: "UID"}}, items...)
+		}
+	}
+
+	failed := false
+	for _, i := range indexes {
+		var b bytes.Buffer
+		if err := s.fetch(&b, i, items); err != nil {
+			log.Print("imap: cannot fetch ", s.msgs[i].file, ": ", err)
+			failed = true
+			continue
+		}
+		if err := s.write(&b); err != nil {
+			return err
+		}
+	}
+	if failed {
+		return s.reply(tag, "NO", "Some messages could not be read")
+	}
+	return s.reply(tag, "OK", "%s completed", cmd)
+}
+
+// Write the response to FETCH of the message at index i
+func (s *imapSession) fetch(b *bytes.Buffer, i int, items []*imapFetchItem) error {
+	m := s.msgs[i]
+	var msg *imapMessage
+	for _, item := range items {
+		if item.needsMessage() {
+			var err error
+			if msg, err = s.load(m); err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	fmt.Fprintf(b, "* %d FETCH (", i+1)
+	for j, item := range items {
+		if j > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(item.name)
+		b.WriteByte(' ')
+
+		switch item.name {
+		case "UID":
+			fmt.Fprintf(b, "%d", m.uid)
+		case "FLAGS":
+			b.WriteString(imapMessageFlags(m.file))
+		case "INTERNALDATE":
+			fmt.Fprintf(b, `"%s"`, msg.date.Format("02-Jan-2006 15:04:05 -0700"))
+		case "RFC822.SIZE":
+			fmt.Fprintf(b, "%d", len(msg.data))
+		case "ENVELOPE":
+			imapWriteEnvelope(b, msg.root.mime.header)
+		case "BODY":
+			msg.root.writeStructure(b, false)
+		case "BODYSTRUCTURE":
+			msg.root.writeStructure(b, true)
+		default:
+			data, found := msg.section(item.section)
+			if !found {
+				b.WriteString("NIL")
+				continue
+			}
+			if item.partial {
+				offset := item.offset
+				if offset > len(data) {
+					offset = len(data)
+				}
+				data = data[offset:]
+				if item.length < len(data) {
+					data = data[:item.length]
+				}
+			}
+			fmt.Fprintf(b, "{%d}\r\n", len(data))
+			b.Write(data)
+		}
+	}
+	b.WriteString(")\r\n")
+	return nil
+}
+
+// Write a list of the parameters of a header, like ("CHARSET" "utf-8")
+func imapWriteParams(b *bytes.Buffer, params map[string]string) {
+	if len(params) == 0 {
+		b.WriteString("NIL")
+		return
+	}
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	b.WriteByte('(')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		fmt.Fprintf(b, "%s %s", imapString(strings.ToUpper(name)), imapString(params[name]))
+	}
+	b.WriteByte(')')
+}
+
+// Write the BODY (ext false) or BODYSTRUCTURE of the part
+func (p *imapPart) writeStructure(b *bytes.Buffer, ext bool) {
+	mp := p.mime
+	b.WriteByte('(')
+	defer b.WriteByte(')')
+
+	typ, subtype := mp.contentType, ""
+	if i := strings.IndexByte(typ, '/'); i >= 0 {
+		typ, subtype = typ[:i], typ[i+1:]
+	}
+
+	if len(p.parts) > 0 {
+		for _, c := range p.parts {
+			c.writeStructure(b, ext)
+		}
+		b.WriteByte(' ')
+		b.WriteString(imapString(strings.ToUpper(subtype)))
+		if ext {
+			b.WriteByte(' ')
+			imapWriteParams(b, mp.params)
+			b.WriteByte(' ')
+			p.writeDisposition(b)
+			b.WriteString(" NIL NIL")
+		}
+		return
+	}
+
+	encoding := strings.ToUpper(mp.encoding)
+	if encoding == "" {
+		encoding = "7BIT"
+	}
+	fmt.Fprintf(b, "%s %s ", imapString(strings.ToUpper(typ)), imapString(strings.ToUpper(subtype)))
+	imapWriteParams(b, mp.params)
+	fmt.Fprintf(b, " %s %s %s %d",
+		imapNString(mp.header.Get("Content-Id")),
+		imapNString(mp.header.Get("Content-Description")),
+		imapString(encoding),
+		len(p.body))
+
+	lines := bytes.Count(p.body, []byte("\n"))
+	if len(p.body) > 0 && p.body[len(p.body)-1] != '\n' {
+		lines++
+	}
+	switch {
+	case p.message != nil:
+		b.WriteByte(' ')
+		imapWriteEnvelope(b, p.message.mime.header)
+		b.WriteByte(' ')
+		p.message.writeStructure(b, ext)
+		fmt.Fprintf(b, " %d", lines)
+	case typ == "text":
+		fmt.Fprintf(b, " %d", lines)
+	}
+	if ext {
+		fmt.Fprintf(b, " %s ", imapNString(mp.header.Get("Content-Md5")))
+		p.writeDisposition(b)
+		b.WriteString(" NIL NIL")
+	}
+}
+
+func (p *imapPart) writeDisposition(b *bytes.Buffer) {
+	disp, params, err := mime.ParseMediaType(p.mime.header.Get("Content-Disposition"))
+	if err != nil {
+		b.WriteString("NIL")
+		return
+	}
+	fmt.Fprintf(b, "(%s ", imapString(strings.ToUpper(disp)))
+	imapWriteParams(b, params)
+	b.WriteByte(')')
+}
+
+// Write the ENVELOPE of a message with header h
+func imapWriteEnvelope(b *bytes.Buffer, h textproto.MIMEHeader) {
+	from := imapAddresses(h, "From")
+	sender, replyTo := imapAddresses(h, "Sender"), imapAddresses(h, "Reply-To")
+	// Both default to From (RFC 3501, 7.4.2)
+	if sender == "NIL" {
+		sender = from
+	}
+	if replyTo == "NIL" {
+		replyTo = from
+	}
+	fmt.Fprintf(b, "(%s %s %s %s %s %s %s %s %s %s)",
+		imapNString(h.Get("Date")),
+		imapNString(h.Get("Subject")),
+		from, sender, replyTo,
+		imapAddresses(h, "To"),
+		imapAddresses(h, "Cc"),
+		imapAddresses(h, "Bcc"),
+		imapNString(h.Get("In-Reply-To")),
+		imapNString(h.Get("Message-Id")))
+}
+
+// List of the addresses in a header, like (("Name" NIL "user" "example.com"))
+func imapAddresses(h textproto.MIMEHeader, key string) string {
+	if h.Get(key) == "" {
+		return "NIL"
+	}
+	addresses, err := ciHeader(mail.Header(h)).AddressList(textproto.CanonicalMIMEHeaderKey(key))
+	if err != nil || len(addresses) == 0 {
+		return "NIL"
+	}
+
+	var b strings.Builder
+	b.WriteByte('(')
+	for _, a := range addresses {
+		user, host := a.Address, ""
+		if i := strings.LastIndexByte(a.Address, '@'); i >= 0 {
+			user, host = a.Address[:i], a.Address[i+1:]
+		}
+		name := a.Name
+		for _, c := range name {
+			if c > '~' {
+				// Names in envelopes are not decoded
+				name = mime.QEncoding.Encode("utf-8", a.Name)
+				break
+			}
+		}
+		fmt.Fprintf(&b, "(%s NIL %s %s)", imapNString(name), imapNString(user), imapNString(host))
+	}
+	b.WriteByte(')')
+	return b.String()
+}
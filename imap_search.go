@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errIMAPCharset = errors.New("Unsupported charset")
+
+// All the messages
+type searchAll struct{}
+
+func (searchAll) eval(c *caches, all fileSet) fileSet {
+	result := make(fileSet, len(all))
+	for f := range all {
+		result[f] = struct{}{}
+	}
+	return result
+}
+
+// Messages by serial, as IMAP UIDs, that were selected outside of the caches
+type searchSerials map[uint64]bool
+
+func (s searchSerials) eval(c *caches, all fileSet) fileSet {
+	result := make(fileSet)
+	for f := range all {
+		if cf, found := c.files[f]; found && s[cf.serial] {
+			result[f] = struct{}{}
+		}
+	}
+	return result
+}
+
+// Messages with an indexed header containing value, ignoring case
+type searchHeaderFold struct {
+	header string
+	value  string
+}
+
+func (s searchHeaderFold) eval(c *caches, all fileSet) fileSet {
+	result := make(fileSet)
+	value := strings.ToLower(s.value)
+	for v, files := range c.data[s.header] {
+		if !strings.Contains(strings.ToLower(decodeHeader(v)), value) {
+			continue
+		}
+		for _, f := range files {
+			result[f] = struct{}{}
+		}
+	}
+	return result
+}
+
+// Messages dated from since and before until
+type searchDate struct {
+	since time.Time
+	until time.Time
+}
+
+func (s searchDate) eval(c *caches, all fileSet) fileSet {
+	result := make(fileSet)
+	for _, f := range c.dates.between(s.since, s.until) {
+		result[f] = struct{}{}
+	}
+	return result
+}
+
+// Maildir flags searched as their names in the flags index
+var imapSearchFlags = map[string]string{
+	"ANSWERED": "replied",
+	"DELETED":  "trashed",
+	"DRAFT":    "draft",
+	"FLAGGED":  "flagged",
+	"SEEN":     "seen",
+}
+
+// Translate SEARCH criteria (RFC 3501, 6.4.4) into a query for the caches.
+// Indexed headers, flags and dates are searched in the caches; other
+// headers, sizes and sequence numbers are checked here, in the messages
+// of the session.
+type imapSearchParser struct {
+	s    *imapSession
+	args []imapArg
+	pos  int
+}
+
+func (s *imapSession) searchQuery(args []imapArg) (searchNode, error) {
+	if len(args) >= 2 && !args[0].isList && strings.EqualFold(args[0].value, "CHARSET") {
+		switch strings.ToUpper(args[1].value) {
+		case "US-ASCII", "UTF-8":
+		default:
+			return nil, errIMAPCharset
+		}
+		args = args[2:]
+	}
+	p := &imapSearchParser{s: s, args: args}
+	return p.parseAll()
+}
+
+func (p *imapSearchParser) parseAll() (searchNode, error) {
+	nodes := make(searchAnd, 0)
+	for p.pos < len(p.args) {
+		n, err := p.parseKey()
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, n)
+	}
+	switch len(nodes) {
+	case 0:
+		return nil, errIMAPSyntax
+	case 1:
+		return nodes[0], nil
+	}
+	return nodes, nil
+}
+
+func (p *imapSearchParser) next() (imapArg, error) {
+	if p.pos >= len(p.args) {
+		return imapArg{}, errIMAPSyntax
+	}
+	p.pos++
+	return p.args[p.pos-1], nil
+}
+
+func (p *imapSearchParser) string() (string, error) {
+	a, err := p.next()
+	if err != nil || a.isList {
+		return "", errIMAPSyntax
+	}
+	return a.value, nil
+}
+
+func (p *imapSearchParser) date() (time.Time, error) {
+	s, err := p.string()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Parse("2-Jan-2006", s)
+}
+
+func (p *imapSearchParser) number() (int64, error) {
+	s, err := p.string()
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+func (p *imapSearchParser) parseKey() (searchNode, error) {
+	a, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if a.isList {
+		sub := &imapSearchParser{s: p.s, args: a.list}
+		return sub.parseAll()
+	}
+
+	key := strings.ToUpper(a.value)
+	if flag, found := imapSearchFlags[key]; found {
+		return searchHeader{header: flagKey, value: flag, match: keyTypeNormal}, nil
+	}
+	if flag, found := imapSearchFlags[strings.TrimPrefix(key, "UN")]; found {
+		return searchNot{node: searchHeader{header: flagKey, value: flag, match: keyTypeNormal}}, nil
+	}
+
+	switch key {
+	case "ALL", "OLD":
+		return searchAll{}, nil
+	case "NEW", "RECENT":
+		// Messages are never recent for read-only sessions
+		return searchSerials{}, nil
+	case "KEYWORD", "UNKEYWORD":
+		keyword, err := p.string()
+		if err != nil {
+			return nil, err
+		}
+		var node searchNode = searchSerials{}
+		if strings.EqualFold(keyword, "$Forwarded") {
+			node = searchHeader{header: flagKey, value: "passed", match: keyTypeNormal}
+		}
+		if key == "UNKEYWORD" {
+			node = searchNot{node: node}
+		}
+		return node, nil
+	case "FROM", "TO", "CC", "BCC", "SUBJECT":
+		value, err := p.string()
+		if err != nil {
+			return nil, err
+		}
+		return p.s.searchHeader(strings.ToLower(key), value), nil
+	case "HEADER":
+		name, err := p.string()
+		if err != nil {
+			return nil, err
+		}
+		value, err := p.string()
+		if err != nil {
+			return nil, err
+		}
+		return p.s.searchHeader(strings.ToLower(name), value), nil
+	case "BODY", "TEXT":
+		value, err := p.string()
+		if err != nil {
+			return nil, err
+		}
+		return p.s.searchText(value, key == "TEXT"), nil
+	case "BEFORE", "SENTBEFORE":
+		d, err := p.date()
+		if err != nil {
+			return nil, err
+		}
+		return searchDate{until: d}, nil
+	case "ON", "SENTON":
+		d, err := p.date()
+		if err != nil {
+			return nil, err
+		}
+		return searchDate{since: d, until: d.AddDate(0, 0, 1)}, nil
+	case "SINCE", "SENTSINCE":
+		d, err := p.date()
+		if err != nil {
+			return nil, err
+		}
+		return searchDate{since: d}, nil
+	case "LARGER", "SMALLER":
+		n, err := p.number()
+		if err != nil {
+			return nil, err
+		}
+		return p.s.searchSize(n, key == "LARGER"), nil
+	case "UID":
+		a, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		return p.s.searchSet(a, true)
+	case "NOT":
+		n, err := p.parseKey()
+		if err != nil {
+			return nil, err
+		}
+		return searchNot{node: n}, nil
+	case "OR":
+		a, err := p.parseKey()
+		if err != nil {
+			return nil, err
+		}
+		b, err := p.parseKey()
+		if err != nil {
+			return nil, err
+		}
+		return searchOr{a, b}, nil
+	}
+	return p.s.searchSet(a, false)
+}
+
+// Messages selected by a sequence set
+func (s *imapSession) searchSet(a imapArg, uid bool) (searchNode, error) {
+	indexes, err := s.selected(a, uid)
+	if err != nil {
+		return nil, err
+	}
+	serials := make(searchSerials)
+	for _, i := range indexes {
+		serials[s.msgs[i].uid] = true
+	}
+	return serials, nil
+}
+
+// Serials of the messages of the session for which match is true
+func (s *imapSession) searchFiles(match func(m cacheUID) bool) searchSerials {
+	serials := make(searchSerials)
+	for _, m := range s.msgs {
+		if match(m) {
+			serials[m.uid] = true
+		}
+	}
+	return serials
+}
+
+func (s *imapSession) searchHeader(header, value string) searchNode {
+	keys := s.server.indexer.keys()
+	if header != "" && header != flagKey && keys.has(header) && keys.keyType(header) != keyTypeAny {
+		return searchHeaderFold{header: header, value: value}
+	}
+
+	value = strings.ToLower(value)
+	return s.searchFiles(func(m cacheUID) bool {
+		msg, err := s.server.indexer.parseHeader(m.file.filename())
+		if err != nil {
+			return false
+		}
+		_, values := ciHeader(msg.Header).get(header)
+		for _, v := range values {
+			if strings.Contains(strings.ToLower(decodeHeader(v)), value) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// Messages with value in the body, or anywhere in the message for TEXT.
+// The body index is used if enabled, otherwise the messages are read.
+func (s *imapSession) searchText(value string, text bool) searchNode {
+	if s.server.indexer.body {
+		words := tokenize(value, nil)
+		if len(words) == 0 {
+			return searchAll{}
+		}
+		return searchPhrase(words)
+	}
+
+	lower := bytes.ToLower([]byte(value))
+	return s.searchFiles(func(m cacheUID) bool {
+		data, err := ioutil.ReadFile(m.file.filename())
+		if err != nil {
+			return false
+		}
+		if !text {
+			msg, err := mail.ReadMessage(bytes.NewReader(data))
+			if err != nil {
+				return false
+			}
+			if data, err = ioutil.ReadAll(msg.Body); err != nil {
+				return false
+			}
+		}
+		return bytes.Contains(bytes.ToLower(data), lower)
+	})
+}
+
+// Messages larger or smaller than n bytes, with lines ending in CRLF
+func (s *imapSession) searchSize(n int64, larger bool) searchNode {
+	return s.searchFiles(func(m cacheUID) bool {
+		data, err := ioutil.ReadFile(m.file.filename())
+		if err != nil {
+			return false
+		}
+		size := int64(len(imapCRLF(data)))
+		if larger {
+			return size > n
+		}
+		return size < n
+	})
+}
+
+func (s *imapSession) cmdSearch(tag string, args []imapArg, uid bool) error {
+	cmd := "SEARCH"
+	if uid {
+		cmd = "UID SEARCH"
+	}
+	query, err := s.searchQuery(args)
+	if err == errIMAPCharset {
+		return s.reply(tag, "NO", "[BADCHARSET (US-ASCII UTF-8)] Unsupported charset")
+	}
+	if err != nil {
+		return s.reply(tag, "BAD", "Invalid search criteria")
+	}
+
+	r := newCacheUIDRequest(s.folder)
+	r.query = query
+	metrics.cacheSend("uids", func() { s.server.cache.uidsCh <- r })
+	matches := (<-r.data).files
+
+	var b strings.Builder
+	b.WriteString("SEARCH")
+	for _, m := range matches {
+		// Messages the client does not know about yet are not reported
+		n := s.seq(m.uid)
+		if n == 0 {
+			continue
+		}
+		if uid {
+			b.WriteString(" " + strconv.FormatUint(m.uid, 10))
+		} else {
+			b.WriteString(" " + strconv.Itoa(n))
+		}
+	}
+	if err := s.untagged("%s", b.String()); err != nil {
+		return err
+	}
+	return s.reply(tag, "OK", "%s completed", cmd)
+}
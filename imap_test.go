@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestIMAPParse(t *testing.T) {
+	line := &imapLine{
+		text:     []string{`a1 FETCH 1:* (UID BODY.PEEK[HEADER.FIELDS (From "To")]<0.10>) "q \"x\"" {3}`, ` NIL`},
+		literals: []string{"lit"},
+	}
+	args, err := parseIMAPLine(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(args) != 7 {
+		t.Fatalf("expected 7 arguments, got %d: %v", len(args), args)
+	}
+	if args[0].value != "a1" || args[1].value != "FETCH" || args[2].value != "1:*" {
+		t.Errorf("unexpected atoms %v", args[:3])
+	}
+	if !args[3].isList || len(args[3].list) != 2 || args[3].list[1].value != `BODY.PEEK[HEADER.FIELDS (From "To")]<0.10>` {
+		t.Errorf("unexpected list %v", args[3])
+	}
+	if !args[4].quoted || args[4].value != `q "x"` {
+		t.Errorf("unexpected quoted string %v", args[4])
+	}
+	if !args[5].quoted || args[5].value != "lit" || args[6].value != "NIL" {
+		t.Errorf("unexpected literal %v", args[5:])
+	}
+
+	for _, bad := range []string{`a1 (FETCH`, `a1 FETCH)`, `a1 "open`} {
+		if _, err := parseIMAPLine(&imapLine{text: []string{bad}}); err == nil {
+			t.Errorf("%s: expected error", bad)
+		}
+	}
+}
+
+func TestIMAPSeqSet(t *testing.T) {
+	set, err := parseIMAPSeqSet("2,4:5,9:*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n, ok := range map[uint64]bool{1: false, 2: true, 3: false, 4: true, 5: true, 8: false, 9: true, 12: true} {
+		if set.contains(n, 12) != ok {
+			t.Errorf("%d: expected %v", n, ok)
+		}
+	}
+	// "*" is the largest number, even if smaller than the other end
+	if set, _ = parseIMAPSeqSet("10:*"); !set.contains(7, 7) || set.contains(6, 7) {
+		t.Error("unexpected range to *")
+	}
+	for _, bad := range []string{"", "0", "1:x", "1,,2"} {
+		if _, err := parseIMAPSeqSet(bad); err == nil {
+			t.Errorf("%s: expected error", bad)
+		}
+	}
+}
+
+func TestIMAPMatch(t *testing.T) {
+	for _, c := range []struct {
+		pattern, name string
+		match         bool
+	}{
+		{"*", "INBOX.Sent", true},
+		{"%", "INBOX", true},
+		{"%", "INBOX.Sent", false},
+		{"INBOX.%", "INBOX.Sent", true},
+		{"INBOX.%", "INBOX.Sent.Old", false},
+		{"IN*Old", "INBOX.Sent.Old", true},
+		{"work", "work.Sent", false},
+	} {
+		if imapMatch(c.pattern, c.name) != c.match {
+			t.Errorf("%s %s: expected %v", c.pattern, c.name, c.match)
+		}
+	}
+}
+
+func TestIMAPSections(t *testing.T) {
+	msg := &imapMessage{data: imapCRLF([]byte(testMultipart))}
+	msg.root = newIMAPPart(msg.data, 0)
+
+	for section, expected := range map[string]string{
+		"HEADER.FIELDS (FROM)": "From: someone@example.com\r\n\r\n",
+		"1.1":                  "f=C3=BCr",
+		"1.2.MIME":             "Content-Type: text/html\r\n\r\n",
+		"2":                    "YSxiLGMK",
+	} {
+		sec, err := parseIMAPSection(section)
+		if err != nil {
+			t.Fatal(section, ": ", err)
+		}
+		data, found := msg.section(sec)
+		if !found || string(data) != expected {
+			t.Errorf("%s: expected %q, got %q", section, expected, data)
+		}
+	}
+	if _, found := msg.section(&imapSection{parts: []int{3}}); found {
+		t.Error("part 3 should not exist")
+	}
+	for _, bad := range []string{"0", "MIME", "HEADER.FIELDS", "TEXT (FROM)", "FOO"} {
+		if _, err := parseIMAPSection(bad); err == nil {
+			t.Errorf("%s: expected error", bad)
+		}
+	}
+
+	var b bytes.Buffer
+	msg.root.writeStructure(&b, false)
+	expected := `((("TEXT" "PLAIN" ("CHARSET" "utf-8") NIL NIL "QUOTED-PRINTABLE" 8 1)` +
+		`("TEXT" "HTML" NIL NIL NIL "7BIT" 11 1) "ALTERNATIVE")` +
+		`("TEXT" "CSV" ("NAME" "export.csv") NIL NIL "BASE64" 8 1) "MIXED")`
+	if b.String() != expected {
+		t.Errorf("unexpected body structure %s", b.String())
+	}
+}
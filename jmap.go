@@ -0,0 +1,643 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// JMAP (RFC 8620 and 8621) for the indexed messages: one account, with a
+// mailbox for each folder. Ids are the names of folders and the ids of
+// messages in base64, as JMAP ids cannot have dots.
+const (
+	jmapCore          = "urn:ietf:params:jmap:core"
+	jmapMail          = "urn:ietf:params:jmap:mail"
+	jmapAccount       = "perso"
+	jmapMaxRequest    = 10 << 20
+	jmapMaxCalls      = 16
+	jmapMaxObjects    = 500
+	jmapMaxQueryLimit = 1000
+)
+
+// A method error, sent as an "error" response to the method call
+type jmapError struct {
+	Type        string `json:"type"`
+	Description string `json:"description,omitempty"`
+}
+
+func (e *jmapError) Error() string {
+	return e.Type + ": " + e.Description
+}
+
+func newJMAPError(kind, description string) *jmapError {
+	return &jmapError{Type: kind, Description: description}
+}
+
+var (
+	errJMAPPointer = errors.New("Invalid path")
+	errJMAPID      = errors.New("Invalid id")
+	errJMAPState   = errors.New("Unknown state")
+)
+
+// Id of a folder or message
+func jmapID(s string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+func parseJMAPID(id string) (string, error) {
+	s, err := base64.RawURLEncoding.DecodeString(id)
+	if err != nil || len(s) == 0 {
+		return "", errJMAPID
+	}
+	return string(s), nil
+}
+
+// A method call or response: [name, arguments, method call id]
+type jmapInvocation struct {
+	name string
+	args json.RawMessage
+	id   string
+}
+
+func (i *jmapInvocation) UnmarshalJSON(data []byte) error {
+	var parts []json.RawMessage
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return err
+	}
+	if len(parts) != 3 {
+		return errors.New("Invocations must have three elements")
+	}
+	if err := json.Unmarshal(parts[0], &i.name); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(parts[2], &i.id); err != nil {
+		return err
+	}
+	i.args = parts[1]
+	return nil
+}
+
+func (i *jmapInvocation) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{i.name, i.args, i.id})
+}
+
+type jmapRequest struct {
+	Using       []string          `json:"using"`
+	MethodCalls []*jmapInvocation `json:"methodCalls"`
+	CreatedIDs  map[string]string `json:"createdIds,omitempty"`
+}
+
+type jmapResponse struct {
+	MethodResponses []*jmapInvocation `json:"methodResponses"`
+	CreatedIDs      map[string]string `json:"createdIds,omitempty"`
+	SessionState    string            `json:"sessionState"`
+}
+
+// Argument taking its value from the response to a previous call
+type jmapResultReference struct {
+	ResultOf string `json:"resultOf"`
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+}
+
+// What the client of an API request can see and do
+type jmapContext struct {
+	h     *httpHandler
+	grant *authGrant
+	using map[string]bool
+}
+
+func (c *jmapContext) allows(p authPerm) bool {
+	return c.grant == nil || c.grant.allows(p)
+}
+
+func (c *jmapContext) allowsMailbox(name string) bool {
+	return c.grant == nil || c.grant.allowsMailbox(name)
+}
+
+// Fail if a method is called for an account other than the only one
+func (c *jmapContext) account(id string) error {
+	if id != jmapAccount {
+		return newJMAPError("accountNotFound", "")
+	}
+	return nil
+}
+
+// Decode the arguments of a method, that must be for the only account
+func (c *jmapContext) arguments(data json.RawMessage, args interface{}, account *string) error {
+	if err := json.Unmarshal(data, args); err != nil {
+		return newJMAPError("invalidArguments", err.Error())
+	}
+	return c.account(*account)
+}
+
+// Current state of the index
+func (c *jmapContext) state() string {
+	cr := newCacheChangesRequest(0)
+	metrics.cacheSend("changes", func() { c.h.cache.changesCh <- cr })
+	return c.formatState((<-cr.data).state)
+}
+
+// States are the ids of events of the index, as cursors
+func (c *jmapContext) formatState(id uint64) string {
+	return c.h.cache.formatCursor(id)
+}
+
+// Id of the event of a state, only if given since the caches started
+func (c *jmapContext) parseState(state string) (uint64, error) {
+	id, err := c.h.cache.parseCursor(state)
+	if err != nil {
+		return 0, errJMAPState
+	}
+	return id, nil
+}
+
+type jmapMethod struct {
+	capability string
+	call       func(c *jmapContext, args json.RawMessage) (interface{}, error)
+}
+
+var jmapMethods = map[string]jmapMethod{
+	"Core/echo":     {jmapCore, jmapEcho},
+	"Mailbox/get":   {jmapMail, jmapMailboxGet},
+	"Email/query":   {jmapMail, jmapEmailQuery},
+	"Email/get":     {jmapMail, jmapEmailGet},
+	"Email/changes": {jmapMail, jmapEmailChanges},
+	"Email/set":     {jmapMail, jmapEmailSet},
+}
+
+func jmapEcho(c *jmapContext, args json.RawMessage) (interface{}, error) {
+	return args, nil
+}
+
+// The client making a request, nil without authentication
+func (h *httpHandler) jmapGrant(r *http.Request) (*authGrant, error) {
+	if h.config.auth == nil || !h.config.auth.enabled() {
+		return nil, nil
+	}
+	return h.config.auth.authenticate(r)
+}
+
+// Changes when the mailboxes or the permissions of the client change
+func (h *httpHandler) jmapSessionState(grant *authGrant) string {
+	hash := fnv.New64a()
+	for _, m := range h.config.mailboxes {
+		io.WriteString(hash, m.name+"\n")
+	}
+	if grant != nil {
+		io.WriteString(hash, grant.name+strconv.Itoa(int(grant.perms))+strings.Join(grant.mailboxes, ","))
+	}
+	return strconv.FormatUint(hash.Sum64(), 36)
+}
+
+// The session resource, describing the account and the URLs of the API
+func (h *httpHandler) jmapSession() func(w http.ResponseWriter, r *http.Request) {
+	return h.handler(func(h *httpHandler, w http.ResponseWriter, r *http.Request) error {
+		if r.Method != "GET" {
+			http.Error(w, "Method not supported", 405)
+			return nil
+		}
+		grant, err := h.jmapGrant(r)
+		if err != nil {
+			return err
+		}
+
+		base := "http://" + r.Host
+		if r.TLS != nil {
+			base = "https://" + r.Host
+		}
+		var username string
+		if grant != nil {
+			username = grant.name
+		}
+		readOnly := grant != nil && !grant.allows(authWrite) && !grant.allows(authDelete)
+
+		session := map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				jmapCore: map[string]interface{}{
+					"maxSizeUpload":         0,
+					"maxConcurrentUpload":   1,
+					"maxSizeRequest":        jmapMaxRequest,
+					"maxConcurrentRequests": 4,
+					"maxCallsInRequest":     jmapMaxCalls,
+					"maxObjectsInGet":       jmapMaxObjects,
+					"maxObjectsInSet":       jmapMaxObjects,
+					"collationAlgorithms":   []string{},
+				},
+				jmapMail: map[string]interface{}{},
+			},
+			"accounts": map[string]interface{}{
+				jmapAccount: map[string]interface{}{
+					"name":       jmapAccount,
+					"isPersonal": true,
+					"isReadOnly": readOnly,
+					"accountCapabilities": map[string]interface{}{
+						jmapMail: map[string]interface{}{
+							"maxMailboxesPerEmail":       1,
+							"maxMailboxDepth":            nil,
+							"maxSizeMailboxName":         255,
+							"maxSizeAttachmentsPerEmail": 0,
+							"emailQuerySortOptions":      []string{"receivedAt", "sentAt"},
+							"mayCreateTopLevelMailbox":   false,
+						},
+					},
+				},
+			},
+			"primaryAccounts": map[string]string{
+				jmapCore: jmapAccount,
+				jmapMail: jmapAccount,
+			},
+			"username":       username,
+			"apiUrl":         base + "/jmap/api",
+			"downloadUrl":    base + "/jmap/download/{accountId}/{blobId}/{name}?accept={type}",
+			"uploadUrl":      base + "/jmap/upload/{accountId}",
+			"eventSourceUrl": base + "/jmap/eventsource?types={types}&closeafter={closeafter}&ping={ping}",
+			"state":          h.jmapSessionState(grant),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(session)
+	})
+}
+
+// Reply to a request that cannot be processed at all (RFC 8620, 3.6.1)
+func jmapProblem(w http.ResponseWriter, kind, detail string) {
+	jmapProblemStatus(w, 400, kind, detail, nil)
+}
+
+// Problem with another status, and more properties like the "limit" exceeded
+func jmapProblemStatus(w http.ResponseWriter, status int, kind, detail string, more map[string]interface{}) {
+	problem := map[string]interface{}{
+		"type":   "urn:ietf:params:jmap:error:" + kind,
+		"status": status,
+		"detail": detail,
+	}
+	for k, v := range more {
+		problem[k] = v
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(problem)
+}
+
+// API requests: method calls processed in order
+func (h *httpHandler) jmapAPI() func(w http.ResponseWriter, r *http.Request) {
+	return h.handler(func(h *httpHandler, w http.ResponseWriter, r *http.Request) error {
+		if r.Method != "POST" {
+			http.Error(w, "Method not supported", 405)
+			return nil
+		}
+		grant, err := h.jmapGrant(r)
+		if err != nil {
+			return err
+		}
+
+		var req jmapRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, jmapMaxRequest)).Decode(&req); err != nil {
+			jmapProblem(w, "notRequest", err.Error())
+			return nil
+		}
+		if len(req.MethodCalls) > jmapMaxCalls {
+			jmapProblemStatus(w, 400, "limit", "Too many method calls", map[string]interface{}{"limit": "maxCallsInRequest"})
+			return nil
+		}
+		c := &jmapContext{h: h, grant: grant, using: make(map[string]bool)}
+		for _, capability := range req.Using {
+			if capability != jmapCore && capability != jmapMail {
+				jmapProblem(w, "unknownCapability", capability)
+				return nil
+			}
+			c.using[capability] = true
+		}
+
+		resp := &jmapResponse{
+			MethodResponses: make([]*jmapInvocation, 0, len(req.MethodCalls)),
+			CreatedIDs:      req.CreatedIDs,
+			SessionState:    h.jmapSessionState(grant),
+		}
+		for _, call := range req.MethodCalls {
+			name, result, err := c.call(call, resp.MethodResponses)
+			if err != nil {
+				jerr, ok := err.(*jmapError)
+				if !ok {
+					log.Print(r.URL.Path, ": ", call.name, ": ", err)
+					jerr = newJMAPError("serverFail", err.Error())
+				}
+				name, result = "error", jerr
+			}
+			data, err := json.Marshal(result)
+			if err != nil {
+				return err
+			}
+			resp.MethodResponses = append(resp.MethodResponses, &jmapInvocation{name: name, args: data, id: call.id})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(resp)
+	})
+}
+
+// Process one method call, after resolving the references to previous results
+func (c *jmapContext) call(call *jmapInvocation, previous []*jmapInvocation) (string, interface{}, error) {
+	method, found := jmapMethods[call.name]
+	if !found || !c.using[method.capability] {
+		return "", nil, newJMAPError("unknownMethod", call.name)
+	}
+	args, err := jmapResolve(call.args, previous)
+	if err != nil {
+		return "", nil, err
+	}
+	result, err := method.call(c, args)
+	return call.name, result, err
+}
+
+// Replace arguments like "#ids" with the value they refer to (RFC 8620, 3.7)
+func jmapResolve(data json.RawMessage, previous []*jmapInvocation) (json.RawMessage, error) {
+	var args map[string]json.RawMessage
+	if err := json.Unmarshal(data, &args); err != nil {
+		return nil, newJMAPError("invalidArguments", err.Error())
+	}
+	resolved := false
+	for name, value := range args {
+		if !strings.HasPrefix(name, "#") {
+			continue
+		}
+		if _, found := args[name[1:]]; found {
+			return nil, newJMAPError("invalidArguments", "Both "+name+" and "+name[1:]+" are set")
+		}
+		var ref jmapResultReference
+		if err := json.Unmarshal(value, &ref); err != nil {
+			return nil, newJMAPError("invalidResultReference", err.Error())
+		}
+		v, err := ref.resolve(previous)
+		if err != nil {
+			return nil, newJMAPError("invalidResultReference", err.Error())
+		}
+		if args[name[1:]], err = json.Marshal(v); err != nil {
+			return nil, err
+		}
+		delete(args, name)
+		resolved = true
+	}
+	if !resolved {
+		return data, nil
+	}
+	return json.Marshal(args)
+}
+
+func (ref *jmapResultReference) resolve(previous []*jmapInvocation) (interface{}, error) {
+	for _, p := range previous {
+		if p.id != ref.ResultOf {
+			continue
+		}
+		if p.name != ref.Name {
+			return nil, errors.New("Response to " + ref.ResultOf + " is not " + ref.Name)
+		}
+		var v interface{}
+		if err := json.Unmarshal(p.args, &v); err != nil {
+			return nil, err
+		}
+		if ref.Path == "" {
+			return v, nil
+		}
+		if !strings.HasPrefix(ref.Path, "/") {
+			return nil, errJMAPPointer
+		}
+		return jmapPointer(v, strings.Split(ref.Path[1:], "/"))
+	}
+	return nil, errors.New("No response to " + ref.ResultOf)
+}
+
+var jmapPointerEscapes = strings.NewReplacer("~1", "/", "~0", "~")
+
+// Evaluate a JSON pointer, where "*" maps the rest of the path on the
+// items of an array, flattening arrays in the result
+func jmapPointer(v interface{}, tokens []string) (interface{}, error) {
+	if len(tokens) == 0 {
+		return v, nil
+	}
+	token := jmapPointerEscapes.Replace(tokens[0])
+	switch value := v.(type) {
+	case map[string]interface{}:
+		next, found := value[token]
+		if !found {
+			return nil, errJMAPPointer
+		}
+		return jmapPointer(next, tokens[1:])
+	case []interface{}:
+		if token == "*" {
+			result := make([]interface{}, 0, len(value))
+			for _, item := range value {
+				r, err := jmapPointer(item, tokens[1:])
+				if err != nil {
+					return nil, err
+				}
+				if list, ok := r.([]interface{}); ok {
+					result = append(result, list...)
+					continue
+				}
+				result = append(result, r)
+			}
+			return result, nil
+		}
+		i, err := strconv.Atoi(token)
+		if err != nil || i < 0 || i >= len(value) {
+			return nil, errJMAPPointer
+		}
+		return jmapPointer(value[i], tokens[1:])
+	}
+	return nil, errJMAPPointer
+}
+
+// Blobs are messages, by the id of the message, or their parts, by the
+// id of the message and the path of the part after a slash.
+func (h *httpHandler) jmapDownload() func(w http.ResponseWriter, r *http.Request) {
+	return h.handler(func(h *httpHandler, w http.ResponseWriter, r *http.Request) error {
+		if r.Method != "GET" {
+			http.Error(w, "Method not supported", 405)
+			return nil
+		}
+		vars := mux.Vars(r)
+		if vars["account"] != jmapAccount {
+			return errNotFound
+		}
+		blob, err := parseJMAPID(vars["blob"])
+		if err != nil {
+			return errNotFound
+		}
+		id, path := blob, ""
+		if i := strings.IndexByte(blob, '/'); i >= 0 {
+			id, path = blob[:i], blob[i+1:]
+		}
+		file, err := h.findMessage(id)
+		if err != nil {
+			return err
+		}
+		grant, err := h.jmapGrant(r)
+		if err != nil {
+			return err
+		}
+		if grant != nil && !grant.allowsMailbox(file.folder) {
+			return errNotFound
+		}
+
+		contentType := r.URL.Query().Get("accept")
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		// Blobs are always attachments, whatever the type asked for, like parts
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Content-Security-Policy", "sandbox")
+		w.Header().Set("Content-Disposition", "attachment; filename*=UTF-8''"+url.PathEscape(vars["name"]))
+
+		if path != "" {
+			return findPart(file.filename(), path, func(p *mimePart, r io.Reader) error {
+				_, err := io.Copy(w, r)
+				return err
+			})
+		}
+		f, err := os.Open(file.filename())
+		if err != nil {
+			if os.IsNotExist(err) {
+				return errNotFound
+			}
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(w, f)
+		return err
+	})
+}
+
+// Uploads are not supported: any blob is larger than maxSizeUpload, 0
+func (h *httpHandler) jmapUpload() func(w http.ResponseWriter, r *http.Request) {
+	return h.handler(func(h *httpHandler, w http.ResponseWriter, r *http.Request) error {
+		if r.Method != "POST" {
+			http.Error(w, "Method not supported", 405)
+			return nil
+		}
+		if mux.Vars(r)["account"] != jmapAccount {
+			return errNotFound
+		}
+		jmapProblemStatus(w, 413, "limit", "Uploads are not supported", map[string]interface{}{"limit": "maxSizeUpload"})
+		return nil
+	})
+}
+
+const jmapMinPing = 5 // Seconds
+
+// Push of the new states of the index (RFC 8620, 7.3): every change of a
+// message changes the state of both emails and mailboxes.
+func (h *httpHandler) jmapEventSource() func(w http.ResponseWriter, r *http.Request) {
+	return h.handler(func(h *httpHandler, w http.ResponseWriter, r *http.Request) error {
+		if r.Method != "GET" {
+			http.Error(w, "Method not supported", 405)
+			return nil
+		}
+		grant, err := h.jmapGrant(r)
+		if err != nil {
+			return err
+		}
+		c := &jmapContext{h: h, grant: grant}
+
+		query := r.URL.Query()
+		types := make([]string, 0, 2)
+		for _, t := range strings.Split(query.Get("types"), ",") {
+			switch t {
+			case "*":
+				types = []string{"Email", "Mailbox"}
+			case "Email", "Mailbox":
+				types = append(types, t)
+			}
+		}
+		closeAfter := query.Get("closeafter") == "state"
+		var ping time.Duration
+		if p := query.Get("ping"); p != "" {
+			seconds, err := strconv.Atoi(p)
+			if err != nil || seconds < 0 {
+				http.Error(w, "Invalid ping", 400)
+				return nil
+			}
+			if seconds > 0 && seconds < jmapMinPing {
+				seconds = jmapMinPing
+			}
+			ping = time.Duration(seconds) * time.Second
+		}
+
+		rc := http.NewResponseController(w)
+		if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+			log.Print(r.URL.Path, ": cannot disable write deadline: ", err)
+		}
+
+		s := newCacheSubscriber()
+		metrics.cacheSend("sub", func() { h.cache.subCh <- s })
+		defer func() {
+			metrics.cacheSend("unsub", func() { h.cache.unsubCh <- s })
+		}()
+		<-s.replay
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(200)
+		if err := rc.Flush(); err != nil {
+			return nil
+		}
+
+		var pings <-chan time.Time
+		if ping > 0 {
+			ticker := time.NewTicker(ping)
+			defer ticker.Stop()
+			pings = ticker.C
+		}
+		for {
+			select {
+			case e, ok := <-s.events:
+				if !ok {
+					return nil
+				}
+				if !c.allowsMailbox(e.file.folder) || len(types) == 0 {
+					continue
+				}
+				changed := make(map[string]string, len(types))
+				for _, t := range types {
+					changed[t] = c.formatState(e.id)
+				}
+				data, err := json.Marshal(map[string]interface{}{
+					"@type":   "StateChange",
+					"changed": map[string]interface{}{jmapAccount: changed},
+				})
+				if err != nil {
+					return err
+				}
+				if _, err := fmt.Fprintf(w, "event: state\ndata: %s\n\n", data); err != nil {
+					return nil
+				}
+				if closeAfter {
+					rc.Flush()
+					return nil
+				}
+			case <-pings:
+				if _, err := fmt.Fprintf(w, "event: ping\ndata: {\"interval\":%d}\n\n", int(ping/time.Second)); err != nil {
+					return nil
+				}
+			case <-r.Context().Done():
+				return nil
+			}
+			if err := rc.Flush(); err != nil {
+				return nil
+			}
+		}
+	})
+}
@@ -0,0 +1,1260 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Keywords of JMAP and the names of the Maildir flags they are
+var jmapKeywords = map[string]string{
+	"$seen":      "seen",
+	"$flagged":   "flagged",
+	"$answered":  "replied",
+	"$draft":     "draft",
+	"$forwarded": "passed",
+}
+
+// Roles of the folders of the first mailbox, by name
+var jmapRoles = map[string]string{
+	"archive": "archive",
+	"drafts":  "drafts",
+	"junk":    "junk",
+	"sent":    "sent",
+	"spam":    "junk",
+	"trash":   "trash",
+}
+
+var jmapMailboxProperties = []string{"id", "name", "parentId", "role", "sortOrder", "totalEmails",
+	"unreadEmails", "totalThreads", "unreadThreads", "myRights", "isSubscribed"}
+
+var jmapEmailProperties = []string{"id", "blobId", "threadId", "mailboxIds", "keywords", "size",
+	"receivedAt", "messageId", "inReplyTo", "references", "sender", "from", "to", "cc", "bcc",
+	"replyTo", "subject", "sentAt", "hasAttachment", "preview", "bodyValues", "textBody",
+	"htmlBody", "attachments"}
+
+var jmapBodyProperties = []string{"partId", "blobId", "size", "name", "type", "charset",
+	"disposition", "cid", "language", "location"}
+
+// Properties that are known without reading the message
+var jmapIndexedProperties = map[string]bool{
+	"id": true, "blobId": true, "threadId": true, "mailboxIds": true,
+	"keywords": true, "size": true, "receivedAt": true,
+}
+
+// Properties asked for by the client, or the default ones. Unknown
+// properties are an error.
+func jmapSelectProperties(asked *[]string, defaults []string, known ...string) ([]string, error) {
+	if asked == nil {
+		return defaults, nil
+	}
+	valid := make(map[string]bool)
+	for _, p := range defaults {
+		valid[p] = true
+	}
+	for _, p := range known {
+		valid[p] = true
+	}
+	for _, p := range *asked {
+		if !valid[p] {
+			return nil, newJMAPError("invalidArguments", "Unknown property: "+p)
+		}
+	}
+	return *asked, nil
+}
+
+// Only the properties of obj in props
+func jmapFilterProperties(obj map[string]interface{}, props []string) map[string]interface{} {
+	result := make(map[string]interface{}, len(props))
+	for _, p := range props {
+		result[p] = obj[p]
+	}
+	return result
+}
+
+type jmapGetArgs struct {
+	AccountID  string    `json:"accountId"`
+	IDs        *[]string `json:"ids"`
+	Properties *[]string `json:"properties"`
+}
+
+func jmapMailboxGet(c *jmapContext, data json.RawMessage) (interface{}, error) {
+	var args jmapGetArgs
+	if err := c.arguments(data, &args, &args.AccountID); err != nil {
+		return nil, err
+	}
+	props, err := jmapSelectProperties(args.Properties, jmapMailboxProperties)
+	if err != nil {
+		return nil, err
+	}
+	state := c.state()
+
+	mailboxes := c.mailboxes()
+	list := make([]map[string]interface{}, 0, len(mailboxes))
+	notFound := make([]string, 0)
+	if args.IDs == nil {
+		for _, m := range mailboxes {
+			list = append(list, jmapFilterProperties(m, props))
+		}
+	} else {
+		byID := make(map[string]map[string]interface{}, len(mailboxes))
+		for _, m := range mailboxes {
+			byID[m["id"].(string)] = m
+		}
+		for _, id := range *args.IDs {
+			m, found := byID[id]
+			if !found {
+				notFound = append(notFound, id)
+				continue
+			}
+			list = append(list, jmapFilterProperties(m, props))
+		}
+	}
+	return map[string]interface{}{
+		"accountId": jmapAccount,
+		"state":     state,
+		"list":      list,
+		"notFound":  notFound,
+	}, nil
+}
+
+// All the messages, or only the unread ones, in all mailboxes
+func (c *jmapContext) allMessages(unread bool) mailFiles {
+	cr := newCacheRequest()
+	cr.unread = unread
+	cr.limit = math.MaxInt32
+	cr.match = c.h.indexer.keys().keyType("")
+	metrics.cacheSend("request", func() { c.h.cache.requestCh <- cr })
+	return <-cr.data
+}
+
+// Thread of each file
+func (c *jmapContext) threads(files mailFiles) []threadSummary {
+	if len(files) == 0 {
+		// Would be all the threads
+		return nil
+	}
+	tr := newCacheThreadsRequest()
+	tr.files = files
+	metrics.cacheSend("threads", func() { c.h.cache.threadsCh <- tr })
+	return <-tr.data
+}
+
+// The folders the client can see, with messages or configured
+func (c *jmapContext) mailboxes() []map[string]interface{} {
+	conf := c.h.config
+	mr := newCacheMailboxesRequest()
+	metrics.cacheSend("mailboxes", func() { c.h.cache.mboxCh <- mr })
+	counts := <-mr.data
+	for _, name := range conf.mailboxes.names() {
+		if _, found := counts[name]; !found {
+			counts[name] = 0
+		}
+	}
+
+	// Threads of all the messages and of the unread ones, by folder
+	threads := make(map[string]map[string]bool)
+	unreadThreads := make(map[string]map[string]bool)
+	unread := make(map[string]int)
+	for _, u := range []bool{false, true} {
+		files := c.allMessages(u)
+		for i, t := range c.threads(files) {
+			folder := files[i].folder
+			set := threads
+			if u {
+				set = unreadThreads
+				unread[folder]++
+			}
+			if set[folder] == nil {
+				set[folder] = make(map[string]bool)
+			}
+			set[folder][t.ID] = true
+		}
+	}
+
+	folders := make([]string, 0, len(counts))
+	known := make(map[string]bool, len(counts))
+	for f := range counts {
+		if c.allowsMailbox(f) {
+			folders = append(folders, f)
+			known[f] = true
+		}
+	}
+	sort.Strings(folders)
+
+	inbox := conf.mailboxes[0].name
+	roles := make(map[string]bool)
+	mailboxes := make([]map[string]interface{}, 0, len(folders))
+	for _, f := range folders {
+		parent, name := jmapParent(f, known)
+		var parentID, role interface{}
+		if parent != "" {
+			parentID = jmapID(parent)
+		}
+		if f == inbox {
+			role = "inbox"
+		} else if r, found := jmapRoles[strings.ToLower(name)]; found && parent == inbox && !roles[r] {
+			role = r
+			roles[r] = true
+		}
+		sortOrder := 1
+		if f == inbox {
+			sortOrder = 0
+		}
+		mailboxes = append(mailboxes, map[string]interface{}{
+			"id":            jmapID(f),
+			"name":          name,
+			"parentId":      parentID,
+			"role":          role,
+			"sortOrder":     sortOrder,
+			"totalEmails":   counts[f],
+			"unreadEmails":  unread[f],
+			"totalThreads":  len(threads[f]),
+			"unreadThreads": len(unreadThreads[f]),
+			"myRights": map[string]bool{
+				"mayReadItems":   true,
+				"mayAddItems":    false,
+				"mayRemoveItems": c.allows(authDelete),
+				"maySetSeen":     c.allows(authWrite),
+				"maySetKeywords": c.allows(authWrite),
+				"mayCreateChild": false,
+				"mayRename":      false,
+				"mayDelete":      false,
+				"maySubmit":      false,
+			},
+			"isSubscribed": true,
+		})
+	}
+	return mailboxes
+}
+
+// The closest folder containing folder, among known ones, and the
+// name of folder inside it: "work.Sent" is "Sent" in "work".
+func jmapParent(folder string, known map[string]bool) (string, string) {
+	parent := folder
+	for {
+		i := strings.LastIndexByte(parent, '.')
+		if i < 0 {
+			return "", folder
+		}
+		parent = parent[:i]
+		if known[parent] {
+			return parent, folder[len(parent)+1:]
+		}
+	}
+}
+
+// Messages in a folder
+type searchMailbox string
+
+func (s searchMailbox) eval(c *caches, all fileSet) fileSet {
+	result := make(fileSet)
+	for f := range all {
+		if f.folder == string(s) {
+			result[f] = struct{}{}
+		}
+	}
+	return result
+}
+
+// Translate a filter of Email/query into a query for the caches. Headers
+// must be indexed and are matched ignoring case; text needs the body index.
+func (c *jmapContext) filter(data json.RawMessage) (searchNode, error) {
+	var f map[string]json.RawMessage
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, newJMAPError("invalidArguments", "Invalid filter: "+err.Error())
+	}
+	if f == nil {
+		return searchAll{}, nil
+	}
+
+	if op, found := f["operator"]; found {
+		var (
+			operator   string
+			conditions []json.RawMessage
+		)
+		if err := json.Unmarshal(op, &operator); err != nil {
+			return nil, newJMAPError("invalidArguments", "Invalid operator")
+		}
+		if err := json.Unmarshal(f["conditions"], &conditions); err != nil {
+			return nil, newJMAPError("invalidArguments", "Invalid conditions")
+		}
+		nodes := make([]searchNode, 0, len(conditions))
+		for _, cond := range conditions {
+			n, err := c.filter(cond)
+			if err != nil {
+				return nil, err
+			}
+			nodes = append(nodes, n)
+		}
+		switch operator {
+		case "AND":
+			if len(nodes) == 0 {
+				return searchAll{}, nil
+			}
+			return searchAnd(nodes), nil
+		case "OR":
+			return searchOr(nodes), nil
+		case "NOT":
+			return searchNot{node: searchOr(nodes)}, nil
+		}
+		return nil, newJMAPError("unsupportedFilter", "Unknown operator: "+operator)
+	}
+
+	nodes := make(searchAnd, 0, len(f))
+	for name, value := range f {
+		n, err := c.condition(name, value)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, n)
+	}
+	if len(nodes) == 0 {
+		return searchAll{}, nil
+	}
+	return nodes, nil
+}
+
+func (c *jmapContext) condition(name string, data json.RawMessage) (searchNode, error) {
+	invalid := newJMAPError("invalidArguments", "Invalid value for "+name)
+
+	switch name {
+	case "inMailbox":
+		var id string
+		if err := json.Unmarshal(data, &id); err != nil {
+			return nil, invalid
+		}
+		folder, err := parseJMAPID(id)
+		if err != nil {
+			return searchOr{}, nil
+		}
+		return searchMailbox(folder), nil
+	case "inMailboxOtherThan":
+		var ids []string
+		if err := json.Unmarshal(data, &ids); err != nil {
+			return nil, invalid
+		}
+		any := make(searchOr, 0, len(ids))
+		for _, id := range ids {
+			if folder, err := parseJMAPID(id); err == nil {
+				any = append(any, searchMailbox(folder))
+			}
+		}
+		return searchNot{node: any}, nil
+	case "before", "after":
+		var t time.Time
+		if err := json.Unmarshal(data, &t); err != nil {
+			return nil, invalid
+		}
+		if name == "before" {
+			return searchDate{until: t}, nil
+		}
+		return searchDate{since: t}, nil
+	case "hasKeyword", "notKeyword":
+		var keyword string
+		if err := json.Unmarshal(data, &keyword); err != nil {
+			return nil, invalid
+		}
+		// Other keywords cannot be set
+		var node searchNode = searchOr{}
+		if flag, found := jmapKeywords[strings.ToLower(keyword)]; found {
+			node = searchHeader{header: flagKey, value: flag, match: keyTypeNormal}
+		}
+		if name == "notKeyword" {
+			node = searchNot{node: node}
+		}
+		return node, nil
+	case "from", "to", "cc", "bcc", "subject":
+		var value string
+		if err := json.Unmarshal(data, &value); err != nil {
+			return nil, invalid
+		}
+		return c.header(name, value)
+	case "header":
+		var header []string
+		if err := json.Unmarshal(data, &header); err != nil || len(header) == 0 || len(header) > 2 {
+			return nil, invalid
+		}
+		// Without a value, messages with the header at all
+		header = append(header, "")
+		return c.header(strings.ToLower(header[0]), header[1])
+	case "body":
+		var value string
+		if err := json.Unmarshal(data, &value); err != nil {
+			return nil, invalid
+		}
+		if !c.h.indexer.body {
+			return nil, newJMAPError("unsupportedFilter", "The body of messages is not indexed")
+		}
+		return jmapPhrase(value), nil
+	case "text":
+		var value string
+		if err := json.Unmarshal(data, &value); err != nil {
+			return nil, invalid
+		}
+		any := make(searchOr, 0)
+		for _, h := range []string{"from", "to", "cc", "bcc", "subject"} {
+			if n, err := c.header(h, value); err == nil {
+				any = append(any, n)
+			}
+		}
+		if c.h.indexer.body {
+			any = append(any, jmapPhrase(value))
+		}
+		if len(any) == 0 {
+			return nil, newJMAPError("unsupportedFilter", "Neither headers nor the body of messages are indexed")
+		}
+		return any, nil
+	}
+	return nil, newJMAPError("unsupportedFilter", "Unsupported condition: "+name)
+}
+
+func (c *jmapContext) header(header, value string) (searchNode, error) {
+	keys := c.h.indexer.keys()
+	if header == "" || header == flagKey || !keys.has(header) || keys.keyType(header) == keyTypeAny {
+		return nil, newJMAPError("unsupportedFilter", "Header not indexed: "+header)
+	}
+	return searchHeaderFold{header: header, value: value}, nil
+}
+
+func jmapPhrase(value string) searchNode {
+	words := tokenize(value, nil)
+	if len(words) == 0 {
+		return searchAll{}
+	}
+	return searchPhrase(words)
+}
+
+type jmapComparator struct {
+	Property    string `json:"property"`
+	IsAscending *bool  `json:"isAscending"`
+}
+
+type jmapQueryArgs struct {
+	AccountID       string           `json:"accountId"`
+	Filter          json.RawMessage  `json:"filter"`
+	Sort            []jmapComparator `json:"sort"`
+	Position        int              `json:"position"`
+	Anchor          *string          `json:"anchor"`
+	AnchorOffset    int              `json:"anchorOffset"`
+	Limit           *int             `json:"limit"`
+	CalculateTotal  bool             `json:"calculateTotal"`
+	CollapseThreads bool             `json:"collapseThreads"`
+}
+
+// Both dates are the one the messages are sorted by in the index
+func jmapEmailQuery(c *jmapContext, data json.RawMessage) (interface{}, error) {
+	var args jmapQueryArgs
+	if err := c.arguments(data, &args, &args.AccountID); err != nil {
+		return nil, err
+	}
+	query := searchNode(searchAll{})
+	if len(args.Filter) > 0 {
+		var err error
+		if query, err = c.filter(args.Filter); err != nil {
+			return nil, err
+		}
+	}
+	ascending := false
+	if len(args.Sort) > 1 {
+		return nil, newJMAPError("unsupportedSort", "Only one comparator is supported")
+	}
+	for _, s := range args.Sort {
+		if s.Property != "receivedAt" && s.Property != "sentAt" {
+			return nil, newJMAPError("unsupportedSort", "Cannot sort by "+s.Property)
+		}
+		ascending = s.IsAscending == nil || *s.IsAscending
+	}
+	state := c.state()
+
+	cr := newCacheRequest()
+	cr.query = query
+	cr.oldest = ascending
+	cr.limit = math.MaxInt32
+	metrics.cacheSend("request", func() { c.h.cache.requestCh <- cr })
+	files := newMailFiles()
+	for _, f := range <-cr.data {
+		if c.allowsMailbox(f.folder) {
+			files = append(files, f)
+		}
+	}
+	if args.CollapseThreads {
+		seen := make(map[string]bool)
+		collapsed := newMailFiles()
+		for i, t := range c.threads(files) {
+			if !seen[t.ID] {
+				seen[t.ID] = true
+				collapsed = append(collapsed, files[i])
+			}
+		}
+		files = collapsed
+	}
+
+	ids := make([]string, len(files))
+	for i, f := range files {
+		ids[i] = jmapID(f.id())
+	}
+
+	position := args.Position
+	if args.Anchor != nil {
+		position = -1
+		for i, id := range ids {
+			if id == *args.Anchor {
+				position = i
+				break
+			}
+		}
+		if position < 0 {
+			return nil, newJMAPError("anchorNotFound", "")
+		}
+		position += args.AnchorOffset
+	} else if position < 0 {
+		position += len(ids)
+	}
+	if position < 0 {
+		position = 0
+	}
+	if position > len(ids) {
+		position = len(ids)
+	}
+
+	limit := jmapMaxQueryLimit
+	if args.Limit != nil {
+		if *args.Limit < 0 {
+			return nil, newJMAPError("invalidArguments", "Negative limit")
+		}
+		if *args.Limit < limit {
+			limit = *args.Limit
+		}
+	}
+	end := position + limit
+	if end > len(ids) {
+		end = len(ids)
+	}
+
+	result := map[string]interface{}{
+		"accountId":           jmapAccount,
+		"queryState":          state,
+		"canCalculateChanges": false,
+		"position":            position,
+		"ids":                 ids[position:end],
+	}
+	if args.CalculateTotal {
+		result["total"] = len(ids)
+	}
+	if args.Limit != nil && *args.Limit > limit {
+		result["limit"] = limit
+	}
+	return result, nil
+}
+
+type jmapEmailGetArgs struct {
+	jmapGetArgs
+	BodyProperties      *[]string `json:"bodyProperties"`
+	FetchTextBodyValues bool      `json:"fetchTextBodyValues"`
+	FetchHTMLBodyValues bool      `json:"fetchHTMLBodyValues"`
+	FetchAllBodyValues  bool      `json:"fetchAllBodyValues"`
+	MaxBodyValueBytes   int       `json:"maxBodyValueBytes"`
+}
+
+// The message with a JMAP id, if the client can see it
+func (c *jmapContext) message(id string) (mailFile, bool) {
+	msgID, err := parseJMAPID(id)
+	if err != nil {
+		return mailFile{}, false
+	}
+	file, err := c.h.findMessage(msgID)
+	if err != nil || !c.allowsMailbox(file.folder) {
+		return mailFile{}, false
+	}
+	return file, true
+}
+
+func jmapEmailGet(c *jmapContext, data json.RawMessage) (interface{}, error) {
+	var args jmapEmailGetArgs
+	if err := c.arguments(data, &args, &args.AccountID); err != nil {
+		return nil, err
+	}
+	if args.IDs == nil || len(*args.IDs) > jmapMaxObjects {
+		return nil, newJMAPError("requestTooLarge", "Ask for at most "+strconv.Itoa(jmapMaxObjects)+" ids")
+	}
+	if args.MaxBodyValueBytes < 0 {
+		return nil, newJMAPError("invalidArguments", "Negative maxBodyValueBytes")
+	}
+	props, err := jmapSelectProperties(args.Properties, jmapEmailProperties, "bodyStructure")
+	if err != nil {
+		return nil, err
+	}
+	bodyProps, err := jmapSelectProperties(args.BodyProperties, jmapBodyProperties, "subParts")
+	if err != nil {
+		return nil, err
+	}
+	state := c.state()
+
+	files := newMailFiles()
+	ids := make([]string, 0, len(*args.IDs))
+	notFound := make([]string, 0)
+	for _, id := range *args.IDs {
+		file, found := c.message(id)
+		if !found {
+			notFound = append(notFound, id)
+			continue
+		}
+		files = append(files, file)
+		ids = append(ids, id)
+	}
+	threads := c.threads(files)
+
+	list := make([]map[string]interface{}, 0, len(files))
+	for i, f := range files {
+		email, err := c.email(f, threads[i].ID, props, bodyProps, &args)
+		if os.IsNotExist(err) {
+			notFound = append(notFound, ids[i])
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, email)
+	}
+	return map[string]interface{}{
+		"accountId": jmapAccount,
+		"state":     state,
+		"list":      list,
+		"notFound":  notFound,
+	}, nil
+}
+
+// Keywords of the flags of a message
+func jmapFileKeywords(file mailFile) map[string]bool {
+	keywords := make(map[string]bool)
+	for _, flag := range file.flags() {
+		for k, f := range jmapKeywords {
+			if f == flag {
+				keywords[k] = true
+			}
+		}
+	}
+	return keywords
+}
+
+func jmapDate(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05Z")
+}
+
+// The properties props of an Email object
+func (c *jmapContext) email(file mailFile, thread string, props, bodyProps []string, args *jmapEmailGetArgs) (map[string]interface{}, error) {
+	info, err := os.Stat(file.filename())
+	if err != nil {
+		return nil, err
+	}
+	received := file.date
+	if received.IsZero() {
+		received = info.ModTime()
+	}
+	email := map[string]interface{}{
+		"id":         jmapID(file.id()),
+		"blobId":     jmapID(file.id()),
+		"threadId":   thread,
+		"mailboxIds": map[string]bool{jmapID(file.folder): true},
+		"keywords":   jmapFileKeywords(file),
+		"size":       info.Size(),
+		"receivedAt": jmapDate(received),
+	}
+
+	parse := false
+	for _, p := range props {
+		if !jmapIndexedProperties[p] {
+			parse = true
+		}
+	}
+	if !parse {
+		return jmapFilterProperties(email, props), nil
+	}
+
+	msg, err := parseJMAPMessage(file)
+	if err != nil {
+		return nil, err
+	}
+	h := msg.header
+	for _, name := range []string{"messageId", "inReplyTo", "references"} {
+		email[name] = msg.messageIDs(name)
+	}
+	for name, header := range map[string]string{"sender": "sender", "from": "from", "to": "to",
+		"cc": "cc", "bcc": "bcc", "replyTo": "reply-to"} {
+		email[name] = msg.addresses(header)
+	}
+	email["subject"] = nil
+	if _, values := h.get("subject"); len(values) > 0 {
+		email["subject"] = decodeHeader(values[0])
+	}
+	email["sentAt"] = nil
+	if date, err := h.Date(); err == nil {
+		email["sentAt"] = date.Format(time.RFC3339)
+	}
+
+	var text, html, attachments []*mimePart
+	jmapBodies([]*mimePart{msg.root}, "mixed", false, &text, &html, &attachments)
+	parts := func(list []*mimePart) []map[string]interface{} {
+		result := make([]map[string]interface{}, len(list))
+		for i, p := range list {
+			result[i] = msg.bodyPart(p, bodyProps)
+		}
+		return result
+	}
+	email["textBody"] = parts(text)
+	email["htmlBody"] = parts(html)
+	email["attachments"] = parts(attachments)
+	email["bodyStructure"] = msg.bodyPart(msg.root, bodyProps)
+	email["hasAttachment"] = len(attachments) > 0
+	email["preview"] = msg.preview(text)
+
+	values := make(map[string]interface{})
+	addValues := func(list []*mimePart) {
+		for _, p := range list {
+			if value, found := msg.bodyValue(p, args.MaxBodyValueBytes); found {
+				values[p.path] = value
+			}
+		}
+	}
+	if args.FetchTextBodyValues {
+		addValues(text)
+	}
+	if args.FetchHTMLBodyValues {
+		addValues(html)
+	}
+	if args.FetchAllBodyValues {
+		addValues(msg.leaves(msg.root, nil))
+	}
+	email["bodyValues"] = values
+
+	return jmapFilterProperties(email, props), nil
+}
+
+// A message parsed for Email/get, with its text parts decoded
+type jmapMessage struct {
+	file     mailFile
+	header   ciHeader
+	root     *mimePart
+	sizes    map[string]int64 // Of the leaf parts, decoded
+	texts    map[string]string
+	problems map[string]bool // Text parts that could not be decoded
+}
+
+func parseJMAPMessage(file mailFile) (*jmapMessage, error) {
+	f, err := os.Open(file.filename())
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	msg, err := mail.ReadMessage(f)
+	if err != nil {
+		return nil, err
+	}
+	m := &jmapMessage{
+		file:     file,
+		header:   ciHeader(msg.Header),
+		sizes:    make(map[string]int64),
+		texts:    make(map[string]string),
+		problems: make(map[string]bool),
+	}
+	m.root, err = parseMIME(textproto.MIMEHeader(msg.Header), msg.Body, func(p *mimePart, r io.Reader) error {
+		if !strings.HasPrefix(p.contentType, "text/") {
+			n, err := io.Copy(ioutil.Discard, p.decode(r))
+			m.sizes[p.path] = n
+			m.problems[p.path] = err != nil
+			return nil
+		}
+		data, err := ioutil.ReadAll(p.decode(r))
+		m.sizes[p.path] = int64(len(data))
+		m.texts[p.path] = decodeCharset(data, p.params["charset"])
+		m.problems[p.path] = err != nil
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Message-IDs in a header, without angle brackets, or nil
+func (m *jmapMessage) messageIDs(property string) []string {
+	header := map[string]string{
+		"messageId":  "message-id",
+		"inReplyTo":  "in-reply-to",
+		"references": "references",
+	}[property]
+	_, values := m.header.get(header)
+	if len(values) == 0 {
+		return nil
+	}
+	ids := parseMessageIDs(strings.Join(values, " "))
+	if len(ids) == 0 {
+		return nil
+	}
+	return ids
+}
+
+type jmapAddress struct {
+	Name  *string `json:"name"`
+	Email string  `json:"email"`
+}
+
+// Addresses in a header, or nil without the header
+func (m *jmapMessage) addresses(header string) []jmapAddress {
+	key, values := m.header.get(header)
+	if values == nil {
+		return nil
+	}
+	list, err := m.header.AddressList(key)
+	if err != nil {
+		return []jmapAddress{}
+	}
+	addresses := make([]jmapAddress, len(list))
+	for i, a := range list {
+		addresses[i].Email = a.Address
+		if a.Name != "" {
+			name := a.Name
+			addresses[i].Name = &name
+		}
+	}
+	return addresses
+}
+
+// Choose the parts to show as text, as HTML and as attachments, with the
+// algorithm of RFC 8621, 4.1.4. A nil text or html is not filled anymore,
+// as an alternative of the other kind was found.
+func jmapBodies(parts []*mimePart, multipart string, inAlternative bool, text, html, attachments *[]*mimePart) {
+	textLength, htmlLength := -1, -1
+	if text != nil {
+		textLength = len(*text)
+	}
+	if html != nil {
+		htmlLength = len(*html)
+	}
+
+	for i, p := range parts {
+		media := strings.SplitN(p.contentType, "/", 2)[0]
+		inlineMedia := media == "image" || media == "audio" || media == "video"
+		inline := p.disposition != "attachment" &&
+			(p.contentType == "text/plain" || p.contentType == "text/html" || inlineMedia) &&
+			(i == 0 || (multipart != "related" && (inlineMedia || p.filename == "")))
+
+		switch {
+		case p.isMultipart():
+			sub := strings.TrimPrefix(p.contentType, "multipart/")
+			jmapBodies(p.parts, sub, inAlternative || sub == "alternative", text, html, attachments)
+		case inline:
+			if multipart == "alternative" {
+				switch p.contentType {
+				case "text/plain":
+					*text = append(*text, p)
+				case "text/html":
+					*html = append(*html, p)
+				default:
+					*attachments = append(*attachments, p)
+				}
+				continue
+			}
+			if inAlternative {
+				if p.contentType == "text/plain" {
+					html = nil
+				}
+				if p.contentType == "text/html" {
+					text = nil
+				}
+			}
+			if text != nil {
+				*text = append(*text, p)
+			}
+			if html != nil {
+				*html = append(*html, p)
+			}
+			if (text == nil || html == nil) && inlineMedia {
+				*attachments = append(*attachments, p)
+			}
+		default:
+			*attachments = append(*attachments, p)
+		}
+	}
+
+	if multipart == "alternative" && text != nil && html != nil {
+		if textLength == len(*text) && htmlLength != len(*html) {
+			*text = append(*text, (*html)[htmlLength:]...)
+		}
+		if htmlLength == len(*html) && textLength != len(*text) {
+			*html = append(*html, (*text)[textLength:]...)
+		}
+	}
+}
+
+// The leaf parts under p
+func (m *jmapMessage) leaves(p *mimePart, result []*mimePart) []*mimePart {
+	if !p.isMultipart() {
+		return append(result, p)
+	}
+	for _, c := range p.parts {
+		result = m.leaves(c, result)
+	}
+	return result
+}
+
+// An EmailBodyPart with the properties props
+func (m *jmapMessage) bodyPart(p *mimePart, props []string) map[string]interface{} {
+	optional := func(s string) interface{} {
+		if s == "" {
+			return nil
+		}
+		return s
+	}
+	part := map[string]interface{}{
+		"partId":      nil,
+		"blobId":      nil,
+		"size":        0,
+		"name":        optional(p.filename),
+		"type":        p.contentType,
+		"charset":     nil,
+		"disposition": optional(p.disposition),
+		"cid":         optional(strings.Trim(p.header.Get("Content-Id"), "<> ")),
+		"language":    nil,
+		"location":    optional(p.header.Get("Content-Location")),
+	}
+	if lang := p.header.Get("Content-Language"); lang != "" {
+		languages := strings.Split(lang, ",")
+		for i := range languages {
+			languages[i] = strings.TrimSpace(languages[i])
+		}
+		part["language"] = languages
+	}
+
+	if p.isMultipart() {
+		subParts := make([]map[string]interface{}, len(p.parts))
+		for i, c := range p.parts {
+			subParts[i] = m.bodyPart(c, props)
+		}
+		part["subParts"] = subParts
+	} else {
+		part["partId"] = p.path
+		part["blobId"] = jmapID(m.file.id() + "/" + p.path)
+		part["size"] = m.sizes[p.path]
+		if charset := p.params["charset"]; charset != "" {
+			part["charset"] = charset
+		} else if strings.HasPrefix(p.contentType, "text/") {
+			part["charset"] = "us-ascii"
+		}
+	}
+
+	result := jmapFilterProperties(part, props)
+	if subParts, found := part["subParts"]; found {
+		result["subParts"] = subParts
+	}
+	return result
+}
+
+// The decoded text of a part, truncated to max bytes if not zero
+func (m *jmapMessage) bodyValue(p *mimePart, max int) (map[string]interface{}, bool) {
+	text, found := m.texts[p.path]
+	if !found {
+		return nil, false
+	}
+	truncated := false
+	if max > 0 && len(text) > max {
+		for max > 0 && !utf8.RuneStart(text[max]) {
+			max--
+		}
+		text, truncated = text[:max], true
+	}
+	return map[string]interface{}{
+		"value":             text,
+		"isEncodingProblem": m.problems[p.path],
+		"isTruncated":       truncated,
+	}, true
+}
+
+// The start of the text of the message, with white space collapsed
+func (m *jmapMessage) preview(text []*mimePart) string {
+	for _, p := range text {
+		body, found := m.texts[p.path]
+		if !found {
+			continue
+		}
+		if p.contentType == "text/html" {
+			body = stripHTML(body)
+		}
+		words := strings.FieldsFunc(body, unicode.IsSpace)
+		preview := []rune(strings.Join(words, " "))
+		if len(preview) > 256 {
+			preview = preview[:256]
+		}
+		return string(preview)
+	}
+	return ""
+}
+
+type jmapChangesArgs struct {
+	AccountID  string `json:"accountId"`
+	SinceState string `json:"sinceState"`
+	MaxChanges *int   `json:"maxChanges"`
+}
+
+// Messages created, updated and destroyed after a state, from the events
+// of the index. Only the recent events are kept: older states cannot be
+// caught up with.
+func jmapEmailChanges(c *jmapContext, data json.RawMessage) (interface{}, error) {
+	var args jmapChangesArgs
+	if err := c.arguments(data, &args, &args.AccountID); err != nil {
+		return nil, err
+	}
+	if args.MaxChanges != nil && *args.MaxChanges <= 0 {
+		return nil, newJMAPError("invalidArguments", "maxChanges must be positive")
+	}
+	since, err := c.parseState(args.SinceState)
+	if err != nil {
+		return nil, newJMAPError("cannotCalculateChanges", err.Error())
+	}
+	cr := newCacheChangesRequest(since)
+	metrics.cacheSend("changes", func() { c.h.cache.changesCh <- cr })
+	changes := <-cr.data
+	if changes.events == nil {
+		return nil, newJMAPError("cannotCalculateChanges", "State unknown or too old")
+	}
+
+	// The first and the last kind of event for each message
+	type change struct {
+		first, last cacheEventType
+	}
+	byID := make(map[string]*change)
+	order := make([]string, 0)
+	state := since
+	more := false
+	for _, e := range changes.events {
+		if !c.allowsMailbox(e.file.folder) {
+			state = e.id
+			continue
+		}
+		id := jmapID(e.file.id())
+		ch, found := byID[id]
+		if !found {
+			if args.MaxChanges != nil && len(order) == *args.MaxChanges {
+				more = true
+				break
+			}
+			ch = &change{first: e.kind}
+			byID[id] = ch
+			order = append(order, id)
+		}
+		ch.last = e.kind
+		state = e.id
+	}
+	if !more {
+		state = changes.state
+	}
+
+	created, updated, destroyed := make([]string, 0), make([]string, 0), make([]string, 0)
+	for _, id := range order {
+		ch := byID[id]
+		switch {
+		case ch.first == cacheEventAdded && ch.last == cacheEventRemoved:
+			// Never seen by the client
+		case ch.first == cacheEventAdded:
+			created = append(created, id)
+		case ch.last == cacheEventRemoved:
+			destroyed = append(destroyed, id)
+		default:
+			updated = append(updated, id)
+		}
+	}
+	return map[string]interface{}{
+		"accountId":      jmapAccount,
+		"oldState":       args.SinceState,
+		"newState":       c.formatState(state),
+		"hasMoreChanges": more,
+		"created":        created,
+		"updated":        updated,
+		"destroyed":      destroyed,
+	}, nil
+}
+
+type jmapSetArgs struct {
+	AccountID string                                `json:"accountId"`
+	IfInState *string                               `json:"ifInState"`
+	Create    map[string]json.RawMessage            `json:"create"`
+	Update    map[string]map[string]json.RawMessage `json:"update"`
+	Destroy   []string                              `json:"destroy"`
+}
+
+// Messages can only be destroyed, and have their keywords changed
+func jmapEmailSet(c *jmapContext, data json.RawMessage) (interface{}, error) {
+	var args jmapSetArgs
+	if err := c.arguments(data, &args, &args.AccountID); err != nil {
+		return nil, err
+	}
+	if len(args.Create)+len(args.Update)+len(args.Destroy) > jmapMaxObjects {
+		return nil, newJMAPError("requestTooLarge", "")
+	}
+	oldState := c.state()
+	if args.IfInState != nil && *args.IfInState != oldState {
+		return nil, newJMAPError("stateMismatch", "")
+	}
+
+	notCreated := make(map[string]*jmapError)
+	for id := range args.Create {
+		notCreated[id] = newJMAPError("forbidden", "Messages are delivered via SMTP or HTTP")
+	}
+
+	destroying := make(map[string]bool, len(args.Destroy))
+	for _, id := range args.Destroy {
+		destroying[id] = true
+	}
+	updated := make(map[string]interface{})
+	notUpdated := make(map[string]error)
+	for id, patch := range args.Update {
+		if destroying[id] {
+			notUpdated[id] = newJMAPError("willDestroy", "")
+			continue
+		}
+		if err := c.updateEmail(id, patch); err != nil {
+			switch err.(type) {
+			case *jmapError, *jmapSetError:
+				notUpdated[id] = err
+				continue
+			}
+			return nil, err
+		}
+		updated[id] = nil
+	}
+
+	destroyed := make([]string, 0)
+	notDestroyed := make(map[string]*jmapError)
+	files := newMailFiles()
+	ids := make(map[mailFile]string)
+	for _, id := range args.Destroy {
+		if !c.allows(authDelete) {
+			notDestroyed[id] = newJMAPError("forbidden", "")
+			continue
+		}
+		file, found := c.message(id)
+		if !found {
+			notDestroyed[id] = newJMAPError("notFound", "")
+			continue
+		}
+		if _, found := ids[file]; found {
+			continue
+		}
+		ids[file] = id
+		files = append(files, file)
+	}
+	if len(files) > 0 {
+		failed := make(map[mailFile]bool)
+		for _, f := range files.delete() {
+			failed[f] = true
+		}
+		c.h.crawler.rescan()
+		for _, f := range files {
+			id := ids[f]
+			if failed[f] {
+				notDestroyed[id] = newJMAPError("serverFail", "Cannot remove the message")
+				continue
+			}
+			destroyed = append(destroyed, id)
+		}
+	}
+
+	return map[string]interface{}{
+		"accountId":    jmapAccount,
+		"oldState":     oldState,
+		"newState":     c.state(),
+		"created":      nil,
+		"updated":      updated,
+		"destroyed":    destroyed,
+		"notCreated":   notCreated,
+		"notUpdated":   notUpdated,
+		"notDestroyed": notDestroyed,
+	}, nil
+}
+
+// Change the keywords of a message, with all of them in "keywords" or
+// one at a time as "keywords/$seen"
+func (c *jmapContext) updateEmail(id string, patch map[string]json.RawMessage) error {
+	if !c.allows(authWrite) {
+		return newJMAPError("forbidden", "")
+	}
+	file, found := c.message(id)
+	if !found {
+		return newJMAPError("notFound", "")
+	}
+
+	invalid := func(property, description string) error {
+		return &jmapSetError{jmapError: jmapError{Type: "invalidProperties", Description: description}, Properties: []string{property}}
+	}
+	flag := func(keyword string) (string, bool) {
+		f, found := jmapKeywords[strings.ToLower(keyword)]
+		return f, found
+	}
+	var fp flagsPatch
+	for property, value := range patch {
+		if property == "keywords" {
+			var keywords map[string]bool
+			if err := json.Unmarshal(value, &keywords); err != nil {
+				return invalid(property, "Invalid keywords")
+			}
+			flags := make([]string, 0, len(keywords))
+			for k, set := range keywords {
+				f, found := flag(k)
+				if !found || !set {
+					return invalid(property, "Unsupported keyword: "+k)
+				}
+				flags = append(flags, f)
+			}
+			fp.Flags = &flags
+			continue
+		}
+		if !strings.HasPrefix(property, "keywords/") {
+			return invalid(property, "Only keywords can be changed")
+		}
+		keyword := jmapPointerEscapes.Replace(strings.TrimPrefix(property, "keywords/"))
+		f, found := flag(keyword)
+		if !found {
+			return invalid(property, "Unsupported keyword: "+keyword)
+		}
+		switch string(value) {
+		case "true":
+			fp.Add = append(fp.Add, f)
+		case "null", "false":
+			fp.Remove = append(fp.Remove, f)
+		default:
+			return invalid(property, "Invalid value")
+		}
+	}
+
+	info, err := fp.apply(file)
+	if err != nil {
+		return invalid("keywords", err.Error())
+	}
+	if to := file.withInfo(info); to != file.filename() {
+		if _, err := c.h.crawler.renameFile(file, to); err != nil {
+			if os.IsNotExist(err) {
+				return newJMAPError("notFound", "")
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// A SetError naming the properties that are invalid
+type jmapSetError struct {
+	jmapError
+	Properties []string `json:"properties"`
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/mail"
+	"net/textproto"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestJMAPPointer(t *testing.T) {
+	var v interface{}
+	data := `{"ids": ["a", "b"], "list": [{"thread": ["x", "y"]}, {"thread": ["z"]}], "a/b": 1}`
+	if err := json.Unmarshal([]byte(data), &v); err != nil {
+		t.Fatal(err)
+	}
+	for path, expected := range map[string]string{
+		"/ids":           `["a","b"]`,
+		"/ids/1":         `"b"`,
+		"/list/*/thread": `["x","y","z"]`,
+		"/a~1b":          `1`,
+	} {
+		r, err := jmapPointer(v, strings.Split(path[1:], "/"))
+		if err != nil {
+			t.Fatal(path, ": ", err)
+		}
+		if got, _ := json.Marshal(r); string(got) != expected {
+			t.Errorf("%s: expected %s, got %s", path, expected, got)
+		}
+	}
+	for _, bad := range []string{"/nope", "/ids/2", "/ids/x"} {
+		if _, err := jmapPointer(v, strings.Split(bad[1:], "/")); err == nil {
+			t.Errorf("%s: expected error", bad)
+		}
+	}
+}
+
+func TestJMAPBodies(t *testing.T) {
+	msg, err := mail.ReadMessage(strings.NewReader(testMultipart))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := parseMIME(textproto.MIMEHeader(msg.Header), msg.Body, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var text, html, attachments []*mimePart
+	jmapBodies([]*mimePart{root}, "mixed", false, &text, &html, &attachments)
+
+	paths := func(parts []*mimePart) []string {
+		r := make([]string, len(parts))
+		for i, p := range parts {
+			r[i] = p.path
+		}
+		return r
+	}
+	for name, c := range map[string]struct {
+		parts    []*mimePart
+		expected []string
+	}{
+		"text":        {text, []string{"1.1"}},
+		"html":        {html, []string{"1.2"}},
+		"attachments": {attachments, []string{"2"}},
+	} {
+		if got := paths(c.parts); !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("%s: expected %v, got %v", name, c.expected, got)
+		}
+	}
+}
+
+func TestJMAPParent(t *testing.T) {
+	known := map[string]bool{"work": true, "work.Sent": true}
+	for folder, expected := range map[string][2]string{
+		"work":          {"", "work"},
+		"work.Sent":     {"work", "Sent"},
+		"work.Sent.Old": {"work.Sent", "Old"},
+		"work.a.b":      {"work", "a.b"},
+		"other.Sent":    {"", "other.Sent"},
+	} {
+		if parent, name := jmapParent(folder, known); parent != expected[0] || name != expected[1] {
+			t.Errorf("%s: expected %v, got %s %s", folder, expected, parent, name)
+		}
+	}
+}
+
+func TestJMAPState(t *testing.T) {
+	c := &jmapContext{h: &httpHandler{cache: &caches{epoch: 1000}}}
+	state := c.formatState(42)
+	if id, err := c.parseState(state); err != nil || id != 42 {
+		t.Errorf("%s: expected 42, got %d %v", state, id, err)
+	}
+	restarted := &jmapContext{h: &httpHandler{cache: &caches{epoch: 2000}}}
+	for _, s := range []string{state, "42", "rs-x", ""} {
+		if _, err := restarted.parseState(s); err != errJMAPState {
+			t.Errorf("%q: expected an unknown state, got %v", s, err)
+		}
+	}
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"net/mail"
 	"os"
 	"strings"
+	"sync"
 )
 
 type keyType int
@@ -16,8 +19,73 @@ const (
 	keyTypeAny
 )
 
+var errInvalidKeyType = errors.New("Invalid key type: use normal, addr or part")
+
+// Names of key types in the configuration file
+var keyTypeNames = map[string]keyType{
+	"normal": keyTypeNormal,
+	"addr":   keyTypeAddr,
+	"part":   keyTypePart,
+}
+
+func parseKeyType(s string) (keyType, error) {
+	kt, found := keyTypeNames[strings.ToLower(s)]
+	if !found {
+		return kt, errInvalidKeyType
+	}
+	return kt, nil
+}
+
+func (kt keyType) String() string {
+	for name, t := range keyTypeNames {
+		if t == kt {
+			return name
+		}
+	}
+	return "any"
+}
+
+// URL path segments that cannot be used as the name of a key
+var reservedKeys = map[string]bool{
+	"admin":       true,
+	"help":        true,
+	"mailboxes":   true,
+	"msg":         true,
+	"mbox":        true,
+	"metrics":     true,
+	"latest":      true,
+	"oldest":      true,
+	"wait":        true,
+	"messages":    true,
+	"events":      true,
+	"search":      true,
+	"query":       true,
+	"threads":     true,
+	"jmap":        true,
+	".well-known": true,
+}
+
+// Check that a header name can be indexed and used in URLs
+func validKey(key string) error {
+	if key == "" {
+		return errors.New("Empty header name")
+	}
+	for _, c := range key {
+		if c <= ' ' || c > '~' || c == ':' || c == '/' {
+			return fmt.Errorf("%s: invalid header name", key)
+		}
+	}
+	if reservedKeys[strings.ToLower(key)] {
+		return fmt.Errorf("%s: header name is reserved", key)
+	}
+	return nil
+}
+
 type indexKey map[string]keyType
 
+// Messages are indexed by their Maildir flags under this key
+const flagKey = "flag"
+
 func makeIndexKeys() indexKey {
 	return make(map[string]keyType)
 }
@@ -45,31 +113,101 @@ func (i indexKey) keyType(key string) keyType {
 	return k
 }
 
+func (i indexKey) copy() indexKey {
+	keys := makeIndexKeys()
+	for k, kt := range i {
+		keys[k] = kt
+	}
+	return keys
+}
+
+// Keys of i that are not in other or have another type there
+func (i indexKey) diff(other indexKey) indexKey {
+	keys := makeIndexKeys()
+	for k, kt := range i {
+		if okt, found := other[k]; !found || okt != kt {
+			keys[k] = kt
+		}
+	}
+	return keys
+}
+
 type mailIndexer struct {
-	keys indexKey
+	mu      sync.RWMutex
+	indexed indexKey // Never modified, replaced by setKeys
+	body    bool     // Index words in the body of messages
 }
 
 func newMailIndexer(keys indexKey) *mailIndexer {
 	return &mailIndexer{
-		keys: keys,
+		indexed: keys,
 	}
 }
 
-func (m *mailIndexer) parse(filename string) (*mail.Message, error) {
+// Keys currently indexed. The result must not be modified.
+func (m *mailIndexer) keys() indexKey {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.indexed
+}
+
+// Replace the indexed keys, returning the ones that were added
+// (or changed type) and the ones to remove.
+func (m *mailIndexer) setKeys(keys indexKey) (indexKey, indexKey) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	added, removed := keys.diff(m.indexed), m.indexed.diff(keys)
+	m.indexed = keys
+	return added, removed
+}
+
+// Parse the headers of a message and, if enabled, the words in its body.
+// The body of the returned message cannot be read anymore.
+func (m *mailIndexer) parse(filename string) (*mail.Message, []string, error) {
 	reader, err := os.Open(filename)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer reader.Close()
 
-	return mail.ReadMessage(reader)
+	msg, err := mail.ReadMessage(reader)
+	if err != nil || !m.body {
+		return msg, nil, err
+	}
+	tokens, err := bodyTokens(msg)
+	return msg, tokens, err
 }
 
 func (m *mailIndexer) cacheEntries(file mailFile, msg *mail.Message) []cacheEntry {
+	return m.keys().cacheEntries(file, msg)
+}
+
+// Parse only the headers of a message
+func (m *mailIndexer) parseHeader(filename string) (*mail.Message, error) {
+	reader, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return mail.ReadMessage(reader)
+}
+
+func (i indexKey) cacheEntries(file mailFile, msg *mail.Message) []cacheEntry {
 	entries := make([]cacheEntry, 0)
 	headers := ciHeader(msg.Header)
 
-	for key, kt := range m.keys {
+	for key, kt := range i {
+		if key == flagKey {
+			for _, f := range file.flags() {
+				entries = append(entries, cacheEntry{
+					name:  key,
+					key:   f,
+					value: file,
+				})
+			}
+			continue
+		}
+
 		headerKey, val := headers.get(key)
 
 		switch kt {
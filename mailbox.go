@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var errInvalidMailbox = errors.New("Invalid mailbox name")
+
+// A Maildir passed on the command line, with the name used in URLs.
+// Folders inside it (Maildir++ ".Folder" or plain subdirectories)
+// are mailboxes called "name.Folder".
+type mailboxRoot struct {
+	name string
+	path string
+}
+
+type mailboxes []*mailboxRoot
+
+// Parse "name=path" or just "path"; in the latter case the name
+// is the name of the directory.
+func parseMailboxRoot(arg string) (*mailboxRoot, error) {
+	name, path := "", arg
+	if i := strings.IndexByte(arg, '='); i >= 0 {
+		name, path = arg[:i], arg[i+1:]
+	}
+	if path == "" {
+		return nil, fmt.Errorf("%s: empty path", arg)
+	}
+	// Files are found under the absolute path, even for "."
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		name = strings.TrimLeft(filepath.Base(abs), ".")
+	}
+	if name == "" || strings.ContainsAny(name, "/=") {
+		return nil, errInvalidMailbox
+	}
+	return &mailboxRoot{name: name, path: abs}, nil
+}
+
+func (ms *mailboxes) add(arg string) error {
+	mr, err := parseMailboxRoot(arg)
+	if err != nil {
+		return err
+	}
+	for _, m := range *ms {
+		if m.name == mr.name {
+			return fmt.Errorf("%s: mailbox name %s already used", arg, mr.name)
+		}
+	}
+	*ms = append(*ms, mr)
+	return nil
+}
+
+func (ms mailboxes) paths() []string {
+	paths := make([]string, len(ms))
+	for i, m := range ms {
+		paths[i] = m.path
+	}
+	return paths
+}
+
+func (ms mailboxes) names() []string {
+	names := make([]string, len(ms))
+	for i, m := range ms {
+		names[i] = m.name
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Name of the mailbox of a message, from the directory containing cur/ and new/
+func (ms mailboxes) name(dir string) string {
+	dir = filepath.Clean(dir)
+
+	var root *mailboxRoot
+	for _, m := range ms {
+		if dir != m.path && !strings.HasPrefix(dir, m.path+string(filepath.Separator)) {
+			continue
+		}
+		// Use the innermost root if they are nested
+		if root == nil || len(m.path) > len(root.path) {
+			root = m
+		}
+	}
+	if root == nil {
+		return ""
+	}
+
+	rel, err := filepath.Rel(root.path, dir)
+	if err != nil || rel == "." {
+		return root.name
+	}
+	name := root.name
+	for _, part := range strings.Split(filepath.ToSlash(rel), "/") {
+		if part = strings.TrimLeft(part, "."); part != "" {
+			name = name + "." + part
+		}
+	}
+	return name
+}
+
+// Directory of the Maildir of a mailbox. Folders follow the Maildir++
+// convention: mailbox "name.Sent" is in the ".Sent" folder of root "name".
+func (ms mailboxes) dir(name string) (string, error) {
+	var root *mailboxRoot
+	for _, m := range ms {
+		if name != m.name && !strings.HasPrefix(name, m.name+".") {
+			continue
+		}
+		if root == nil || len(m.name) > len(root.name) {
+			root = m
+		}
+	}
+	if root == nil {
+		return "", errNotFound
+	}
+	if name == root.name {
+		return root.path, nil
+	}
+
+	folder := strings.TrimPrefix(name, root.name)
+	if strings.ContainsAny(folder, "/\\") || strings.Contains(folder, "..") {
+		return "", errInvalidMailbox
+	}
+	return filepath.Join(root.path, folder), nil
+}
+
+// Whether the mailbox exists on disk
+func (ms mailboxes) exists(name string) bool {
+	dir, err := ms.dir(name)
+	if err != nil {
+		return false
+	}
+	info, err := os.Stat(filepath.Join(dir, "cur"))
+	return err == nil && info.IsDir()
+}
+
+// Paths of ms that are not in other
+func (ms mailboxes) diff(other mailboxes) []string {
+	paths := make([]string, 0)
+	for _, m := range ms {
+		found := false
+		for _, o := range other {
+			if o.path == m.path {
+				found = true
+				break
+			}
+		}
+		if !found {
+			paths = append(paths, m.path)
+		}
+	}
+	return paths
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var maildirDeliveries uint64
+
+var maildirHostname = func() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "localhost"
+	}
+	// Characters that cannot appear in unique names (see maildir(5))
+	host = strings.Replace(host, "/", `\057`, -1)
+	return strings.Replace(host, ":", `\072`, -1)
+}()
+
+// Unique name for a new message, as described in http://cr.yp.to/proto/maildir.html
+func maildirUniqueName() string {
+	now := time.Now()
+	n := atomic.AddUint64(&maildirDeliveries, 1)
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), n, maildirHostname)
+}
+
+// Create the standard Maildir subdirectories if missing
+func maildirMake(dir string) error {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Deliver the message read from r in the Maildir dir. The message is first
+// completely written in tmp/ and then moved to new/, where it appears at once.
+// Returns the name of the delivered file.
+func maildirDeliver(dir string, r io.Reader) (string, error) {
+	tmp, err := maildirWrite(dir, r)
+	if err != nil {
+		return "", err
+	}
+	return maildirPublish(tmp)
+}
+
+// Write the message read from r in tmp/ of the Maildir dir, where readers
+// of the Maildir ignore it. Returns the name of the file in tmp/.
+func maildirWrite(dir string, r io.Reader) (string, error) {
+	if err := maildirMake(dir); err != nil {
+		return "", err
+	}
+
+	tmp := filepath.Join(dir, "tmp", maildirUniqueName())
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return tmp, nil
+}
+
+// Move a message written by maildirWrite to new/. Returns the name of the
+// delivered file.
+func maildirPublish(tmp string) (string, error) {
+	dest := filepath.Join(filepath.Dir(filepath.Dir(tmp)), "new", filepath.Base(tmp))
+	if err := os.Rename(tmp, dest); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return dest, nil
+}
+
+// Whether name looks like it was given by a Maildir delivery ("time.id.host")
+func isMaildirName(name string) bool {
+	parts := strings.SplitN(maildirUnique(name), ".", 3)
+	if len(parts) < 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return false
+	}
+	for _, c := range parts[0] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Stable identifier of a message: the unique part of its file name or, for
+// files not named by a Maildir delivery, a hash of its Message-ID or content.
+func messageUID(file mailFile, h mail.Header) string {
+	if isMaildirName(filepath.Base(file.file)) {
+		return file.unique()
+	}
+	hash := sha1.New()
+	if ids := parseMessageIDs(h.Get("Message-Id")); len(ids) > 0 {
+		io.WriteString(hash, ids[0])
+	} else if f, err := os.Open(file.filename()); err == nil {
+		io.Copy(hash, f)
+		f.Close()
+	} else {
+		return file.unique()
+	}
+	return hex.EncodeToString(hash.Sum(nil)[:10])
+}
+
+// Copy a message to the path to in another Maildir. The copy is written in
+// tmp/ first, so that it appears complete at once. Fails if to exists.
+func maildirCopy(from, to string) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := filepath.Join(filepath.Dir(filepath.Dir(to)), "tmp", maildirUniqueName())
+	dst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		// Unlike rename, link does not replace an existing file
+		err = os.Link(tmp, to)
+	}
+	os.Remove(tmp)
+	return err
+}
+
+// Tests replace it to fail as between two file systems
+var maildirLink = os.Link
+
+// Move a message to the path to in another Maildir, possibly on another
+// file system. Fails if to exists.
+func maildirMove(from, to string) error {
+	err := maildirLink(from, to)
+	if os.IsExist(err) {
+		return err
+	}
+	if err != nil {
+		// Another file system, or no hard links
+		if err := maildirCopy(from, to); err != nil {
+			return err
+		}
+	}
+	return os.Remove(from)
+}
+
+// Unique part of a Maildir file name, before the info (":2,FLAGS")
+func maildirUnique(name string) string {
+	if i := strings.IndexByte(name, ':'); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// Unique part of the file name of the message
+func (m mailFile) unique() string {
+	return maildirUnique(filepath.Base(m.file))
+}
+
+// Letters of the flags in the Maildir file name
+func (m mailFile) info() string {
+	i := strings.LastIndex(m.file, ":2,")
+	if i < 0 {
+		return ""
+	}
+	return m.file[i+3:]
+}
+
+// Letter of a flag by name, like "seen"
+func maildirFlag(name string) (byte, bool) {
+	for f, n := range maildirFlags {
+		if n == name {
+			return f, true
+		}
+	}
+	return 0, false
+}
+
+// Path of the message with different flags. Messages with flags are in cur/.
+func (m mailFile) withInfo(info string) string {
+	letters := []byte(info)
+	sort.Slice(letters, func(i, j int) bool { return letters[i] < letters[j] })
+	return filepath.Join(m.mailbox, "cur", m.unique()+":2,"+string(letters))
+}
+
+// Only the messages without the seen flag
+func (ms mailFiles) unread() mailFiles {
+	r := newMailFiles()
+	for _, m := range ms {
+		if strings.IndexByte(m.info(), 'S') < 0 {
+			r = append(r, m)
+		}
+	}
+	return r
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestMailFileWithInfo(t *testing.T) {
+	tests := []struct {
+		path, info, expected string
+	}{
+		{"/mail/new/1.host", "S", "/mail/cur/1.host:2,S"},
+		{"/mail/cur/1.host:2,S", "", "/mail/cur/1.host:2,"},
+		{"/mail/cur/1.host:2,FS", "SRF", "/mail/cur/1.host:2,FRS"},
+		{"/mail/cur/1.host:2,S", "S", "/mail/cur/1.host:2,S"},
+		{"cur/1.host:2,S", "Sa", "cur/1.host:2,Sa"},
+	}
+	for _, test := range tests {
+		file, err := makeMailFile(test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if path := file.withInfo(test.info); path != test.expected {
+			t.Errorf("%s with %q: expected %s, got %s", test.path, test.info, test.expected, path)
+		}
+	}
+}
+
+func TestMaildirMove(t *testing.T) {
+	src := testMaildir(t, map[string]string{
+		"cur/1.host:2,S": "Subject: one\n\nbody\n",
+		"cur/2.host:2,S": "Subject: two\n\nbody\n",
+	})
+	defer os.RemoveAll(src)
+	dst := testMaildir(t, map[string]string{
+		"cur/2.host:2,S": "Subject: other\n\nbody\n",
+	})
+	defer os.RemoveAll(dst)
+
+	// Copied then removed when it cannot be linked
+	maildirLink = func(from, to string) error {
+		return &os.LinkError{Op: "link", Old: from, New: to, Err: syscall.EXDEV}
+	}
+	defer func() { maildirLink = os.Link }()
+
+	from, to := filepath.Join(src, "cur", "1.host:2,S"), filepath.Join(dst, "cur", "1.host:2,S")
+	if err := maildirMove(from, to); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(to); err != nil || string(data) != "Subject: one\n\nbody\n" {
+		t.Errorf("message not copied: %q %v", data, err)
+	}
+	if _, err := os.Stat(from); !os.IsNotExist(err) {
+		t.Error("message not removed ", err)
+	}
+
+	// Never replaces a message
+	from, to = filepath.Join(src, "cur", "2.host:2,S"), filepath.Join(dst, "cur", "2.host:2,S")
+	if err := maildirMove(from, to); !os.IsExist(err) {
+		t.Error("expected an existing message, got ", err)
+	}
+	if data, err := ioutil.ReadFile(to); err != nil || string(data) != "Subject: other\n\nbody\n" {
+		t.Errorf("message replaced: %q %v", data, err)
+	}
+	if _, err := os.Stat(from); err != nil {
+		t.Error("message removed ", err)
+	}
+	if tmp, _ := filepath.Glob(filepath.Join(dst, "tmp", "*")); len(tmp) != 0 {
+		t.Error("files left in tmp/ ", tmp)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+)
+
+// Whether data is in mbox format, starting with a "From " separator line.
+// An RFC 822 message cannot start like that, as header names end with a colon.
+func isMbox(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("From "))
+}
+
+// Split an mbox into its messages, removing the "From " separator lines.
+// Lines quoted as ">From " (mboxrd) are unquoted.
+func splitMbox(data []byte) [][]byte {
+	msgs := make([][]byte, 0)
+
+	var msg []byte
+	for len(data) > 0 {
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line = data[:i+1]
+		}
+		data = data[len(line):]
+
+		if bytes.HasPrefix(line, []byte("From ")) {
+			if msg != nil {
+				msgs = append(msgs, trimMboxMessage(msg))
+			}
+			msg = make([]byte, 0)
+			continue
+		}
+		if msg == nil {
+			// Garbage before the first separator
+			continue
+		}
+
+		unquoted := bytes.TrimLeft(line, ">")
+		if len(unquoted) < len(line) && bytes.HasPrefix(unquoted, []byte("From ")) {
+			line = line[1:]
+		}
+		msg = append(msg, line...)
+	}
+	if msg != nil {
+		msgs = append(msgs, trimMboxMessage(msg))
+	}
+	return msgs
+}
+
+// Remove the empty line that separates a message from the next "From " line
+func trimMboxMessage(msg []byte) []byte {
+	for _, nl := range []string{"\r\n", "\n"} {
+		if bytes.HasSuffix(msg, []byte(nl+nl)) {
+			return msg[:len(msg)-len(nl)]
+		}
+	}
+	return msg
+}
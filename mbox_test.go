@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSplitMbox(t *testing.T) {
+	data := "From a@x Mon Jul 17 10:00:00 2017\nSubject: one\n\n>From here\n>>From there\n\n" +
+		"From b@x Mon Jul 17 11:00:00 2017\nSubject: two\n\nbye\n"
+	if !isMbox([]byte(data)) {
+		t.Fatal("not detected as mbox")
+	}
+	msgs := splitMbox([]byte(data))
+	want := []string{
+		"Subject: one\n\nFrom here\n>From there\n",
+		"Subject: two\n\nbye\n",
+	}
+	if len(msgs) != len(want) {
+		t.Fatalf("got %d messages, want %d", len(msgs), len(want))
+	}
+	for i := range want {
+		if string(msgs[i]) != want[i] {
+			t.Errorf("message %d: got %q, want %q", i, msgs[i], want[i])
+		}
+	}
+	if isMbox([]byte("From: a@x\n\nhello\n")) {
+		t.Error("RFC 822 message detected as mbox")
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"sort"
+	"time"
+)
+
+// Headers that are always parsed as lists of addresses in JSON output
+var addressHeaders = []string{"from", "to", "cc", "bcc", "reply-to", "sender"}
+
+type jsonAddress struct {
+	Name    string `json:"name,omitempty"`
+	Address string `json:"address"`
+}
+
+type jsonPart struct {
+	Path        string            `json:"path"`
+	ContentType string            `json:"content_type"`
+	Params      map[string]string `json:"params,omitempty"`
+	Disposition string            `json:"disposition,omitempty"`
+	Filename    string            `json:"filename,omitempty"`
+	Encoding    string            `json:"encoding,omitempty"`
+	Size        int64             `json:"size"`
+	Parts       []*jsonPart       `json:"parts,omitempty"`
+}
+
+func makeJSONPart(p *mimePart) *jsonPart {
+	jp := &jsonPart{
+		Path:        p.path,
+		ContentType: p.contentType,
+		Disposition: p.disposition,
+		Filename:    p.filename,
+		Encoding:    p.encoding,
+		Size:        p.size,
+	}
+	if len(p.params) > 0 {
+		jp.Params = p.params
+	}
+	for _, c := range p.parts {
+		jp.Parts = append(jp.Parts, makeJSONPart(c))
+	}
+	return jp
+}
+
+type jsonMessage struct {
+	ID        string                    `json:"id"`
+	Mailbox   string                    `json:"mailbox"`
+	File      string                    `json:"file"`
+	Size      int64                     `json:"size"`
+	Date      time.Time                 `json:"date"`
+	Flags     []string                  `json:"flags"`
+	Thread    string                    `json:"thread,omitempty"`
+	Headers   map[string][]string       `json:"headers"`
+	Addresses map[string][]*jsonAddress `json:"addresses"`
+	Parts     *jsonPart                 `json:"parts"`
+}
+
+func newJSONMessage(m mailFile, keys indexKey) (*jsonMessage, error) {
+	r, err := os.Open(m.filename())
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	info, err := r.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+
+	jm := &jsonMessage{
+		ID:        m.id(),
+		Mailbox:   m.folder,
+		File:      m.file,
+		Size:      info.Size(),
+		Date:      m.date,
+		Flags:     m.flags(),
+		Headers:   make(map[string][]string),
+		Addresses: make(map[string][]*jsonAddress),
+	}
+
+	for k, vals := range msg.Header {
+		decoded := make([]string, len(vals))
+		for i := range vals {
+			decoded[i] = decodeHeader(vals[i])
+		}
+		jm.Headers[k] = decoded
+	}
+
+	headers := ciHeader(msg.Header)
+	addrKeys := make([]string, len(addressHeaders))
+	copy(addrKeys, addressHeaders)
+	for k, kt := range keys {
+		if kt == keyTypeAddr {
+			addrKeys = append(addrKeys, k)
+		}
+	}
+	for _, k := range addrKeys {
+		headerKey, val := headers.get(k)
+		if val == nil {
+			continue
+		}
+		addresses, err := headers.AddressList(headerKey)
+		if err != nil {
+			log.Print(m, ": error parsing header ", headerKey, ": ", err)
+			continue
+		}
+		list := make([]*jsonAddress, 0, len(addresses))
+		for _, a := range addresses {
+			list = append(list, &jsonAddress{Name: a.Name, Address: a.Address})
+		}
+		jm.Addresses[k] = list
+	}
+
+	root, err := parseMIME(textproto.MIMEHeader(msg.Header), msg.Body, nil)
+	if err != nil {
+		log.Print(m, ": error parsing MIME structure: ", err)
+	}
+	jm.Parts = makeJSONPart(root)
+
+	return jm, nil
+}
+
+// Identifier of the message, that does not change when its file is renamed
+// because flags are set or cleared. See messageUID.
+func (m mailFile) id() string {
+	if m.uid != "" {
+		return m.uid
+	}
+	return m.unique()
+}
+
+var maildirFlags = map[byte]string{
+	'D': "draft",
+	'F': "flagged",
+	'P': "passed",
+	'R': "replied",
+	'S': "seen",
+	'T': "trashed",
+}
+
+// Flags from the info part of the Maildir file name (":2,FLAGS")
+func (m mailFile) flags() []string {
+	flags := make([]string, 0)
+	for _, f := range []byte(m.info()) {
+		if name, found := maildirFlags[f]; found {
+			flags = append(flags, name)
+		}
+	}
+	sort.Strings(flags)
+	return flags
+}
+
+// Indented JSON, with characters like "<" in addresses left as they are
+func newJSONEncoder(w io.Writer) *json.Encoder {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	return enc
+}
+
+// Write one message as JSON, not in a list
+func (m mailFile) writeJSON(w io.Writer, keys indexKey, thread string) error {
+	jm, err := newJSONMessage(m, keys)
+	if err != nil {
+		return err
+	}
+	jm.Thread = thread
+	return newJSONEncoder(w).Encode(jm)
+}
+
+// Write messages as JSON; threads has the thread of each message, if known
+func (ms mailFiles) writeJSON(w io.Writer, keys indexKey, threads []threadSummary) error {
+	msgs := make([]*jsonMessage, 0, len(ms))
+	for i, m := range ms {
+		jm, err := newJSONMessage(m, keys)
+		if err != nil {
+			log.Print("could not read ", m, ": ", err)
+			continue
+		}
+		if i < len(threads) {
+			jm.Thread = threads[i].ID
+		}
+		msgs = append(msgs, jm)
+	}
+	return newJSONEncoder(w).Encode(msgs)
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Counters and histograms exported on /metrics in the Prometheus text format
+var metrics = newMetricsRegistry()
+
+// Upper bounds of histogram buckets, in seconds
+var metricsBuckets = []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5, 10, 60}
+
+type histogram struct {
+	counts []uint64 // By bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func newHistogram() *histogram {
+	return &histogram{
+		counts: make([]uint64, len(metricsBuckets)),
+	}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	v := d.Seconds()
+	for i, le := range metricsBuckets {
+		if v <= le {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// Write the series of h; labels are already formatted, like `route="/help",`
+func (h *histogram) writeTo(w io.Writer, name, labels string) {
+	var cumulative uint64
+	for i, le := range metricsBuckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{%sle=\"%g\"} %d\n", name, labels, le, cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, labels, h.count)
+	labels = strings.TrimSuffix(labels, ",")
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %g\n", name, labels, h.sum)
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count)
+}
+
+type httpRequestKey struct {
+	route  string
+	method string
+	code   int
+}
+
+type metricsRegistry struct {
+	mu            sync.Mutex
+	crawlDuration *histogram
+	crawlFiles    int // In the last scan
+	parseErrors   uint64
+	notifyEvents  map[string]uint64 // By operation
+	cacheWait     map[string]*histogram
+	httpRequests  map[httpRequestKey]uint64
+	httpDuration  map[string]*histogram // By route
+	deletes       uint64
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		crawlDuration: newHistogram(),
+		notifyEvents:  make(map[string]uint64),
+		cacheWait:     make(map[string]*histogram),
+		httpRequests:  make(map[httpRequestKey]uint64),
+		httpDuration:  make(map[string]*histogram),
+	}
+}
+
+func (m *metricsRegistry) crawled(files int, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.crawlFiles = files
+	m.crawlDuration.observe(d)
+}
+
+func (m *metricsRegistry) parseError() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.parseErrors++
+}
+
+func (m *metricsRegistry) notified(op string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.notifyEvents[op]++
+}
+
+func (m *metricsRegistry) deleted(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deletes += uint64(n)
+}
+
+// Run send, a send to a channel of the caches, and record how long it
+// waited for the caches goroutine to receive it.
+func (m *metricsRegistry) cacheSend(channel string, send func()) {
+	start := time.Now()
+	send()
+	d := time.Since(start)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, found := m.cacheWait[channel]
+	if !found {
+		h = newHistogram()
+		m.cacheWait[channel] = h
+	}
+	h.observe(d)
+}
+
+func (m *metricsRegistry) request(route, method string, code int, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.httpRequests[httpRequestKey{route, method, code}]++
+	h, found := m.httpDuration[route]
+	if !found {
+		h = newHistogram()
+		m.httpDuration[route] = h
+	}
+	h.observe(d)
+}
+
+var metricsEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func metricsLabel(name, value string) string {
+	return fmt.Sprintf(`%s="%s"`, name, metricsEscaper.Replace(value))
+}
+
+func writeMetricsHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (m *metricsRegistry) writeTo(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	writeMetricsHeader(w, "perso_crawl_duration_seconds", "histogram", "Duration of full scans of the mailboxes.")
+	m.crawlDuration.writeTo(w, "perso_crawl_duration_seconds", "")
+	writeMetricsHeader(w, "perso_crawl_files", "gauge", "Files found by the last scan.")
+	fmt.Fprintf(w, "perso_crawl_files %d\n", m.crawlFiles)
+	writeMetricsHeader(w, "perso_parse_errors_total", "counter", "Messages that could not be parsed, fully or in part.")
+	fmt.Fprintf(w, "perso_parse_errors_total %d\n", m.parseErrors)
+	writeMetricsHeader(w, "perso_deleted_messages_total", "counter", "Messages deleted via HTTP or by the retention limits.")
+	fmt.Fprintf(w, "perso_deleted_messages_total %d\n", m.deletes)
+
+	writeMetricsHeader(w, "perso_fsnotify_events_total", "counter", "Filesystem events received, by operation.")
+	for _, op := range sortedKeys(m.notifyEvents) {
+		fmt.Fprintf(w, "perso_fsnotify_events_total{%s} %d\n", metricsLabel("op", op), m.notifyEvents[op])
+	}
+
+	writeMetricsHeader(w, "perso_cache_wait_seconds", "histogram", "Time waited to hand a request to the caches, by channel.")
+	channels := make([]string, 0, len(m.cacheWait))
+	for ch := range m.cacheWait {
+		channels = append(channels, ch)
+	}
+	sort.Strings(channels)
+	for _, ch := range channels {
+		m.cacheWait[ch].writeTo(w, "perso_cache_wait_seconds", metricsLabel("channel", ch)+",")
+	}
+
+	writeMetricsHeader(w, "perso_http_requests_total", "counter", "HTTP requests, by route, method and status code.")
+	keys := make([]httpRequestKey, 0, len(m.httpRequests))
+	for k := range m.httpRequests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route != keys[j].route {
+			return keys[i].route < keys[j].route
+		}
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].code < keys[j].code
+	})
+	for _, k := range keys {
+		fmt.Fprintf(w, "perso_http_requests_total{%s,%s,code=\"%d\"} %d\n",
+			metricsLabel("route", k.route), metricsLabel("method", k.method), k.code, m.httpRequests[k])
+	}
+
+	writeMetricsHeader(w, "perso_http_request_duration_seconds", "histogram", "Duration of HTTP requests, by route.")
+	routes := make([]string, 0, len(m.httpDuration))
+	for route := range m.httpDuration {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	for _, route := range routes {
+		m.httpDuration[route].writeTo(w, "perso_http_request_duration_seconds", metricsLabel("route", route)+",")
+	}
+}
+
+// Status code of a response, for the metrics
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Allow http.ResponseController to flush event streams
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (h *httpHandler) metrics() func(w http.ResponseWriter, r *http.Request) {
+	return h.handler(func(h *httpHandler, w http.ResponseWriter, r *http.Request) error {
+		if r.Method != "GET" {
+			http.Error(w, "Method not supported", 405)
+			return nil
+		}
+
+		mr := newCacheMailboxesRequest()
+		metrics.cacheSend("mailboxes", func() { h.cache.mboxCh <- mr })
+		counts := <-mr.data
+
+		sr := newCacheStatsRequest()
+		metrics.cacheSend("stats", func() { h.cache.statsCh <- sr })
+		stats := <-sr.data
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetricsHeader(w, "perso_messages", "gauge", "Indexed messages, by mailbox.")
+		names := make([]string, 0, len(counts))
+		for name := range counts {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(w, "perso_messages{%s} %d\n", metricsLabel("mailbox", name), counts[name])
+		}
+
+		keys := make([]string, 0, len(stats))
+		for key := range stats {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		writeMetricsHeader(w, "perso_key_messages", "gauge", "Messages with at least one value of an indexed key, by key.")
+		for _, key := range keys {
+			fmt.Fprintf(w, "perso_key_messages{%s} %d\n", metricsLabel("key", key), stats[key].messages)
+		}
+		writeMetricsHeader(w, "perso_key_values", "gauge", "Distinct values of an indexed key, by key.")
+		for _, key := range keys {
+			fmt.Fprintf(w, "perso_key_values{%s} %d\n", metricsLabel("key", key), stats[key].values)
+		}
+
+		metrics.writeTo(w)
+		return nil
+	})
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram()
+	h.observe(200 * time.Microsecond)
+	h.observe(2 * time.Second)
+	h.observe(2 * time.Minute)
+
+	var b bytes.Buffer
+	h.writeTo(&b, "test_seconds", metricsLabel("route", `/a"b`)+",")
+	out := b.String()
+	for _, line := range []string{
+		`test_seconds_bucket{route="/a\"b",le="0.0001"} 0`,
+		`test_seconds_bucket{route="/a\"b",le="0.0005"} 1`,
+		`test_seconds_bucket{route="/a\"b",le="5"} 2`,
+		`test_seconds_bucket{route="/a\"b",le="60"} 2`,
+		`test_seconds_bucket{route="/a\"b",le="+Inf"} 3`,
+		`test_seconds_count{route="/a\"b"} 3`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, out)
+		}
+	}
+
+	b.Reset()
+	newHistogram().writeTo(&b, "empty", "")
+	if !strings.Contains(b.String(), "empty_count 0\n") {
+		t.Errorf("unexpected output without labels:\n%s", b.String())
+	}
+}
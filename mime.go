@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var errPartFound = errors.New("Part found")
+
+// A node in the MIME structure of a message. Leaf parts have
+// no children; multipart/* parts only have children.
+type mimePart struct {
+	path        string
+	header      textproto.MIMEHeader
+	contentType string
+	params      map[string]string
+	disposition string
+	filename    string
+	encoding    string
+	size        int64
+	parts       []*mimePart
+}
+
+func newMimePart(path string, header textproto.MIMEHeader) *mimePart {
+	p := &mimePart{
+		path:   path,
+		header: header,
+		params: make(map[string]string),
+	}
+
+	ct := header.Get("Content-Type")
+	if ct == "" {
+		ct = "text/plain; charset=us-ascii"
+	}
+	mt, params, err := mime.ParseMediaType(ct)
+	if err != nil {
+		// Unparsable types are treated as plain text (RFC 2045, 5.2)
+		mt = "text/plain"
+	}
+	p.contentType = mt
+	for k, v := range params {
+		p.params[k] = v
+	}
+
+	if cd := header.Get("Content-Disposition"); cd != "" {
+		if disp, dparams, err := mime.ParseMediaType(cd); err == nil {
+			p.disposition = disp
+			p.filename = dparams["filename"]
+		}
+	}
+	if p.filename == "" {
+		p.filename = p.params["name"]
+	}
+	p.filename = decodeHeader(p.filename)
+	p.encoding = strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding")))
+
+	return p
+}
+
+func (p *mimePart) isMultipart() bool {
+	return strings.HasPrefix(p.contentType, "multipart/") && p.params["boundary"] != ""
+}
+
+// Path of the n-th (starting from one) child of this part.
+func (p *mimePart) childPath(n int) string {
+	if p.path == "" {
+		return strconv.Itoa(n)
+	}
+	return p.path + "." + strconv.Itoa(n)
+}
+
+// Walk the body r of the part, filling the tree of subparts. The function
+// fn, if not nil, is called with the reader of each leaf part.
+func (p *mimePart) walk(r io.Reader, fn func(p *mimePart, r io.Reader) error) error {
+	if !p.isMultipart() {
+		cr := &countingReader{r: r}
+		if fn != nil {
+			if err := fn(p, cr); err != nil {
+				return err
+			}
+		}
+		// Consume whatever was not read to know the size
+		_, err := io.Copy(ioutil.Discard, cr)
+		p.size = cr.n
+		return err
+	}
+
+	mr := multipart.NewReader(r, p.params["boundary"])
+	for n := 1; ; n++ {
+		part, err := mr.NextRawPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		child := newMimePart(p.childPath(n), part.Header)
+		p.parts = append(p.parts, child)
+		if err := child.walk(part, fn); err != nil {
+			return err
+		}
+	}
+}
+
+// Parse the MIME structure of a message with header h and body r.
+// A single part message has only one part, with path "1"; the root
+// of a multipart message has an empty path.
+func parseMIME(h textproto.MIMEHeader, r io.Reader, fn func(p *mimePart, r io.Reader) error) (*mimePart, error) {
+	root := newMimePart("", h)
+	if !root.isMultipart() {
+		root.path = "1"
+	}
+	return root, root.walk(r, fn)
+}
+
+// Reader of the body of this part with the transfer encoding undone.
+func (p *mimePart) decode(r io.Reader) io.Reader {
+	switch p.encoding {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	}
+	return r
+}
+
+// Header value to use when serving this part as a standalone file: the
+// type as parsed, so that unparsable types are served as plain text.
+func (p *mimePart) mediaType() string {
+	if ct := mime.FormatMediaType(p.contentType, p.params); ct != "" {
+		return ct
+	}
+	return p.contentType
+}
+
+// Content-Disposition to use when serving this part, if any. Only plain
+// text is shown inline: other types, like HTML, could run script sent by
+// anyone on the origin of perso.
+func (p *mimePart) contentDisposition() string {
+	disp := p.disposition
+	if p.contentType != "text/plain" || disp != "inline" && (disp != "" || p.filename != "") {
+		disp = "attachment"
+	}
+	if disp == "" {
+		return ""
+	}
+	params := make(map[string]string)
+	if p.filename != "" {
+		params["filename"] = p.filename
+	}
+	if cd := mime.FormatMediaType(disp, params); cd != "" {
+		return cd
+	}
+	return disp
+}
+
+// Find the leaf part with the specified path inside file and
+// call fn with the decoded body of that part.
+func findPart(file, path string, fn func(p *mimePart, r io.Reader) error) error {
+	reader, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	msg, err := mail.ReadMessage(reader)
+	if err != nil {
+		return err
+	}
+
+	_, err = parseMIME(textproto.MIMEHeader(msg.Header), msg.Body, func(p *mimePart, r io.Reader) error {
+		if p.path != path {
+			return nil
+		}
+		if err := fn(p, p.decode(r)); err != nil {
+			return err
+		}
+		return errPartFound
+	})
+	switch err {
+	case errPartFound:
+		return nil
+	case nil:
+		return errNotFound
+	}
+	return err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
+
+var headerDecoder = &mime.WordDecoder{}
+
+// Decode RFC 2047 encoded-words, returning the value as-is on errors.
+func decodeHeader(s string) string {
+	d, err := headerDecoder.DecodeHeader(s)
+	if err != nil {
+		return s
+	}
+	return d
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+const testMultipart = `From: someone@example.com
+Content-Type: multipart/mixed; boundary="XX"
+
+--XX
+Content-Type: multipart/alternative; boundary="YY"
+
+--YY
+Content-Type: text/plain; charset=utf-8
+Content-Transfer-Encoding: quoted-printable
+
+f=C3=BCr
+--YY
+Content-Type: text/html
+
+<p>html</p>
+--YY--
+--XX
+Content-Type: text/csv; name="export.csv"
+Content-Transfer-Encoding: base64
+
+YSxiLGMK
+--XX--
+`
+
+func TestMIMEPaths(t *testing.T) {
+	msg, err := mail.ReadMessage(strings.NewReader(testMultipart))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bodies := make(map[string]string)
+	root, err := parseMIME(textproto.MIMEHeader(msg.Header), msg.Body, func(p *mimePart, r io.Reader) error {
+		data, err := ioutil.ReadAll(p.decode(r))
+		bodies[p.path] = string(data)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.path != "" || len(root.parts) != 2 {
+		t.Fatal("Unexpected root part ", root.path, len(root.parts))
+	}
+	if root.parts[0].parts[1].path != "1.2" {
+		t.Error("Unexpected path ", root.parts[0].parts[1].path)
+	}
+	if bodies["1.1"] != "für" {
+		t.Error("Unexpected quoted-printable body ", bodies["1.1"])
+	}
+	if bodies["2"] != "a,b,c\n" {
+		t.Error("Unexpected base64 body ", bodies["2"])
+	}
+	if root.parts[1].filename != "export.csv" {
+		t.Error("Unexpected filename ", root.parts[1].filename)
+	}
+}
+
+func TestMIMESinglePart(t *testing.T) {
+	msg, err := mail.ReadMessage(strings.NewReader("Subject: test\n\nbody\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := parseMIME(textproto.MIMEHeader(msg.Header), msg.Body, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.path != "1" || root.contentType != "text/plain" || root.size != 5 {
+		t.Error("Unexpected part ", root.path, root.contentType, root.size)
+	}
+}
+
+func TestMIMEContentDisposition(t *testing.T) {
+	for _, c := range []struct {
+		contentType, disposition, expected string
+	}{
+		{"", "", ""},
+		{"text/plain", "inline", "inline"},
+		{"text/plain", "attachment; filename=a.txt", "attachment; filename=a.txt"},
+		{"text/plain", "", ""},
+		{"text/html", "", "attachment"},
+		{"text/html", "inline", "attachment"},
+		{"image/svg+xml", "inline; filename=a.svg", "attachment; filename=a.svg"},
+		{"text/html; charset", "", ""},
+	} {
+		header := make(textproto.MIMEHeader)
+		if c.contentType != "" {
+			header.Set("Content-Type", c.contentType)
+		}
+		if c.disposition != "" {
+			header.Set("Content-Disposition", c.disposition)
+		}
+		p := newMimePart("1", header)
+		if cd := p.contentDisposition(); cd != c.expected {
+			t.Errorf("%s, %s: expected %q, got %q", c.contentType, c.disposition, c.expected, cd)
+		}
+	}
+	p := newMimePart("1", textproto.MIMEHeader{"Content-Type": {"text/html; charset"}})
+	if mt := p.mediaType(); mt != "text/plain" {
+		t.Error("Unparsable type served as ", mt)
+	}
+}
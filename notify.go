@@ -9,10 +9,17 @@ func (e *event) handle(c *crawler) {
 
 type notify struct{}
 
-func newNotify(dir string) (*notify, error) {
+func newNotify(dirs ...string) (*notify, error) {
 	return nil, nil
 }
 
+func (n *notify) watch(dirs ...string) error {
+	return nil
+}
+
+func (n *notify) unwatch(dir string) {
+}
+
 func (i *notify) eventsChannel() chan *event {
 	return nil
 }
@@ -6,65 +6,153 @@ import (
 	fsnotify "gopkg.in/fsnotify.v1"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 )
 
 type event fsnotify.Event
 
+// Operations counted in the metrics
+var notifyOps = []struct {
+	op   fsnotify.Op
+	name string
+}{
+	{fsnotify.Create, "create"},
+	{fsnotify.Write, "write"},
+	{fsnotify.Remove, "remove"},
+	{fsnotify.Rename, "rename"},
+	{fsnotify.Chmod, "chmod"},
+}
+
 func (ev event) handle(c *crawler) {
+	for _, o := range notifyOps {
+		if ev.Op&o.op == o.op {
+			metrics.notified(o.name)
+		}
+	}
 	if ev.Name == "" {
 		return
 	}
 
-	info, err := os.Stat(ev.Name)
-	if err != nil || info.IsDir() {
-		return
+	// A file renamed in the same Maildir, for example when flags change, is
+	// created with its new name by the next event
+	if ev.Op&fsnotify.Create == fsnotify.Create {
+		if c.renameTo(ev.Name) {
+			return
+		}
+	} else {
+		c.renameTo("")
 	}
-
-	file, err := makeMailFile(ev.Name)
-	if err != nil {
-		log.Print(ev.Name, ": error parsing file ", err)
-		return
+	if ev.Op&fsnotify.Rename == fsnotify.Rename {
+		if _, found := c.files[ev.Name]; found {
+			c.renamed = ev.Name
+			return
+		}
 	}
 
 	if ev.Op&fsnotify.Remove == fsnotify.Remove ||
 		ev.Op&fsnotify.Rename == fsnotify.Rename {
-		files := make([]mailFile, 1)
-		files[0] = file
-
-		c.cache.removeCh <- files
-		c.remove(files)
+		c.removePath(ev.Name)
 	}
 
 	if ev.Op&fsnotify.Rename == fsnotify.Rename ||
 		ev.Op&fsnotify.Write == fsnotify.Write ||
 		ev.Op&fsnotify.Create == fsnotify.Create {
+		info, err := os.Stat(ev.Name)
+		if err != nil || info.IsDir() {
+			return
+		}
+		// Already indexed, for example when delivered via HTTP
+		if _, found := c.indexed(ev.Name, info); found {
+			return
+		}
+
+		file, err := c.mailFile(ev.Name)
+		if err != nil {
+			log.Print(ev.Name, ": error parsing file ", err)
+			return
+		}
 		c.markAdded(file, info)
 	}
 }
 
+// Index path in place of the file renamed by the previous event, if it is
+// the same message: it is the same in the caches, only with a new name.
+// Otherwise the renamed file was moved away and is forgotten.
+func (c *crawler) renameTo(path string) bool {
+	from := c.renamed
+	if from == "" {
+		return false
+	}
+	c.renamed = ""
+	meta, found := c.files[from]
+	if !found {
+		return false
+	}
+	if path != "" {
+		if file, err := c.mailFile(path); err == nil && file.mailbox == meta.mfile.mailbox && file.unique() == meta.mfile.unique() {
+			if info, err := os.Stat(path); err == nil {
+				c.moved(from, path)
+				c.markAdded(file, info)
+				return true
+			}
+		}
+	}
+	c.removePath(from)
+	return false
+}
+
+// Forget about a file or about all files in a directory
+func (c *crawler) removePath(name string) {
+	files := newMailFiles()
+	if meta, found := c.files[name]; found {
+		files = append(files, meta.mfile)
+	} else {
+		prefix := name + string(filepath.Separator)
+		for file, meta := range c.files {
+			if strings.HasPrefix(file, prefix) {
+				files = append(files, meta.mfile)
+			}
+		}
+	}
+	if len(files) == 0 {
+		return
+	}
+
+	metrics.cacheSend("remove", func() { c.cache.removeCh <- files })
+	c.remove(files)
+}
+
 type notify struct {
 	events  chan *event
 	watcher *fsnotify.Watcher
+	mu      sync.Mutex // Protects dirs, also changed when reconfigured
+	dirs    map[string]struct{}
 }
 
-func newNotify(dir string) (*notify, error) {
+func newNotify(dirs ...string) (*notify, error) {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return nil, err
 	}
 
-	if err := watcher.Add(dir); err != nil {
-		return nil, err
-	}
-
 	n := &notify{
 		events:  make(chan *event),
 		watcher: watcher,
+		dirs:    make(map[string]struct{}),
+	}
+
+	for _, dir := range dirs {
+		if err := n.watchTree(dir, false); err != nil {
+			return nil, err
+		}
 	}
 
 	// Listen to events forever, no need to close this watcher.
 	go func() {
-		for ev := range n.watcher.Events {
+		for ev := range queueEvents(n.watcher.Events) {
+			n.track(ev)
 			ev := event(ev)
 			n.events <- &ev
 		}
@@ -73,6 +161,123 @@ func newNotify(dir string) (*notify, error) {
 	return n, nil
 }
 
+// Removing a watch blocks until fsnotify can deliver more events:
+// keep receiving them while they are being handled.
+func queueEvents(in <-chan fsnotify.Event) <-chan fsnotify.Event {
+	out := make(chan fsnotify.Event)
+	go func() {
+		defer close(out)
+
+		queue := make([]fsnotify.Event, 0)
+		for {
+			var (
+				send chan fsnotify.Event
+				next fsnotify.Event
+			)
+			if len(queue) > 0 {
+				send, next = out, queue[0]
+			}
+			select {
+			case ev, ok := <-in:
+				if !ok {
+					return
+				}
+				queue = append(queue, ev)
+			case send <- next:
+				queue = queue[1:]
+			}
+		}
+	}()
+	return out
+}
+
+// Temporary files of deliveries in progress are not interesting
+func watchable(dir string) bool {
+	return filepath.Base(dir) != "tmp"
+}
+
+// Watch dir and all directories below it. If existing is true, events
+// are generated for files found, as they might have been added before
+// the directory was being watched.
+func (n *notify) watchTree(dir string, existing bool) error {
+	return filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !f.IsDir() {
+			if existing {
+				n.events <- &event{Name: path, Op: fsnotify.Create}
+			}
+			return nil
+		}
+		if !watchable(path) {
+			return filepath.SkipDir
+		}
+		if err := n.watcher.Add(path); err != nil {
+			return err
+		}
+		n.mu.Lock()
+		n.dirs[path] = struct{}{}
+		n.mu.Unlock()
+		return nil
+	})
+}
+
+// Start watching more mailboxes
+func (n *notify) watch(dirs ...string) error {
+	if n == nil {
+		return nil
+	}
+	for _, dir := range dirs {
+		if err := n.watchTree(dir, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stop watching dir and all directories below it
+func (n *notify) unwatch(dir string) {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	prefix := dir + string(filepath.Separator)
+	for d := range n.dirs {
+		if d == dir || strings.HasPrefix(d, prefix) {
+			n.watcher.Remove(d)
+			delete(n.dirs, d)
+		}
+	}
+}
+
+// Follow creation and removal of directories
+func (n *notify) track(ev fsnotify.Event) {
+	if ev.Op&fsnotify.Create == fsnotify.Create {
+		info, err := os.Stat(ev.Name)
+		if err != nil || !info.IsDir() || !watchable(ev.Name) {
+			return
+		}
+		if err := n.watchTree(ev.Name, true); err != nil {
+			log.Print(ev.Name, ": cannot watch directory: ", err)
+		}
+		return
+	}
+
+	if ev.Op&fsnotify.Remove == fsnotify.Remove ||
+		ev.Op&fsnotify.Rename == fsnotify.Rename {
+		n.mu.Lock()
+		_, found := n.dirs[ev.Name]
+		n.mu.Unlock()
+		if found {
+			// Removed directories are already unwatched
+			n.unwatch(ev.Name)
+		}
+	}
+}
+
 func (i *notify) eventsChannel() chan *event {
 	return i.events
 }
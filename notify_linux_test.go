@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	fsnotify "gopkg.in/fsnotify.v1"
+)
+
+// Kinds of the events sent by the caches so far
+func testEventKinds(cache *caches, s *cacheSubscriber) []cacheEventType {
+	// The caches handled all changes sent before the dump
+	testDump(cache)
+	var kinds []cacheEventType
+	for {
+		select {
+		case e := <-s.events:
+			kinds = append(kinds, e.kind)
+		default:
+			return kinds
+		}
+	}
+}
+
+func TestNotifyRename(t *testing.T) {
+	dir := testMaildir(t, map[string]string{
+		"cur/1500000001.M1P1.host:2,S": "Subject: one\n\nbody\n",
+		"cur/1500000002.M1P1.host:2,S": "Subject: two\n\nbody\n",
+	})
+	defer os.RemoveAll(dir)
+	cache, c := testCrawler(t, dir)
+	c.scan()
+	s := newCacheSubscriber()
+	cache.subCh <- s
+	<-s.replay
+
+	rename := func(from, to string) {
+		if err := os.Rename(from, to); err != nil {
+			t.Fatal(err)
+		}
+		event{Name: from, Op: fsnotify.Rename}.handle(c)
+	}
+	expect := func(what string, kinds ...cacheEventType) {
+		t.Helper()
+		got := testEventKinds(cache, s)
+		if len(got) != len(kinds) {
+			t.Fatalf("%s: expected events %v, got %v", what, kinds, got)
+		}
+		for i := range kinds {
+			if got[i] != kinds[i] {
+				t.Fatalf("%s: expected events %v, got %v", what, kinds, got)
+			}
+		}
+	}
+
+	// Flags changed: the same message with a new name
+	one := filepath.Join(dir, "cur", "1500000001.M1P1.host:2,S")
+	flagged := filepath.Join(dir, "cur", "1500000001.M1P1.host:2,FS")
+	rename(one, flagged)
+	event{Name: flagged, Op: fsnotify.Create}.handle(c)
+	expect("flags", cacheEventUpdated)
+	if _, found := c.files[one]; found {
+		t.Error("old name still known")
+	}
+	if _, found := c.files[flagged]; !found {
+		t.Error("new name not known")
+	}
+
+	// Moved out of the Maildir: forgotten with the next event
+	two := filepath.Join(dir, "cur", "1500000002.M1P1.host:2,S")
+	away := filepath.Join(dir, "two")
+	rename(two, away)
+	expect("rename")
+	event{Name: filepath.Join(dir, "cur"), Op: fsnotify.Chmod}.handle(c)
+	expect("moved away", cacheEventRemoved)
+	if _, found := c.files[two]; found {
+		t.Error("moved message still known")
+	}
+	rename(away, two)
+	event{Name: two, Op: fsnotify.Create}.handle(c)
+	expect("moved back", cacheEventAdded)
+
+	// Followed by another message: the old one is removed, the new one added
+	other := filepath.Join(dir, "new", "1500000003.M1P1.host")
+	rename(two, away)
+	if err := ioutil.WriteFile(other, []byte("Subject: three\n\nbody\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	event{Name: other, Op: fsnotify.Create}.handle(c)
+	expect("other message", cacheEventRemoved, cacheEventAdded)
+	if _, found := c.files[other]; !found || len(c.files) != 2 {
+		t.Errorf("expected the flagged and the new message, got %d", len(c.files))
+	}
+}
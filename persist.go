@@ -0,0 +1,161 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Increase when the format of the snapshot changes
+const indexVersion = 5
+
+// Minimum time between two saves of the index while messages keep changing
+const indexSaveInterval = time.Minute
+
+var errIndexOutdated = errors.New("Index was made with different settings")
+
+// What is saved on disk so that a restart doesn't need to parse all messages again.
+type indexSnapshot struct {
+	Version int
+	Keys    string
+	Files   []indexFile
+}
+
+type indexFile struct {
+	ID      string
+	Mailbox string
+	Folder  string
+	File    string
+	Date    time.Time
+	Size    int64
+	ModTime time.Time
+	Entries []indexEntry
+	Body    []string
+	// Used for threading
+	MessageID  string
+	References []string
+	Subject    string
+}
+
+type indexEntry struct {
+	Name string
+	Key  string
+}
+
+// The index must be rebuilt from scratch if the indexed keys or the mailboxes change
+func indexSignature(indexer *mailIndexer, mboxes mailboxes) string {
+	keys := indexer.keys()
+	sig := make([]string, 0, len(keys)+len(mboxes)+1)
+	if indexer.body {
+		sig = append(sig, "body")
+	}
+	for k, kt := range keys {
+		sig = append(sig, fmt.Sprintf("%s:%d", k, kt))
+	}
+	for _, m := range mboxes {
+		sig = append(sig, fmt.Sprintf("%s=%s", m.name, m.path))
+	}
+	sort.Strings(sig)
+	return strings.Join(sig, ",")
+}
+
+// Default location of the index file: next to the Maildir directory
+func defaultIndexFile(root string) string {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(abs), "."+filepath.Base(abs)+".perso-index")
+}
+
+func loadIndex(path, signature string) (*indexSnapshot, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	var snap indexSnapshot
+	if err := gob.NewDecoder(zr).Decode(&snap); err != nil {
+		return nil, err
+	}
+	if snap.Version != indexVersion || snap.Keys != signature {
+		return nil, errIndexOutdated
+	}
+	return &snap, nil
+}
+
+func (snap *indexSnapshot) save(path string) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	zw, _ := gzip.NewWriterLevel(f, gzip.BestSpeed)
+	err = gob.NewEncoder(zw).Encode(snap)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (f *indexFile) mailFile() mailFile {
+	return mailFile{
+		uid:     f.ID,
+		mailbox: f.Mailbox,
+		folder:  f.Folder,
+		file:    f.File,
+		date:    f.Date,
+	}
+}
+
+func (f *indexFile) cacheEntries() []cacheEntry {
+	mfile := f.mailFile()
+	entries := make([]cacheEntry, len(f.Entries))
+	for i, e := range f.Entries {
+		entries[i] = cacheEntry{name: e.Name, key: e.Key, value: mfile}
+	}
+	return entries
+}
+
+func (f *indexFile) threadRef() threadRef {
+	return threadRef{
+		messageID:  f.MessageID,
+		references: f.References,
+		subject:    f.Subject,
+	}
+}
+
+// File information as it was when the index was saved
+type indexFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (i *indexFileInfo) Name() string       { return i.name }
+func (i *indexFileInfo) Size() int64        { return i.size }
+func (i *indexFileInfo) Mode() os.FileMode  { return 0600 }
+func (i *indexFileInfo) ModTime() time.Time { return i.modTime }
+func (i *indexFileInfo) IsDir() bool        { return false }
+func (i *indexFileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Messages known to the caches, with their entries
+func testDump(cache *caches) map[mailFile]cacheFile {
+	data := make(chan map[mailFile]cacheFile)
+	cache.dumpCh <- data
+	return <-data
+}
+
+func TestIndexSnapshot(t *testing.T) {
+	dir := testMaildir(t, map[string]string{
+		"cur/1500000001.M1P1.host:2,S": "Subject: one\nMessage-ID: <one@host>\n\nbody\n",
+		"cur/1500000002.M1P1.host:2,S": "Subject: two\nMessage-ID: <two@host>\n\nbody\n",
+	})
+	defer os.RemoveAll(dir)
+	index := defaultIndexFile(dir)
+	defer os.Remove(index)
+
+	cache, c := testCrawler(t, dir)
+	c.index = index
+	c.scan()
+	if err := c.save(); err != nil {
+		t.Fatal(err)
+	}
+	saved := testDump(cache)
+	if len(saved) != 2 {
+		t.Fatalf("expected two messages, got %d", len(saved))
+	}
+
+	// Restored as they were saved, without parsing the messages
+	cache, c = testCrawler(t, dir)
+	c.index = index
+	c.restore()
+	restored := testDump(cache)
+	if len(c.files) != 2 || len(restored) != 2 {
+		t.Fatalf("expected two messages restored, got %d %d", len(c.files), len(restored))
+	}
+	for file, cf := range saved {
+		rf, found := restored[file]
+		if !found {
+			t.Fatal("message not restored ", file)
+		}
+		if len(rf.entries) != len(cf.entries) || rf.thread.messageID != cf.thread.messageID {
+			t.Errorf("%s: expected %v, got %v", file.file, cf, rf)
+		}
+	}
+
+	// A file removed while not running is forgotten by the first scan
+	if err := os.Remove(filepath.Join(dir, "cur", "1500000001.M1P1.host:2,S")); err != nil {
+		t.Fatal(err)
+	}
+	c.scan()
+	if restored := testDump(cache); len(c.files) != 1 || len(restored) != 1 {
+		t.Errorf("expected one message left, got %d %d", len(c.files), len(restored))
+	}
+
+	// Another signature: the snapshot is ignored
+	cache, c = testCrawler(t, dir)
+	c.index = index
+	c.indexer.body = true
+	c.restore()
+	if len(c.files) != 0 || len(testDump(cache)) != 0 {
+		t.Error("snapshot of other settings restored")
+	}
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"crypto/tls"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
@@ -11,41 +15,156 @@ func main() {
 	conf.parseFlags()
 
 	// Provides help text based on user configuration
-	help := newHelp(conf.keys)
+	help := newHelp(conf.keys, conf.body)
 
 	// Keep track of what is searcheable
 	indexer := newMailIndexer(conf.keys)
+	indexer.body = conf.body
 
 	// Handle all requests to the cache (searching or adding)
-	caches := newCaches(indexer, conf.root)
+	caches := newCaches(indexer)
 	go caches.run()
 
 	// First crawl. HTTP listener won't start before
-	crawler := newCrawler(indexer, caches, conf.root)
+	crawler := newCrawler(indexer, caches, conf.mailboxes, conf.index)
+	crawler.interval = time.Duration(conf.interval)
+	crawler.retention = conf.retention
+	crawler.restore()
 	crawler.scan()
+	if err := crawler.save(); err != nil {
+		log.Print(conf.index, ": cannot save index: ", err)
+	}
 
+	var (
+		notify *notify
+		events <-chan *event
+		errors <-chan error
+	)
 	if conf.interval > 0 {
-		go func() {
-			notify, err := newNotify(conf.root)
+		var err error
+		notify, err = newNotify(conf.mailboxes.paths()...)
+		if err != nil {
+			log.Fatal("inotify setup error: ", err)
+		}
+		events, errors = notify.eventsChannel(), notify.errorsChannel()
+	}
+	// Keep crawling for new or deleted messages
+	go crawler.run(events, errors)
+
+	// Save the index when terminated
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		if err := crawler.shutdown(); err != nil {
+			log.Print(conf.index, ": cannot save index: ", err)
+		}
+		os.Exit(0)
+	}()
+
+	// Receive mail directly, without an external MTA
+	if conf.smtp != "" {
+		var tlsConf *tls.Config
+		if conf.smtpCert != "" {
+			cert, err := tls.LoadX509KeyPair(conf.smtpCert, conf.smtpKey)
 			if err != nil {
-				log.Fatal("inotify setup error: ", err)
+				log.Fatal("cannot load SMTP certificate: ", err)
 			}
+			tlsConf = &tls.Config{Certificates: []tls.Certificate{cert}}
+		}
+		smtp := newSMTPServer(conf.smtp, conf.mailboxes[0].path, tlsConf)
+		go func() {
+			log.Fatal("smtp: ", smtp.run())
+		}()
+	}
 
-			// Keep crawling for new or deleted messages
-			crawler.run(
-				notify.eventsChannel(),
-				notify.errorsChannel(),
-				time.Tick(time.Duration(conf.interval)),
-			)
+	// Certificates are loaded again when they change
+	var tlsConf *tls.Config
+	if conf.tlsCert != "" {
+		var err error
+		tlsConf, err = newTLSConfig(conf.tlsCert, conf.tlsKey, conf.tlsCA)
+		if err != nil {
+			log.Fatal("cannot load TLS certificate: ", err)
+		}
+	}
+
+	// Let mail clients read the mailboxes
+	var imap *imapServer
+	if conf.imap != "" {
+		imap = newIMAPServer(conf.imap, caches, indexer, conf, tlsConf)
+		go func() {
+			log.Fatal("imap: ", imap.run())
+		}()
+	}
+	var pop3 *pop3Server
+	if conf.pop3 != "" {
+		pop3 = newPOP3Server(conf.pop3, caches, crawler, conf, tlsConf)
+		go func() {
+			log.Fatal("pop3: ", pop3.run())
 		}()
 	}
 
 	// Handle all HTTP requests here
-	handler := newHttpHandler(help, caches, conf, crawler, indexer)
+	router := newHttpRouter(newHttpHandler(help, caches, conf, crawler, indexer))
 	srv := &http.Server{
 		Addr:         conf.listen,
+		Handler:      router,
 		WriteTimeout: 15 * time.Second,
 		ReadTimeout:  15 * time.Second,
 	}
-	log.Fatal(handler.run(srv))
+
+	// Load the configuration again on SIGHUP
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+	go func() {
+		current := conf
+		for range hups {
+			next, err := current.reload()
+			if err != nil {
+				log.Print("cannot reload configuration: ", err)
+				continue
+			}
+			reload(current, next, notify, crawler)
+			router.set(newHttpHandler(newHelp(next.keys, next.body), caches, next, crawler, indexer))
+			if imap != nil {
+				imap.setConfig(next)
+			}
+			if pop3 != nil {
+				pop3.setConfig(next)
+			}
+			current = next
+			log.Print("configuration reloaded")
+		}
+	}()
+
+	if tlsConf == nil {
+		log.Fatal(srv.ListenAndServe())
+	}
+
+	srv.TLSConfig = tlsConf
+	if conf.redirect != "" {
+		go func() {
+			log.Fatal("http redirect: ", newRedirectServer(conf.redirect, conf.listen).ListenAndServe())
+		}()
+	}
+	// Certificates are in TLSConfig
+	log.Fatal(srv.ListenAndServeTLS("", ""))
+}
+
+// Apply a new configuration to the crawler and to the watched directories
+func reload(current, next *config, notify *notify, crawler *crawler) {
+	if next.listen != current.listen {
+		log.Print("listen address changed to ", next.listen, ": restart to use it")
+	}
+	if next.interval > 0 && current.interval == 0 {
+		log.Print("interval set: restart to watch mailboxes for changes")
+	}
+
+	for _, path := range current.mailboxes.diff(next.mailboxes) {
+		notify.unwatch(path)
+	}
+	crawler.reconfigure(next.keys, next.mailboxes, time.Duration(next.interval))
+	if err := notify.watch(next.mailboxes.diff(current.mailboxes)...); err != nil {
+		log.Print("cannot watch mailboxes: ", err)
+	}
 }
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const pop3IdleTimeout = 10 * time.Minute // Minimum autologout timer (RFC 1939, 3)
+
+var errPOP3Locked = errors.New("Mailbox already in use")
+
+// POP3 server (RFC 1939) for one mailbox per session: the first one on the
+// command line, or the one after "+" in the user name ("alice+work").
+// Deleted messages are removed when the client quits.
+type pop3Server struct {
+	listen  string
+	cache   *caches
+	crawler *crawler
+	tls     *tls.Config
+	conf    atomic.Value // *config, replaced when reloaded
+	mux     sync.Mutex
+	locked  map[string]bool // Mailboxes of the sessions in the transaction state
+}
+
+func newPOP3Server(listen string, cache *caches, crawler *crawler, conf *config, tlsConf *tls.Config) *pop3Server {
+	s := &pop3Server{
+		listen:  listen,
+		cache:   cache,
+		crawler: crawler,
+		tls:     tlsConf,
+		locked:  make(map[string]bool),
+	}
+	s.setConfig(conf)
+	return s
+}
+
+func (s *pop3Server) config() *config {
+	return s.conf.Load().(*config)
+}
+
+// Use the mailboxes and clients of a new configuration for new sessions
+func (s *pop3Server) setConfig(conf *config) {
+	s.conf.Store(conf)
+}
+
+// Only one session at a time can use a mailbox (RFC 1939, 8)
+func (s *pop3Server) lock(mailbox string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.locked[mailbox] {
+		return errPOP3Locked
+	}
+	s.locked[mailbox] = true
+	return nil
+}
+
+func (s *pop3Server) unlock(mailbox string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	delete(s.locked, mailbox)
+}
+
+func (s *pop3Server) run() error {
+	ln, err := net.Listen("tcp", s.listen)
+	if err != nil {
+		return err
+	}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Print("pop3: accept: ", err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go newPOP3Session(s, conn).serve()
+	}
+}
+
+type pop3Session struct {
+	server  *pop3Server
+	conn    net.Conn
+	text    *textproto.Conn
+	isTLS   bool
+	user    string
+	grant   *authGrant
+	mailbox string     // Empty until logged in
+	msgs    []fileMeta // Messages as listed when logging in
+	sizes   []int64    // Sizes as sent, with lines ending in CRLF
+	deleted []bool
+}
+
+func newPOP3Session(s *pop3Server, conn net.Conn) *pop3Session {
+	return &pop3Session{
+		server: s,
+		conn:   conn,
+		text:   textproto.NewConn(conn),
+	}
+}
+
+func (s *pop3Session) ok(format string, args ...interface{}) error {
+	s.conn.SetWriteDeadline(time.Now().Add(pop3IdleTimeout))
+	return s.text.PrintfLine("+OK %s", fmt.Sprintf(format, args...))
+}
+
+func (s *pop3Session) fail(format string, args ...interface{}) error {
+	s.conn.SetWriteDeadline(time.Now().Add(pop3IdleTimeout))
+	return s.text.PrintfLine("-ERR %s", fmt.Sprintf(format, args...))
+}
+
+// Write a multi-line response, with the terminating line
+func (s *pop3Session) lines(first string, lines []string) error {
+	s.conn.SetWriteDeadline(time.Now().Add(pop3IdleTimeout))
+	w := s.text.DotWriter()
+	fmt.Fprintf(w, "+OK %s\r\n", first)
+	for _, l := range lines {
+		fmt.Fprintf(w, "%s\r\n", l)
+	}
+	return w.Close()
+}
+
+func (s *pop3Session) serve() {
+	defer s.conn.Close()
+	defer func() {
+		if s.mailbox != "" {
+			s.server.unlock(s.mailbox)
+		}
+	}()
+
+	if err := s.ok("POP3 perso ready"); err != nil {
+		return
+	}
+
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(pop3IdleTimeout))
+		line, err := s.text.ReadLine()
+		if err != nil {
+			if err != io.EOF {
+				log.Print("pop3: ", s.conn.RemoteAddr(), ": ", err)
+			}
+			return
+		}
+
+		verb, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			verb, arg = line[:i], strings.TrimSpace(line[i+1:])
+		}
+		verb = strings.ToUpper(verb)
+
+		var quit bool
+		switch {
+		case verb == "QUIT":
+			err = s.cmdQuit()
+			quit = true
+		case verb == "CAPA":
+			err = s.cmdCapa()
+		case s.mailbox == "":
+			err = s.authorization(verb, arg)
+		default:
+			err = s.transaction(verb, arg)
+		}
+		if err != nil {
+			log.Print("pop3: ", s.conn.RemoteAddr(), ": ", err)
+			return
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// Commands before logging in
+func (s *pop3Session) authorization(verb, arg string) error {
+	switch verb {
+	case "STLS":
+		return s.cmdStls()
+	case "USER":
+		return s.cmdUser(arg)
+	case "PASS":
+		return s.cmdPass(arg)
+	}
+	return s.fail("Command not valid before logging in")
+}
+
+// Commands on the messages of a mailbox
+func (s *pop3Session) transaction(verb, arg string) error {
+	switch verb {
+	case "STAT":
+		return s.cmdStat()
+	case "LIST":
+		return s.cmdList(arg)
+	case "UIDL":
+		return s.cmdUidl(arg)
+	case "RETR":
+		return s.cmdRetr(arg)
+	case "TOP":
+		return s.cmdTop(arg)
+	case "DELE":
+		return s.cmdDele(arg)
+	case "RSET":
+		for i := range s.deleted {
+			s.deleted[i] = false
+		}
+		return s.ok("Deletions undone")
+	case "NOOP":
+		return s.ok("")
+	}
+	return s.fail("Command not recognized")
+}
+
+// Whether the plain text password can be sent: not if TLS is available
+// but not yet used
+func (s *pop3Session) canLogin() bool {
+	return s.server.tls == nil || s.isTLS
+}
+
+func (s *pop3Session) cmdCapa() error {
+	capa := []string{"TOP", "UIDL", "RESP-CODES", "AUTH-RESP-CODE"}
+	if s.canLogin() {
+		capa = append(capa, "USER")
+	}
+	if s.server.tls != nil && !s.isTLS {
+		capa = append(capa, "STLS")
+	}
+	capa = append(capa, "IMPLEMENTATION perso")
+	return s.lines("Capability list follows", capa)
+}
+
+func (s *pop3Session) cmdStls() error {
+	if s.server.tls == nil || s.isTLS {
+		return s.fail("TLS not available")
+	}
+	if err := s.ok("Ready to start TLS"); err != nil {
+		return err
+	}
+
+	conn := tls.Server(s.conn, s.server.tls)
+	conn.SetDeadline(time.Now().Add(pop3IdleTimeout))
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	s.conn = conn
+	s.text = textproto.NewConn(conn)
+	s.isTLS = true
+	s.user = ""
+	return nil
+}
+
+func (s *pop3Session) cmdUser(arg string) error {
+	if !s.canLogin() {
+		return s.fail("Use STLS first")
+	}
+	if arg == "" {
+		return s.fail("Syntax: USER name")
+	}
+	s.user = arg
+	return s.ok("Send the password")
+}
+
+func (s *pop3Session) cmdPass(arg string) error {
+	if s.user == "" {
+		return s.fail("Send USER first")
+	}
+	user := s.user
+	s.user = ""
+
+	conf := s.server.config()
+	mailbox := conf.mailboxes[0].name
+	if i := strings.IndexByte(user, '+'); i >= 0 {
+		user, mailbox = user[:i], user[i+1:]
+	}
+
+	grant, err := conf.auth.login(user, arg)
+	if err != nil {
+		log.Print("pop3: ", s.conn.RemoteAddr(), ": ", user, ": ", err)
+		return s.fail("[AUTH] Invalid credentials")
+	}
+	if grant != nil && (!grant.allows(authRead) || !grant.allowsMailbox(mailbox)) {
+		return s.fail("[AUTH] Permission denied")
+	}
+	if grant != nil && len(grant.headers) > 0 {
+		return s.fail("[AUTH] Clients restricted by headers cannot use POP3")
+	}
+	if !conf.mailboxes.exists(mailbox) {
+		return s.fail("[AUTH] No such mailbox")
+	}
+	if err := s.server.lock(mailbox); err != nil {
+		return s.fail("[IN-USE] %s", err)
+	}
+
+	s.grant, s.mailbox = grant, mailbox
+	s.msgs = s.server.crawler.mailboxFiles(mailbox)
+	s.sizes = make([]int64, len(s.msgs))
+	for i := range s.msgs {
+		s.sizes[i] = pop3Size(s.msgs[i])
+	}
+	s.deleted = make([]bool, len(s.msgs))
+	return s.ok("%s has %d messages", mailbox, len(s.msgs))
+}
+
+// Index of the message numbered arg, if not deleted
+func (s *pop3Session) message(arg string) (int, bool) {
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 1 || n > len(s.msgs) || s.deleted[n-1] {
+		return 0, false
+	}
+	return n - 1, true
+}
+
+// Size of a message as sent by RETR, with CR added to lines ending in LF
+// only (RFC 1939, 5), or of the file if it cannot be read anymore
+func pop3Size(meta fileMeta) int64 {
+	data, err := ioutil.ReadFile(meta.mfile.filename())
+	if err != nil {
+		return meta.info.Size()
+	}
+	return int64(len(data) + bytes.Count(data, []byte("\n")) - bytes.Count(data, []byte("\r\n")))
+}
+
+func (s *pop3Session) cmdStat() error {
+	var count int
+	var size int64
+	for i := range s.msgs {
+		if !s.deleted[i] {
+			count++
+			size += s.sizes[i]
+		}
+	}
+	return s.ok("%d %d", count, size)
+}
+
+func (s *pop3Session) cmdList(arg string) error {
+	if arg != "" {
+		i, ok := s.message(arg)
+		if !ok {
+			return s.fail("No such message")
+		}
+		return s.ok("%d %d", i+1, s.sizes[i])
+	}
+	lines := make([]string, 0, len(s.msgs))
+	for i := range s.msgs {
+		if !s.deleted[i] {
+			lines = append(lines, fmt.Sprintf("%d %d", i+1, s.sizes[i]))
+		}
+	}
+	return s.lines(fmt.Sprintf("%d messages", len(lines)), lines)
+}
+
+func (s *pop3Session) cmdUidl(arg string) error {
+	if arg != "" {
+		i, ok := s.message(arg)
+		if !ok {
+			return s.fail("No such message")
+		}
+		return s.ok("%d %s", i+1, s.msgs[i].mfile.id())
+	}
+	lines := make([]string, 0, len(s.msgs))
+	for i, m := range s.msgs {
+		if !s.deleted[i] {
+			lines = append(lines, fmt.Sprintf("%d %s", i+1, m.mfile.id()))
+		}
+	}
+	return s.lines("Unique-ID listing follows", lines)
+}
+
+// File of a message, following it if it was renamed since logging in
+func (s *pop3Session) file(i int) mailFile {
+	file := s.msgs[i].mfile
+	if _, err := os.Stat(file.filename()); os.IsNotExist(err) {
+		cr := newCacheFindRequest(file.id())
+		metrics.cacheSend("find", func() { s.server.cache.findCh <- cr })
+		if f, ok := <-cr.data; ok && f.folder == file.folder {
+			s.msgs[i].mfile = f
+			file = f
+		}
+	}
+	return file
+}
+
+// Send the header of a message and the first lines of its body,
+// or all of it if lines is negative
+func (s *pop3Session) send(arg string, lines int) error {
+	i, ok := s.message(arg)
+	if !ok {
+		return s.fail("No such message")
+	}
+	data, err := ioutil.ReadFile(s.file(i).filename())
+	if err != nil {
+		log.Print("pop3: ", err)
+		return s.fail("[SYS/TEMP] Cannot read message")
+	}
+	data = imapCRLF(data)
+	if lines >= 0 {
+		data = pop3Top(data, lines)
+	}
+
+	if err := s.ok("%d octets", len(data)); err != nil {
+		return err
+	}
+	w := s.text.DotWriter()
+	w.Write(data)
+	return w.Close()
+}
+
+// The header of a message and the first n lines of its body
+func pop3Top(data []byte, n int) []byte {
+	end := bytes.Index(data, []byte("\r\n\r\n"))
+	if end < 0 {
+		return data
+	}
+	end += 4
+	for ; n > 0 && end < len(data); n-- {
+		i := bytes.Index(data[end:], []byte("\r\n"))
+		if i < 0 {
+			return data
+		}
+		end += i + 2
+	}
+	return data[:end]
+}
+
+func (s *pop3Session) cmdRetr(arg string) error {
+	return s.send(arg, -1)
+}
+
+func (s *pop3Session) cmdTop(arg string) error {
+	args := strings.Fields(arg)
+	if len(args) != 2 {
+		return s.fail("Syntax: TOP msg n")
+	}
+	n, err := strconv.Atoi(args[1])
+	if err != nil || n < 0 {
+		return s.fail("Invalid number of lines")
+	}
+	return s.send(args[0], n)
+}
+
+func (s *pop3Session) cmdDele(arg string) error {
+	if s.grant != nil && !s.grant.allows(authDelete) {
+		return s.fail("Permission denied")
+	}
+	i, ok := s.message(arg)
+	if !ok {
+		return s.fail("No such message")
+	}
+	s.deleted[i] = true
+	return s.ok("Message %d deleted", i+1)
+}
+
+// Remove the deleted messages, if logged in, and say goodbye
+func (s *pop3Session) cmdQuit() error {
+	if s.mailbox == "" {
+		return s.ok("Bye")
+	}
+
+	files := newMailFiles()
+	for i := range s.msgs {
+		if s.deleted[i] {
+			files = append(files, s.file(i))
+		}
+	}
+	if len(files) == 0 {
+		return s.ok("Bye")
+	}
+	failed := files.delete()
+	s.server.crawler.rescan()
+	if len(failed) > 0 {
+		return s.fail("[SYS/TEMP] %d of %d deleted messages not removed", len(failed), len(files))
+	}
+	return s.ok("Bye, %d messages removed", len(files))
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPOP3Top(t *testing.T) {
+	data := []byte("Subject: x\r\nTo: y\r\n\r\none\r\ntwo\r\nthree")
+	for n, expected := range map[int]string{
+		0:  "Subject: x\r\nTo: y\r\n\r\n",
+		2:  "Subject: x\r\nTo: y\r\n\r\none\r\ntwo\r\n",
+		10: string(data),
+	} {
+		if top := string(pop3Top(data, n)); top != expected {
+			t.Errorf("%d: expected %q, got %q", n, expected, top)
+		}
+	}
+	if top := string(pop3Top([]byte("Subject: x\r\n"), 1)); top != "Subject: x\r\n" {
+		t.Errorf("unexpected top of message without body %q", top)
+	}
+}
+
+// A client connected to a session of server, and the end of the session
+type pop3TestClient struct {
+	t    *testing.T
+	text *textproto.Conn
+	done chan struct{}
+}
+
+func newPOP3TestClient(t *testing.T, s *pop3Server) *pop3TestClient {
+	client, conn := net.Pipe()
+	c := &pop3TestClient{t: t, text: textproto.NewConn(client), done: make(chan struct{})}
+	go func() {
+		newPOP3Session(s, conn).serve()
+		close(c.done)
+	}()
+	c.expect("+OK")
+	return c
+}
+
+// Send a command and check the start of the response
+func (c *pop3TestClient) cmd(line, expected string) string {
+	c.t.Helper()
+	if err := c.text.PrintfLine("%s", line); err != nil {
+		c.t.Fatal(err)
+	}
+	return c.expect(expected)
+}
+
+func (c *pop3TestClient) expect(expected string) string {
+	c.t.Helper()
+	resp, err := c.text.ReadLine()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if !strings.HasPrefix(resp, expected) {
+		c.t.Fatalf("expected %s, got %s", expected, resp)
+	}
+	return resp
+}
+
+// Close the connection, without QUIT, and wait for the session to end
+func (c *pop3TestClient) drop() {
+	c.text.Close()
+	<-c.done
+}
+
+func TestPOP3Session(t *testing.T) {
+	dir, err := ioutil.TempDir("", "perso-pop3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := make([]string, 3)
+	for i := range files {
+		files[i] = filepath.Join(dir, "cur", "150000000"+string(rune('0'+i))+".M1P1.host:2,S")
+		msg := "Subject: " + string(rune('a'+i)) + "\nMessage-ID: <" + string(rune('a'+i)) + "@host>\n\nline\n"
+		if err := ioutil.WriteFile(files[i], []byte(msg), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exists := func(i int) bool {
+		_, err := os.Stat(files[i])
+		return err == nil
+	}
+
+	conf := newConfig()
+	conf.interval = 0
+	if err := conf.mailboxes.add("box=" + dir); err != nil {
+		t.Fatal(err)
+	}
+	if conf.auth, err = newAuth(nil); err != nil {
+		t.Fatal(err)
+	}
+	indexer := newMailIndexer(conf.keys)
+	cache := newCaches(indexer)
+	go cache.run()
+	crawler := newCrawler(indexer, cache, conf.mailboxes, "")
+	crawler.scan()
+	go crawler.run(nil, nil)
+	server := newPOP3Server("", cache, crawler, conf, nil)
+
+	c := newPOP3TestClient(t, server)
+	c.cmd("USER alice", "+OK")
+	c.cmd("PASS secret", "+OK box has 3 messages")
+	other := newPOP3TestClient(t, server)
+	other.cmd("USER alice+box", "+OK")
+	other.cmd("PASS secret", "-ERR [IN-USE]")
+	other.drop()
+
+	// Sizes are those of the messages as sent, with CRLF
+	info, err := os.Stat(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := strconv.FormatInt(info.Size()+4, 10)
+	c.cmd("LIST 1", "+OK 1 "+size)
+	c.cmd("RETR 1", "+OK "+size+" octets")
+	if _, err := c.text.ReadDotLines(); err != nil {
+		t.Fatal(err)
+	}
+	c.cmd("STAT", "+OK 3 ")
+
+	// Deletions only take effect at QUIT
+	c.cmd("DELE 1", "+OK")
+	c.cmd("DELE 1", "-ERR")
+	c.cmd("RETR 1", "-ERR")
+	c.cmd("STAT", "+OK 2 ")
+	c.cmd("RSET", "+OK")
+	c.cmd("STAT", "+OK 3 ")
+	c.cmd("DELE 3", "+OK")
+	c.drop()
+	if !exists(0) || !exists(2) {
+		t.Fatal("messages removed without QUIT")
+	}
+
+	// The mailbox is unlocked when the connection is closed
+	c = newPOP3TestClient(t, server)
+	c.cmd("USER alice", "+OK")
+	c.cmd("PASS secret", "+OK box has 3 messages")
+	c.cmd("DELE 2", "+OK")
+	c.cmd("QUIT", "+OK Bye, 1 messages removed")
+	<-c.done
+	if !exists(0) || exists(1) || !exists(2) {
+		t.Error("expected only the second message to be removed")
+	}
+}
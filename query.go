@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+var errEmptyQuery = errors.New("Empty query")
+
+// Messages with an indexed header matching a value
+type searchHeader struct {
+	header string
+	value  string
+	match  keyType
+}
+
+func (s searchHeader) eval(c *caches, all fileSet) fileSet {
+	result := make(fileSet)
+	for _, f := range c.match(s.header, s.value, s.match) {
+		result[f] = struct{}{}
+	}
+	return result
+}
+
+// Parameters of the query string that are not clauses
+var queryReserved = map[string]bool{
+	"format": true,
+	"since":  true,
+	"until":  true,
+	"unread": true,
+}
+
+// Build a query from URL parameters like "from=a@x&to=b@y&subject~=Invoice".
+// Different parameters must all match; a parameter repeated more than
+// once matches any of its values. "header~=value" matches part of the
+// header, "q" searches the body of messages, if indexed.
+func parseHeaderQuery(params url.Values, indexer *mailIndexer) (searchNode, error) {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		if !queryReserved[name] {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, errEmptyQuery
+	}
+	// Same order for the same query
+	sort.Strings(names)
+
+	clauses := make(searchAnd, 0, len(names))
+	for _, name := range names {
+		any := make(searchOr, 0, len(params[name]))
+		for _, value := range params[name] {
+			node, err := parseClause(name, value, indexer)
+			if err != nil {
+				return nil, err
+			}
+			any = append(any, node)
+		}
+		if len(any) == 1 {
+			clauses = append(clauses, any[0])
+			continue
+		}
+		clauses = append(clauses, any)
+	}
+	if len(clauses) == 1 {
+		return clauses[0], nil
+	}
+	return clauses, nil
+}
+
+func parseClause(name, value string, indexer *mailIndexer) (searchNode, error) {
+	if name == "q" {
+		if !indexer.body {
+			return nil, errors.New("Body is not indexed")
+		}
+		return parseSearchQuery(value)
+	}
+
+	header := strings.ToLower(strings.TrimSuffix(name, "~"))
+	keys := indexer.keys()
+	if header == "" || !keys.has(header) {
+		return nil, errors.New("Header not indexed: " + name)
+	}
+	kt := keys.keyType(header)
+	if kt == keyTypeAny {
+		return nil, errors.New("Header not indexed: " + name)
+	}
+	if kt == keyTypeAddr {
+		value = strings.ToLower(value)
+	}
+	if strings.HasSuffix(name, "~") {
+		kt = keyTypePart
+	}
+	return searchHeader{header: header, value: value, match: kt}, nil
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How often the crawler checks if messages must be purged
+const retentionInterval = time.Minute
+
+// Limits of a mailbox. Zero values are no limit.
+type retentionPolicy struct {
+	age      time.Duration
+	messages int
+	bytes    int64
+}
+
+// Fields set in p replace the ones of r
+func (r retentionPolicy) merge(p *retentionPolicy) retentionPolicy {
+	if p == nil {
+		return r
+	}
+	if p.age > 0 {
+		r.age = p.age
+	}
+	if p.messages > 0 {
+		r.messages = p.messages
+	}
+	if p.bytes > 0 {
+		r.bytes = p.bytes
+	}
+	return r
+}
+
+func (r retentionPolicy) enabled() bool {
+	return r.age > 0 || r.messages > 0 || r.bytes > 0
+}
+
+// Limits of all mailboxes and what to do with the messages over them
+type retention struct {
+	policies map[string]*retentionPolicy // By mailbox name, "" for all mailboxes
+	archive  string                      // Directory where to save purged messages, if any
+	agent    string
+}
+
+func newRetention() *retention {
+	return &retention{
+		policies: make(map[string]*retentionPolicy),
+	}
+}
+
+func (r *retention) enabled() bool {
+	for _, p := range r.policies {
+		if p.enabled() {
+			return true
+		}
+	}
+	return false
+}
+
+// Limits for a mailbox: the ones of the mailbox itself, then of its parents
+// ("work" for "work.Sent"), then the ones for all mailboxes.
+func (r *retention) policy(mailbox string) retentionPolicy {
+	names := []string{""}
+	for i, c := range mailbox {
+		if c == '.' {
+			names = append(names, mailbox[:i])
+		}
+	}
+	names = append(names, mailbox)
+
+	var policy retentionPolicy
+	for _, name := range names {
+		policy = policy.merge(r.policies[name])
+	}
+	return policy
+}
+
+// A command line flag setting one limit, as "value" or "mailbox=value"
+type retentionFlag struct {
+	retention *retention
+	set       func(p *retentionPolicy, value string) error
+}
+
+func (f *retentionFlag) String() string {
+	return ""
+}
+
+func (f *retentionFlag) Set(arg string) error {
+	name, value := "", arg
+	if i := strings.IndexByte(arg, '='); i >= 0 {
+		name, value = arg[:i], arg[i+1:]
+	}
+	p, found := f.retention.policies[name]
+	if !found {
+		p = &retentionPolicy{}
+		f.retention.policies[name] = p
+	}
+	return f.set(p, value)
+}
+
+func setRetentionAge(p *retentionPolicy, value string) error {
+	age, err := time.ParseDuration(value)
+	if err != nil || age <= 0 {
+		return errInvalidFlag
+	}
+	p.age = age
+	return nil
+}
+
+func setRetentionMessages(p *retentionPolicy, value string) error {
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return errInvalidFlag
+	}
+	p.messages = n
+	return nil
+}
+
+func setRetentionBytes(p *retentionPolicy, value string) error {
+	n, err := parseSize(value)
+	if err != nil || n <= 0 {
+		return errInvalidFlag
+	}
+	p.bytes = n
+	return nil
+}
+
+// Parse sizes like "2G", "500M", "64k" or a number of bytes
+func parseSize(s string) (int64, error) {
+	mult := int64(1)
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'k', 'K':
+			mult = 1 << 10
+		case 'm', 'M':
+			mult = 1 << 20
+		case 'g', 'G':
+			mult = 1 << 30
+		case 't', 'T':
+			mult = 1 << 40
+		}
+		if mult > 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	return n * mult, err
+}
+
+// Date used to decide if a message is too old. Without Date header,
+// the time it was written in the Maildir.
+func retentionDate(meta *fileMeta) time.Time {
+	if meta.mfile.date.IsZero() {
+		return meta.info.ModTime()
+	}
+	return meta.mfile.date
+}
+
+// Messages over the limits of policy, from a list sorted from the oldest
+func (p retentionPolicy) expired(metas []*fileMeta, now time.Time) []*fileMeta {
+	cut := 0
+	if p.age > 0 {
+		limit := now.Add(-p.age)
+		cut = sort.Search(len(metas), func(i int) bool {
+			return !retentionDate(metas[i]).Before(limit)
+		})
+	}
+	if p.messages > 0 && len(metas)-p.messages > cut {
+		cut = len(metas) - p.messages
+	}
+	if p.bytes > 0 {
+		var total int64
+		for i := len(metas) - 1; i >= cut; i-- {
+			total += metas[i].info.Size()
+			if total > p.bytes {
+				cut = i + 1
+				break
+			}
+		}
+	}
+	return metas[:cut]
+}
+
+// Save messages in a compressed mbox file in the archive directory
+func (r *retention) save(mailbox string, files mailFiles) (string, error) {
+	if err := os.MkdirAll(r.archive, 0700); err != nil {
+		return "", err
+	}
+	name := filepath.Join(r.archive, fmt.Sprintf("%s-%s.mbox.gz", mailbox, time.Now().Format("20060102-150405")))
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return "", err
+	}
+
+	zw := gzip.NewWriter(f)
+	for _, m := range files {
+		if err = m.writeTo(zw, r.agent); err != nil {
+			break
+		}
+	}
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return name, err
+}
+
+// Delete (or archive) the oldest messages of each mailbox over its limits
+func (c *crawler) purge() {
+	byMailbox := make(map[string][]*fileMeta)
+	for _, meta := range c.files {
+		byMailbox[meta.mfile.folder] = append(byMailbox[meta.mfile.folder], meta)
+	}
+
+	now := time.Now()
+	for mailbox, metas := range byMailbox {
+		policy := c.retention.policy(mailbox)
+		if !policy.enabled() {
+			continue
+		}
+		sort.Slice(metas, func(i, j int) bool {
+			di, dj := retentionDate(metas[i]), retentionDate(metas[j])
+			if !di.Equal(dj) {
+				return di.Before(dj)
+			}
+			return metas[i].mfile.before(metas[j].mfile)
+		})
+		expired := policy.expired(metas, now)
+		if len(expired) == 0 {
+			continue
+		}
+
+		files := make(mailFiles, len(expired))
+		for i, meta := range expired {
+			files[i] = meta.mfile
+		}
+
+		if c.retention.archive != "" {
+			name, err := c.retention.save(mailbox, files)
+			if err != nil {
+				log.Print("purge: ", mailbox, ": cannot archive messages, not purging: ", err)
+				continue
+			}
+			log.Printf("purge: %s: archived %d messages into %s", mailbox, len(files), name)
+		}
+
+		// Files that cannot be removed stay indexed, and are tried again at the next purge
+		failed := make(map[mailFile]bool)
+		for _, f := range files.delete() {
+			failed[f] = true
+		}
+		var size int64
+		removed := newMailFiles()
+		for _, meta := range expired {
+			if !failed[meta.mfile] {
+				removed = append(removed, meta.mfile)
+				size += meta.info.Size()
+			}
+		}
+		if len(failed) > 0 {
+			log.Printf("purge: %s: %d of %d messages not removed", mailbox, len(failed), len(files))
+		}
+		if len(removed) == 0 {
+			continue
+		}
+		metrics.cacheSend("remove", func() { c.cache.removeCh <- removed })
+		c.remove(removed)
+		log.Printf("purge: %s: removed %d messages (%d bytes), %d left", mailbox, len(removed), size, len(metas)-len(removed))
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetentionPolicy(t *testing.T) {
+	r := newRetention()
+	(&retentionFlag{r, setRetentionAge}).Set("72h")
+	(&retentionFlag{r, setRetentionMessages}).Set("work=100")
+	(&retentionFlag{r, setRetentionAge}).Set("work.Sent=1h")
+	if err := (&retentionFlag{r, setRetentionBytes}).Set("work=2G"); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&retentionFlag{r, setRetentionBytes}).Set("2X"); err == nil {
+		t.Error("invalid size accepted")
+	}
+
+	p := r.policy("work.Sent")
+	if p.age != time.Hour || p.messages != 100 || p.bytes != 2<<30 {
+		t.Errorf("unexpected policy for work.Sent: %+v", p)
+	}
+	if p := r.policy("other"); p.age != 72*time.Hour || p.messages != 0 {
+		t.Errorf("unexpected policy for other: %+v", p)
+	}
+}
+
+func TestRetentionExpired(t *testing.T) {
+	now := time.Date(2017, 7, 17, 10, 0, 0, 0, time.UTC)
+	metas := make([]*fileMeta, 5)
+	for i := range metas {
+		metas[i] = &fileMeta{
+			mfile: mailFile{date: now.Add(time.Duration(i-5) * time.Hour)},
+			info:  &indexFileInfo{size: 100},
+		}
+	}
+
+	tests := []struct {
+		policy retentionPolicy
+		n      int
+	}{
+		{retentionPolicy{age: 150 * time.Minute}, 3},
+		{retentionPolicy{messages: 4}, 1},
+		{retentionPolicy{bytes: 250}, 3},
+		{retentionPolicy{age: 10 * time.Hour, messages: 10, bytes: 1000}, 0},
+	}
+	for _, test := range tests {
+		if n := len(test.policy.expired(metas, now)); n != test.n {
+			t.Errorf("%+v: %d messages expired, want %d", test.policy, n, test.n)
+		}
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"errors"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var errInvalidQuery = errors.New("Invalid query")
+
+// Maximum size of a text part that is indexed
+const searchMaxPart = 1 << 20
+
+// Split text into lowercase words. Positions are kept so that phrases can be found.
+func tokenize(s string, tokens []string) []string {
+	start := -1
+	for i, r := range s {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 {
+			tokens = append(tokens, strings.ToLower(s[start:i]))
+			start = -1
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, strings.ToLower(s[start:]))
+	}
+	return tokens
+}
+
+// Remove tags from HTML, with the contents of scripts and styles
+func stripHTML(s string) string {
+	var b strings.Builder
+	for len(s) > 0 {
+		lt := strings.IndexByte(s, '<')
+		if lt < 0 {
+			b.WriteString(s)
+			break
+		}
+		b.WriteString(s[:lt])
+		b.WriteByte(' ')
+		s = s[lt:]
+
+		gt := strings.IndexByte(s, '>')
+		if gt < 0 {
+			break
+		}
+		tag := strings.ToLower(s[1:gt])
+		s = s[gt+1:]
+
+		for _, skip := range []string{"script", "style"} {
+			if tag == skip || strings.HasPrefix(tag, skip+" ") {
+				end := strings.Index(strings.ToLower(s), "</"+skip)
+				if end < 0 {
+					return html.UnescapeString(b.String())
+				}
+				s = s[end:]
+			}
+		}
+	}
+	return html.UnescapeString(b.String())
+}
+
+// Decode text in a single byte charset to UTF-8. Only Latin-1
+// (and its Windows superset, approximately) is converted.
+func decodeCharset(data []byte, charset string) string {
+	switch strings.ToLower(charset) {
+	case "iso-8859-1", "latin1", "windows-1252", "cp1252":
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+		return string(runes)
+	}
+	if !utf8.Valid(data) {
+		return strings.ToValidUTF8(string(data), " ")
+	}
+	return string(data)
+}
+
+// Words of the text parts of msg. Parts are separated by an empty
+// token, so that phrases never span two parts.
+func bodyTokens(msg *mail.Message) ([]string, error) {
+	tokens := make([]string, 0)
+	_, err := parseMIME(textproto.MIMEHeader(msg.Header), msg.Body, func(p *mimePart, r io.Reader) error {
+		if p.contentType != "text/plain" && p.contentType != "text/html" {
+			return nil
+		}
+		if p.disposition == "attachment" {
+			return nil
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(p.decode(r), searchMaxPart))
+		if err != nil {
+			return err
+		}
+		text := decodeCharset(data, p.params["charset"])
+		if p.contentType == "text/html" {
+			text = stripHTML(text)
+		}
+		if len(tokens) > 0 {
+			tokens = append(tokens, "")
+		}
+		tokens = tokenize(text, tokens)
+		return nil
+	})
+	return tokens, err
+}
+
+// Inverted index of the words in the body of messages. Only used from the caches goroutine.
+type bodyIndex struct {
+	terms map[string]map[mailFile][]int
+}
+
+func newBodyIndex() *bodyIndex {
+	return &bodyIndex{
+		terms: make(map[string]map[mailFile][]int),
+	}
+}
+
+func (b *bodyIndex) add(file mailFile, tokens []string) {
+	for pos, t := range tokens {
+		if t == "" {
+			continue
+		}
+		files, found := b.terms[t]
+		if !found {
+			files = make(map[mailFile][]int)
+			b.terms[t] = files
+		}
+		files[file] = append(files[file], pos)
+	}
+}
+
+func (b *bodyIndex) remove(file mailFile, tokens []string) {
+	for _, t := range tokens {
+		files, found := b.terms[t]
+		if !found {
+			continue
+		}
+		delete(files, file)
+		if len(files) == 0 {
+			delete(b.terms, t)
+		}
+	}
+}
+
+type fileSet map[mailFile]struct{}
+
+func (s fileSet) files() mailFiles {
+	files := make([]mailFile, 0, len(s))
+	for f := range s {
+		files = append(files, f)
+	}
+	return files
+}
+
+// A parsed search query
+type searchNode interface {
+	eval(c *caches, all fileSet) fileSet
+}
+
+type searchPhrase []string
+
+type searchAnd []searchNode
+
+type searchOr []searchNode
+
+type searchNot struct {
+	node searchNode
+}
+
+func (p searchPhrase) eval(c *caches, all fileSet) fileSet {
+	result := make(fileSet)
+	first, found := c.body.terms[p[0]]
+	if !found {
+		return result
+	}
+
+	for file, positions := range first {
+		for _, pos := range positions {
+			if p.at(c.body, file, pos) {
+				result[file] = struct{}{}
+				break
+			}
+		}
+	}
+	return result
+}
+
+// Whether the rest of the phrase follows the first word, found at pos
+func (p searchPhrase) at(b *bodyIndex, file mailFile, pos int) bool {
+	for i := 1; i < len(p); i++ {
+		positions := b.terms[p[i]][file]
+		j := sort.SearchInts(positions, pos+i)
+		if j >= len(positions) || positions[j] != pos+i {
+			return false
+		}
+	}
+	return true
+}
+
+func (a searchAnd) eval(c *caches, all fileSet) fileSet {
+	var result fileSet
+	for _, n := range a {
+		set := n.eval(c, all)
+		if result == nil {
+			result = set
+			continue
+		}
+		for f := range result {
+			if _, found := set[f]; !found {
+				delete(result, f)
+			}
+		}
+	}
+	return result
+}
+
+func (o searchOr) eval(c *caches, all fileSet) fileSet {
+	result := make(fileSet)
+	for _, n := range o {
+		for f := range n.eval(c, all) {
+			result[f] = struct{}{}
+		}
+	}
+	return result
+}
+
+func (n searchNot) eval(c *caches, all fileSet) fileSet {
+	exclude := n.node.eval(c, all)
+	result := make(fileSet)
+	for f := range all {
+		if _, found := exclude[f]; !found {
+			result[f] = struct{}{}
+		}
+	}
+	return result
+}
+
+// Query parser. The grammar is:
+//
+//	query  = and { "OR" and }
+//	and    = not { ["AND"] not }
+//	not    = ("NOT" | "-") not | "(" query ")" | word | '"' phrase '"'
+type searchParser struct {
+	tokens []string
+	pos    int
+}
+
+// Split the query in words, quoted phrases and parenthesis
+func lexQuery(q string) ([]string, error) {
+	tokens := make([]string, 0)
+	for i := 0; i < len(q); {
+		c := q[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(' || c == ')' || c == '-':
+			tokens = append(tokens, string(c))
+			i++
+		case c == '"':
+			end := strings.IndexByte(q[i+1:], '"')
+			if end < 0 {
+				return nil, errInvalidQuery
+			}
+			tokens = append(tokens, q[i:i+end+2])
+			i += end + 2
+		default:
+			end := strings.IndexAny(q[i:], " \t\r\n()\"")
+			if end < 0 {
+				end = len(q) - i
+			}
+			tokens = append(tokens, q[i:i+end])
+			i += end
+		}
+	}
+	return tokens, nil
+}
+
+func parseSearchQuery(q string) (searchNode, error) {
+	tokens, err := lexQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, errInvalidQuery
+	}
+	p := &searchParser{tokens: tokens}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, errInvalidQuery
+	}
+	return node, nil
+}
+
+func (p *searchParser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *searchParser) parseOr() (searchNode, error) {
+	nodes := make(searchOr, 0)
+	for {
+		n, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, n)
+		if p.peek() != "OR" {
+			break
+		}
+		p.pos++
+	}
+	if len(nodes) == 1 {
+		return nodes[0], nil
+	}
+	return nodes, nil
+}
+
+func (p *searchParser) parseAnd() (searchNode, error) {
+	nodes := make(searchAnd, 0)
+	for {
+		n, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, n)
+
+		next := p.peek()
+		if next == "AND" {
+			p.pos++
+			continue
+		}
+		if next == "" || next == "OR" || next == ")" {
+			break
+		}
+	}
+	if len(nodes) == 1 {
+		return nodes[0], nil
+	}
+	return nodes, nil
+}
+
+func (p *searchParser) parseNot() (searchNode, error) {
+	t := p.peek()
+	switch {
+	case t == "" || t == ")" || t == "AND" || t == "OR":
+		return nil, errInvalidQuery
+	case t == "NOT" || t == "-":
+		p.pos++
+		n, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return searchNot{node: n}, nil
+	case t == "(":
+		p.pos++
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, errInvalidQuery
+		}
+		p.pos++
+		return n, nil
+	}
+
+	p.pos++
+	words := tokenize(strings.Trim(t, `"`), nil)
+	if len(words) == 0 {
+		return nil, errInvalidQuery
+	}
+	return searchPhrase(words), nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/url"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestSearchQuery(t *testing.T) {
+	a := mailFile{file: "a", date: time.Unix(1, 0)}
+	b := mailFile{file: "b", date: time.Unix(2, 0)}
+	c := mailFile{file: "c", date: time.Unix(3, 0)}
+
+	cache := newCaches(newMailIndexer(makeIndexKeys()))
+	index := cache.body
+	index.add(a, tokenize("Please reset your password now.", nil))
+	index.add(b, tokenize("Your password was changed", nil))
+	index.add(c, tokenize(stripHTML("<p>Reset</p><style>password {}</style>"), nil))
+	all := fileSet{a: {}, b: {}, c: {}}
+
+	tests := map[string][]mailFile{
+		"password":                    {a, b},
+		"PASSWORD reset":              {a},
+		`"your password"`:             {a, b},
+		`"password your"`:             {},
+		"reset OR changed":            {a, b, c},
+		"reset -password":             {c},
+		"NOT (reset AND password)":    {b, c},
+		`reset AND NOT "was changed"`: {a, c},
+	}
+	for q, want := range tests {
+		node, err := parseSearchQuery(q)
+		if err != nil {
+			t.Errorf("%s: %v", q, err)
+			continue
+		}
+		got := node.eval(cache, all)
+		if len(got) != len(want) {
+			t.Errorf("%s: got %d messages, want %d", q, len(got), len(want))
+			continue
+		}
+		for _, f := range want {
+			if _, found := got[f]; !found {
+				t.Errorf("%s: %s not found", q, f.file)
+			}
+		}
+	}
+
+	for _, q := range []string{"", `"unterminated`, "(a", "a OR", "AND"} {
+		if _, err := parseSearchQuery(q); err == nil {
+			t.Errorf("%s: expected an error", q)
+		}
+	}
+
+	index.remove(a, tokenize("Please reset your password now.", nil))
+	if _, found := index.terms["please"]; found {
+		t.Error("removed message still indexed")
+	}
+}
+
+func TestHeaderQuery(t *testing.T) {
+	keys := makeIndexKeys()
+	keys.add("", keyTypeAny)
+	keys.add("from", keyTypeAddr)
+	keys.add("to", keyTypeAddr)
+	keys.add("subject", keyTypeNormal)
+	cache := newCaches(newMailIndexer(keys))
+
+	add := func(name, from, to, subject string) mailFile {
+		f := mailFile{file: name, date: time.Unix(int64(name[0]), 0)}
+		cache.add(cacheMessage{file: f, entries: []cacheEntry{
+			{name: "", key: "", value: f},
+			{name: "from", key: from, value: f},
+			{name: "to", key: to, value: f},
+			{name: "subject", key: subject, value: f},
+		}})
+		return f
+	}
+	a := add("a", "noreply@x", "alice@y", "Invoice 12")
+	b := add("b", "noreply@x", "bob@y", "Invoice 13")
+	add("c", "info@x", "alice@y", "Invoice 14")
+	add("d", "noreply@x", "alice@y", "Welcome")
+
+	tests := map[string][]mailFile{
+		"from=NoReply@x&to=alice@y&subject~=Invoice":      {a},
+		"from=noreply@x&to=alice@y&to=bob@y&subject~=Inv": {a, b},
+		"subject=Invoice 13":                              {b},
+	}
+	for q, want := range tests {
+		params, _ := url.ParseQuery(q)
+		node, err := parseHeaderQuery(params, cache.indexer)
+		if err != nil {
+			t.Errorf("%s: %v", q, err)
+			continue
+		}
+		got := cache.search(node, time.Time{}, time.Time{})
+		sort.Sort(got)
+		if len(got) != len(want) {
+			t.Errorf("%s: got %v, want %v", q, got, want)
+			continue
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("%s: got %v, want %v", q, got, want)
+			}
+		}
+	}
+
+	for _, q := range []string{"", "format=json", "cc=alice@y", "q=body"} {
+		params, _ := url.ParseQuery(q)
+		if _, err := parseHeaderQuery(params, cache.indexer); err == nil {
+			t.Errorf("%s: expected an error", q)
+		}
+	}
+}
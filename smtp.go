@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	smtpMaxSize     = 32 << 20
+	smtpMaxRcpts    = 1000
+	smtpIdleTimeout = 5 * time.Minute
+)
+
+// Minimal SMTP server (RFC 5321) delivering every message it accepts
+// into a Maildir, whatever the recipients.
+type smtpServer struct {
+	listen   string
+	hostname string
+	root     string
+	tls      *tls.Config
+	maxSize  int64
+}
+
+func newSMTPServer(listen, root string, tlsConf *tls.Config) *smtpServer {
+	return &smtpServer{
+		listen:   listen,
+		hostname: maildirHostname,
+		root:     root,
+		tls:      tlsConf,
+		maxSize:  smtpMaxSize,
+	}
+}
+
+func (s *smtpServer) run() error {
+	ln, err := net.Listen("tcp", s.listen)
+	if err != nil {
+		return err
+	}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Print("smtp: accept: ", err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go newSMTPSession(s, conn).serve()
+	}
+}
+
+type smtpSession struct {
+	server *smtpServer
+	conn   net.Conn
+	text   *textproto.Conn
+	helo   string
+	from   string
+	rcpts  []string
+	isTLS  bool
+}
+
+func newSMTPSession(s *smtpServer, conn net.Conn) *smtpSession {
+	return &smtpSession{
+		server: s,
+		conn:   conn,
+		text:   textproto.NewConn(conn),
+	}
+}
+
+func (s *smtpSession) reply(code int, format string, args ...interface{}) error {
+	s.conn.SetWriteDeadline(time.Now().Add(smtpIdleTimeout))
+	return s.text.PrintfLine("%d %s", code, fmt.Sprintf(format, args...))
+}
+
+func (s *smtpSession) reset() {
+	s.from = ""
+	s.rcpts = nil
+}
+
+func (s *smtpSession) serve() {
+	defer s.conn.Close()
+
+	if err := s.reply(220, "%s ESMTP perso", s.server.hostname); err != nil {
+		return
+	}
+
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(smtpIdleTimeout))
+		line, err := s.text.ReadLine()
+		if err != nil {
+			if err != io.EOF {
+				log.Print("smtp: ", s.conn.RemoteAddr(), ": ", err)
+			}
+			return
+		}
+
+		verb, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			verb, arg = line[:i], strings.TrimSpace(line[i+1:])
+		}
+
+		var quit bool
+		switch strings.ToUpper(verb) {
+		case "HELO":
+			err = s.cmdHelo(arg, false)
+		case "EHLO":
+			err = s.cmdHelo(arg, true)
+		case "STARTTLS":
+			err = s.cmdStartTLS()
+		case "MAIL":
+			err = s.cmdMail(arg)
+		case "RCPT":
+			err = s.cmdRcpt(arg)
+		case "DATA":
+			err = s.cmdData()
+		case "RSET":
+			s.reset()
+			err = s.reply(250, "OK")
+		case "NOOP":
+			err = s.reply(250, "OK")
+		case "VRFY":
+			err = s.reply(252, "Cannot VRFY user")
+		case "QUIT":
+			s.reply(221, "Bye")
+			quit = true
+		default:
+			err = s.reply(500, "Command not recognized")
+		}
+		if err != nil {
+			log.Print("smtp: ", s.conn.RemoteAddr(), ": ", err)
+			return
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+func (s *smtpSession) cmdHelo(arg string, extended bool) error {
+	if arg == "" {
+		return s.reply(501, "Domain name required")
+	}
+	s.helo = arg
+	s.reset()
+
+	if !extended {
+		return s.reply(250, "%s", s.server.hostname)
+	}
+
+	lines := []string{
+		s.server.hostname,
+		"PIPELINING",
+		"8BITMIME",
+		fmt.Sprintf("SIZE %d", s.server.maxSize),
+	}
+	if s.server.tls != nil && !s.isTLS {
+		lines = append(lines, "STARTTLS")
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(smtpIdleTimeout))
+	for i, l := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+		if err := s.text.PrintfLine("250%s%s", sep, l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *smtpSession) cmdStartTLS() error {
+	if s.server.tls == nil || s.isTLS {
+		return s.reply(502, "TLS not available")
+	}
+	if err := s.reply(220, "Ready to start TLS"); err != nil {
+		return err
+	}
+
+	conn := tls.Server(s.conn, s.server.tls)
+	conn.SetDeadline(time.Now().Add(smtpIdleTimeout))
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+
+	// Forget everything known before the handshake (RFC 3207, 4.2)
+	s.conn = conn
+	s.text = textproto.NewConn(conn)
+	s.isTLS = true
+	s.helo = ""
+	s.reset()
+	return nil
+}
+
+// Extract the address from "FROM:<addr> PARAMS" or "TO:<addr> PARAMS"
+func smtpPath(arg, prefix string) (string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", false
+	}
+	arg = strings.TrimSpace(arg[len(prefix):])
+	if !strings.HasPrefix(arg, "<") {
+		return "", false
+	}
+	end := strings.IndexByte(arg, '>')
+	if end < 0 {
+		return "", false
+	}
+	return arg[1:end], true
+}
+
+func (s *smtpSession) cmdMail(arg string) error {
+	if s.helo == "" {
+		return s.reply(503, "Send HELO/EHLO first")
+	}
+	if s.from != "" {
+		return s.reply(503, "Sender already specified")
+	}
+	from, ok := smtpPath(arg, "FROM:")
+	if !ok {
+		return s.reply(501, "Syntax: MAIL FROM:<address>")
+	}
+	if from == "" {
+		// Null reverse-path of bounces
+		from = "<>"
+	}
+	s.from = from
+	return s.reply(250, "OK")
+}
+
+func (s *smtpSession) cmdRcpt(arg string) error {
+	if s.from == "" {
+		return s.reply(503, "Send MAIL first")
+	}
+	rcpt, ok := smtpPath(arg, "TO:")
+	if !ok || rcpt == "" {
+		return s.reply(501, "Syntax: RCPT TO:<address>")
+	}
+	if len(s.rcpts) >= smtpMaxRcpts {
+		return s.reply(452, "Too many recipients")
+	}
+	s.rcpts = append(s.rcpts, rcpt)
+	return s.reply(250, "OK")
+}
+
+func (s *smtpSession) received() string {
+	var b bytes.Buffer
+	from := s.from
+	if from == "<>" {
+		from = ""
+	}
+	proto := "ESMTP"
+	if s.isTLS {
+		proto = "ESMTPS"
+	}
+	fmt.Fprintf(&b, "Return-Path: <%s>\n", from)
+	fmt.Fprintf(&b, "Received: from %s (%s)\n\tby %s (perso) with %s;\n\t%s\n",
+		s.helo, s.conn.RemoteAddr(), s.server.hostname, proto, time.Now().Format(time.RFC1123Z))
+	return b.String()
+}
+
+func (s *smtpSession) cmdData() error {
+	if len(s.rcpts) == 0 {
+		return s.reply(503, "Send RCPT first")
+	}
+	if err := s.reply(354, "End data with <CR><LF>.<CR><LF>"); err != nil {
+		return err
+	}
+
+	s.conn.SetReadDeadline(time.Now().Add(smtpIdleTimeout))
+	dot := s.text.DotReader()
+	body := &sizeLimitReader{r: dot, left: s.server.maxSize}
+	file, err := maildirDeliver(s.server.root, io.MultiReader(strings.NewReader(s.received()), body))
+
+	// Read the rest of the message in any case, or the protocol gets out of sync
+	if _, derr := io.Copy(ioutil.Discard, dot); derr != nil {
+		return derr
+	}
+	defer s.reset()
+
+	switch err {
+	case nil:
+	case errMessageTooLarge:
+		return s.reply(552, "Message exceeds fixed maximum message size")
+	default:
+		log.Print("smtp: cannot deliver message: ", err)
+		return s.reply(451, "Local error in processing")
+	}
+
+	return s.reply(250, "OK: queued as %s", filepath.Base(file))
+}
+
+var errMessageTooLarge = errors.New("Message too large")
+
+// Fails reading more than left bytes from r
+type sizeLimitReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (l *sizeLimitReader) Read(b []byte) (int, error) {
+	n, err := l.r.Read(b)
+	l.left -= int64(n)
+	if l.left < 0 {
+		return n, errMessageTooLarge
+	}
+	return n, err
+}
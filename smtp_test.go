@@ -0,0 +1,160 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// A client connected to a session of server, and the end of the session
+type smtpTestClient struct {
+	t    *testing.T
+	text *textproto.Conn
+	done chan struct{}
+}
+
+func newSMTPTestClient(t *testing.T, s *smtpServer) *smtpTestClient {
+	client, conn := net.Pipe()
+	c := &smtpTestClient{t: t, text: textproto.NewConn(client), done: make(chan struct{})}
+	go func() {
+		newSMTPSession(s, conn).serve()
+		close(c.done)
+	}()
+	c.expect(220)
+	return c
+}
+
+// Send a command and check the code of the response
+func (c *smtpTestClient) cmd(line string, code int) string {
+	c.t.Helper()
+	if err := c.text.PrintfLine("%s", line); err != nil {
+		c.t.Fatal(err)
+	}
+	return c.expect(code)
+}
+
+func (c *smtpTestClient) expect(code int) string {
+	c.t.Helper()
+	_, msg, err := c.text.ReadResponse(code)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return msg
+}
+
+// Send the message after DATA, dot-stuffed
+func (c *smtpTestClient) data(msg string, code int) string {
+	c.t.Helper()
+	c.cmd("DATA", 354)
+	w := c.text.DotWriter()
+	if _, err := w.Write([]byte(msg)); err != nil {
+		c.t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		c.t.Fatal(err)
+	}
+	return c.expect(code)
+}
+
+func (c *smtpTestClient) quit() {
+	c.t.Helper()
+	c.cmd("QUIT", 221)
+	<-c.done
+}
+
+// Messages delivered into the Maildir dir
+func smtpDelivered(t *testing.T, dir string) []string {
+	names, err := filepath.Glob(filepath.Join(dir, "new", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs := make([]string, len(names))
+	for i, name := range names {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs[i] = string(data)
+	}
+	return msgs
+}
+
+func TestSMTPSession(t *testing.T) {
+	dir, err := ioutil.TempDir("", "perso-smtp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	server := newSMTPServer("", dir, nil)
+	server.maxSize = 1024
+
+	c := newSMTPTestClient(t, server)
+	if ehlo := c.cmd("EHLO client.example.com", 250); !strings.Contains(ehlo, "SIZE 1024") || strings.Contains(ehlo, "STARTTLS") {
+		t.Error("unexpected extensions ", ehlo)
+	}
+	c.cmd("MAIL FROM:<bob@example.com> SIZE=100", 250)
+	c.cmd("RCPT TO:<alice@example.com>", 250)
+	c.cmd("RCPT TO:<carol@example.com>", 250)
+	if queued := c.data("Subject: hello\r\n\r\n.leading dot\r\nbody\r\n", 250); !strings.Contains(queued, "queued as ") {
+		t.Error("unexpected response ", queued)
+	}
+	c.quit()
+
+	msgs := smtpDelivered(t, dir)
+	if len(msgs) != 1 {
+		t.Fatalf("expected one message, got %d", len(msgs))
+	}
+	if !strings.HasPrefix(msgs[0], "Return-Path: <bob@example.com>\nReceived: from client.example.com ") {
+		t.Error("unexpected trace headers ", msgs[0])
+	}
+	if !strings.HasSuffix(msgs[0], "\nSubject: hello\n\n.leading dot\nbody\n") {
+		t.Error("message not unstuffed ", msgs[0])
+	}
+}
+
+func TestSMTPSessionErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "perso-smtp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	server := newSMTPServer("", dir, nil)
+	server.maxSize = 1024
+
+	// Commands in the wrong order
+	c := newSMTPTestClient(t, server)
+	c.cmd("MAIL FROM:<bob@example.com>", 503)
+	c.cmd("HELO", 501)
+	c.cmd("HELO client.example.com", 250)
+	c.cmd("RCPT TO:<alice@example.com>", 503)
+	c.cmd("DATA", 503)
+	c.cmd("MAIL TO:<bob@example.com>", 501)
+	c.cmd("MAIL FROM:<>", 250)
+	c.cmd("MAIL FROM:<bob@example.com>", 503)
+	c.cmd("RCPT TO:<>", 501)
+	c.cmd("DATA", 503)
+	c.cmd("STARTTLS", 502)
+	c.cmd("TURN", 500)
+
+	// Too large, then the session goes on
+	c.cmd("RCPT TO:<alice@example.com>", 250)
+	c.data("Subject: large\r\n\r\n"+strings.Repeat("line\r\n", 300), 552)
+	c.cmd("RCPT TO:<alice@example.com>", 503)
+	c.cmd("RSET", 250)
+	c.cmd("MAIL FROM:<>", 250)
+	c.cmd("RCPT TO:<alice@example.com>", 250)
+	c.data("Subject: small\r\n\r\nbody\r\n", 250)
+	c.quit()
+
+	msgs := smtpDelivered(t, dir)
+	if len(msgs) != 1 || !strings.HasPrefix(msgs[0], "Return-Path: <>\n") || !strings.Contains(msgs[0], "Subject: small") {
+		t.Error("expected only the small message, got ", msgs)
+	}
+	if tmp, _ := filepath.Glob(filepath.Join(dir, "tmp", "*")); len(tmp) != 0 {
+		t.Error("files left in tmp/ ", tmp)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"net/mail"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Headers used to put a message in a thread
+type threadRef struct {
+	messageID  string
+	references []string // Oldest first, the parent last
+	subject    string
+}
+
+// Message-IDs found in a header value, without angle brackets
+func parseMessageIDs(value string) []string {
+	ids := make([]string, 0)
+	for {
+		start := strings.IndexByte(value, '<')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(value[start:], '>')
+		if end < 0 {
+			break
+		}
+		if id := strings.TrimSpace(value[start+1 : start+end]); id != "" {
+			ids = append(ids, id)
+		}
+		value = value[start+end+1:]
+	}
+	return ids
+}
+
+func makeThreadRef(h mail.Header) threadRef {
+	var ref threadRef
+	if ids := parseMessageIDs(h.Get("Message-Id")); len(ids) > 0 {
+		ref.messageID = ids[0]
+	}
+	ref.references = parseMessageIDs(h.Get("References"))
+
+	// In-Reply-To is the parent if References is missing or incomplete
+	if ids := parseMessageIDs(h.Get("In-Reply-To")); len(ids) > 0 {
+		last := len(ref.references) - 1
+		if last < 0 || ref.references[last] != ids[0] {
+			ref.references = append(ref.references, ids[0])
+		}
+	}
+	ref.subject = decodeHeader(h.Get("Subject"))
+	return ref
+}
+
+// A message in a thread, or a message that is referenced but was not found.
+type threadContainer struct {
+	id       string
+	thread   string // Identifier of the thread if this is its root
+	file     *mailFile
+	ref      threadRef
+	parent   *threadContainer
+	children []*threadContainer
+}
+
+func (c *threadContainer) root() *threadContainer {
+	for c.parent != nil {
+		c = c.parent
+	}
+	return c
+}
+
+// Whether c is d or one of its ancestors
+func (c *threadContainer) isAncestorOf(d *threadContainer) bool {
+	for ; d != nil; d = d.parent {
+		if d == c {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *threadContainer) unlink() {
+	if c.parent == nil {
+		return
+	}
+	siblings := c.parent.children
+	for i, s := range siblings {
+		if s == c {
+			c.parent.children = append(siblings[:i], siblings[i+1:]...)
+			break
+		}
+	}
+	c.parent = nil
+}
+
+func (c *threadContainer) link(child *threadContainer) {
+	child.unlink()
+	child.parent = c
+	c.children = append(c.children, child)
+}
+
+// Call fn for c and all containers below it
+func (c *threadContainer) walk(fn func(c *threadContainer)) {
+	fn(c)
+	for _, child := range c.children {
+		child.walk(fn)
+	}
+}
+
+// Identifier of a thread in URLs, from the Message-ID of its first message
+func threadID(rootID string) string {
+	sum := sha1.Sum([]byte(rootID))
+	return hex.EncodeToString(sum[:8])
+}
+
+type threadSummary struct {
+	ID       string    `json:"id"`
+	Subject  string    `json:"subject"`
+	Messages int       `json:"messages"`
+	Date     time.Time `json:"date"` // Of the latest message
+}
+
+// Messages linked in threads following the algorithm by Jamie Zawinski
+// (https://www.jwz.org/doc/threading.html), without grouping by subject.
+// Only used from the caches goroutine.
+type threadIndex struct {
+	containers map[string]*threadContainer
+	threads    map[string]*threadContainer // By thread identifier
+	files      map[mailFile]*threadContainer
+}
+
+func newThreadIndex() *threadIndex {
+	return &threadIndex{
+		containers: make(map[string]*threadContainer),
+		threads:    make(map[string]*threadContainer),
+		files:      make(map[mailFile]*threadContainer),
+	}
+}
+
+func (t *threadIndex) container(id string) *threadContainer {
+	c, found := t.containers[id]
+	if !found {
+		c = &threadContainer{id: id, thread: threadID(id)}
+		t.containers[id] = c
+		t.threads[c.thread] = c
+	}
+	return c
+}
+
+func (t *threadIndex) add(file mailFile, ref threadRef) {
+	id := ref.messageID
+	if id == "" {
+		id = "\x00" + file.filename()
+	}
+	c := t.container(id)
+	if c.file != nil {
+		// Same Message-ID as another message, like a copy in another mailbox
+		c = t.container(id + "\x00" + file.filename())
+	}
+	c.file = &file
+	c.ref = ref
+	t.files[file] = c
+
+	// Each reference is the parent of the next one, unless already linked elsewhere
+	var parent *threadContainer
+	for _, r := range ref.references {
+		if r == ref.messageID {
+			continue
+		}
+		rc := t.container(r)
+		if parent != nil && rc.parent == nil && !rc.isAncestorOf(parent) {
+			parent.link(rc)
+		}
+		parent = rc
+	}
+
+	// The last reference is the parent of this message
+	if parent != nil && !c.isAncestorOf(parent) {
+		parent.link(c)
+	}
+}
+
+// Forget a message. Its thread is built again from the remaining messages,
+// as they might have been linked only through the removed one.
+func (t *threadIndex) remove(file mailFile) {
+	c, found := t.files[file]
+	if !found {
+		return
+	}
+
+	rest := newMailFiles()
+	refs := make(map[mailFile]threadRef)
+	c.root().walk(func(c *threadContainer) {
+		if t.containers[c.id] == c {
+			delete(t.containers, c.id)
+		}
+		if t.threads[c.thread] == c {
+			delete(t.threads, c.thread)
+		}
+		if c.file == nil {
+			return
+		}
+		delete(t.files, *c.file)
+		if *c.file != file {
+			rest = append(rest, *c.file)
+			refs[*c.file] = c.ref
+		}
+	})
+
+	sort.Sort(rest)
+	for _, f := range rest {
+		t.add(f, refs[f])
+	}
+}
+
+// Identifier of the thread of a message
+func (t *threadIndex) thread(file mailFile) (string, bool) {
+	c, found := t.files[file]
+	if !found {
+		return "", false
+	}
+	return c.root().thread, true
+}
+
+// Messages in the thread with identifier id
+func (t *threadIndex) messages(id string) mailFiles {
+	files := newMailFiles()
+	c, found := t.threads[id]
+	if !found || c.parent != nil {
+		return files
+	}
+	c.walk(func(c *threadContainer) {
+		if c.file != nil {
+			files = append(files, *c.file)
+		}
+	})
+	return files
+}
+
+// All threads with messages in mailbox (if not empty) dated between since
+// and until, the most recent first.
+func (t *threadIndex) list(mailbox string, since, until time.Time) []threadSummary {
+	threads := make([]threadSummary, 0)
+	for _, root := range t.containers {
+		if root.parent != nil {
+			continue
+		}
+		var (
+			ts      = threadSummary{ID: root.thread}
+			first   mailFile
+			matches bool
+		)
+		root.walk(func(c *threadContainer) {
+			if c.file == nil {
+				return
+			}
+			f := *c.file
+			ts.Messages++
+			if ts.Messages == 1 || f.before(first) {
+				first = f
+				ts.Subject = c.ref.subject
+			}
+			if f.date.After(ts.Date) {
+				ts.Date = f.date
+			}
+			if (mailbox == "" || f.folder == mailbox) && f.between(since, until) {
+				matches = true
+			}
+		})
+		if matches {
+			threads = append(threads, ts)
+		}
+	}
+	sort.Slice(threads, func(i, j int) bool {
+		if !threads[i].Date.Equal(threads[j].Date) {
+			return threads[i].Date.After(threads[j].Date)
+		}
+		return threads[i].ID < threads[j].ID
+	})
+	return threads
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestThreadRef(t *testing.T) {
+	msg, err := mail.ReadMessage(strings.NewReader("Message-ID: <c@x>\r\n" +
+		"References: <a@x>\r\n <b@x>\r\nIn-Reply-To: <b@x> (reply)\r\nSubject: Re: hi\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := makeThreadRef(msg.Header)
+	if ref.messageID != "c@x" || strings.Join(ref.references, " ") != "a@x b@x" || ref.subject != "Re: hi" {
+		t.Errorf("unexpected thread headers: %+v", ref)
+	}
+}
+
+func TestThreads(t *testing.T) {
+	base := time.Date(2017, 7, 17, 10, 0, 0, 0, time.UTC)
+	file := func(name string, i int) mailFile {
+		return mailFile{file: name, date: base.Add(time.Duration(i) * time.Minute)}
+	}
+	a, b, c, d := file("a", 0), file("b", 1), file("c", 2), file("d", 3)
+
+	threads := newThreadIndex()
+	// The reply arrives before the message it replies to
+	threads.add(c, threadRef{messageID: "c", references: []string{"a", "b"}})
+	threads.add(a, threadRef{messageID: "a", subject: "Hello"})
+	threads.add(b, threadRef{messageID: "b", references: []string{"a"}})
+	threads.add(d, threadRef{messageID: "d", references: []string{"x"}})
+
+	id, _ := threads.thread(a)
+	for _, f := range []mailFile{b, c} {
+		if tid, _ := threads.thread(f); tid != id {
+			t.Errorf("%s is not in the thread of a", f.file)
+		}
+	}
+	if tid, _ := threads.thread(d); tid == id {
+		t.Error("d should be in another thread")
+	}
+
+	list := threads.list("", time.Time{}, time.Time{})
+	if len(list) != 2 || list[1].ID != id || list[1].Messages != 3 || list[1].Subject != "Hello" {
+		t.Errorf("unexpected threads: %+v", list)
+	}
+	if files := threads.messages(id); len(files) != 3 {
+		t.Errorf("expected three messages in thread, got %v", files)
+	}
+	if files := threads.messages(threadID("b")); len(files) != 0 {
+		t.Errorf("expected no thread for a reply, got %v", files)
+	}
+
+	// c still references a through b
+	threads.remove(b)
+	threads.remove(a)
+	if tid, _ := threads.thread(c); tid != id {
+		t.Error("c left its thread after removing its parents")
+	}
+	if files := threads.messages(id); len(files) != 1 || files[0] != c {
+		t.Errorf("unexpected messages in thread: %v", files)
+	}
+
+	threads.remove(c)
+	threads.remove(d)
+	if len(threads.containers) != 0 || len(threads.threads) != 0 {
+		t.Errorf("containers left: %v", threads.threads)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// How often certificate files are checked for changes, at most
+const certCheckInterval = 10 * time.Second
+
+// A certificate and its key, loaded again when their files change
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time // Of the newest of the two files when loaded
+	checked time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	modTime, err := c.modified()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.load(modTime); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Modification time of the newest of the two files
+func (c *certReloader) modified() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (c *certReloader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.cert = &cert
+	c.modTime = modTime
+	c.checked = time.Now()
+	return nil
+}
+
+// Use as tls.Config.GetCertificate. If the new files cannot be loaded,
+// for example because only one of them was replaced yet, the previous
+// certificate is used until they can.
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.checked) < certCheckInterval {
+		return c.cert, nil
+	}
+	c.checked = time.Now()
+	modTime, err := c.modified()
+	if err != nil {
+		log.Print(c.certFile, ": cannot check certificate: ", err)
+		return c.cert, nil
+	}
+	if !modTime.Equal(c.modTime) {
+		if err := c.load(modTime); err != nil {
+			log.Print(c.certFile, ": cannot load new certificate: ", err)
+		} else {
+			log.Print(c.certFile, ": certificate loaded again")
+		}
+	}
+	return c.cert, nil
+}
+
+// TLS configuration of the HTTP server. With a client CA, clients can
+// present a certificate signed by it to authenticate.
+func newTLSConfig(certFile, keyFile, clientCA string) (*tls.Config, error) {
+	certs, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	conf := &tls.Config{
+		GetCertificate: certs.getCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if clientCA != "" {
+		pem, err := ioutil.ReadFile(clientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New(clientCA + ": no certificates found")
+		}
+		conf.ClientCAs = pool
+		conf.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return conf, nil
+}
+
+// Server redirecting all plain HTTP requests to the HTTPS server on tlsAddr.
+// Other methods than GET and HEAD are redirected with 308, so that clients
+// send them again unchanged, with their body.
+func newRedirectServer(addr, tlsAddr string) *http.Server {
+	_, port, _ := net.SplitHostPort(tlsAddr)
+	return &http.Server{
+		Addr:         addr,
+		WriteTimeout: 15 * time.Second,
+		ReadTimeout:  15 * time.Second,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			host, _, err := net.SplitHostPort(r.Host)
+			if err != nil {
+				host = r.Host
+			}
+			if port != "" && port != "443" {
+				host = net.JoinHostPort(host, port)
+			}
+			url := "https://" + host + r.URL.RequestURI()
+			code := http.StatusMovedPermanently
+			if r.Method != "GET" && r.Method != "HEAD" {
+				code = http.StatusPermanentRedirect
+			}
+			http.Redirect(w, r, url, code)
+		}),
+	}
+}
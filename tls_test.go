@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A self-signed certificate and its key, in PEM
+func testCertificate(t *testing.T, name string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "perso-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	// Files written at a later time, as their times are compared
+	mtime := time.Now()
+	write := func(name string, data []byte) {
+		if err := ioutil.WriteFile(name, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		mtime = mtime.Add(time.Minute)
+		if err := os.Chtimes(name, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cert := func(c *certReloader, expected []byte, when string) {
+		// Files are checked again after certCheckInterval
+		c.mu.Lock()
+		c.checked = time.Time{}
+		c.mu.Unlock()
+		got, err := c.getCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block, _ := pem.Decode(expected)
+		if !bytes.Equal(got.Certificate[0], block.Bytes) {
+			t.Errorf("%s: unexpected certificate", when)
+		}
+	}
+
+	oldCert, oldKey := testCertificate(t, "old.example.com")
+	write(certFile, oldCert)
+	write(keyFile, oldKey)
+	c, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert(c, oldCert, "loaded")
+
+	newCert, newKey := testCertificate(t, "new.example.com")
+	write(certFile, newCert)
+	cert(c, oldCert, "only the certificate replaced")
+	write(keyFile, newKey[:len(newKey)/2])
+	cert(c, oldCert, "key half written")
+	write(keyFile, newKey)
+	cert(c, newCert, "both replaced")
+}
+
+func TestRedirectServer(t *testing.T) {
+	s := newRedirectServer(":80", ":8443")
+	for method, code := range map[string]int{"GET": 301, "HEAD": 301, "POST": 308, "DELETE": 308} {
+		w := httptest.NewRecorder()
+		s.Handler.ServeHTTP(w, httptest.NewRequest(method, "http://example.com/messages?x=1", nil))
+		if w.Code != code {
+			t.Errorf("%s: expected %d, got %d", method, code, w.Code)
+		}
+		if loc := w.Header().Get("Location"); loc != "https://example.com:8443/messages?x=1" {
+			t.Errorf("%s: unexpected location %s", method, loc)
+		}
+	}
+}
@@ -3,8 +3,10 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"html"
 	"io"
 	"net/url"
+	"sort"
 )
 
 type templateWriter interface {
@@ -54,6 +56,7 @@ func (t *template) render(w io.Writer, tw templateWriter) error {
 }
 
 type listTemplate struct {
+	prefix string
 	header string
 	values []string
 }
@@ -76,8 +79,85 @@ func (l *listTemplate) writeContent(w io.Writer) error {
 	}
 
 	for _, val := range l.values {
-		if _, err := fmt.Fprintf(w, `<li><a href="/%s/%s/latest/0">%s</a></li>`,
-			url.QueryEscape(l.header), url.QueryEscape(val), val); err != nil {
+		if _, err := fmt.Fprintf(w, `<li><a href="%s/%s/%s/latest/0">%s</a></li>`,
+			l.prefix, url.QueryEscape(l.header), url.QueryEscape(val), val); err != nil {
+			return err
+		}
+	}
+
+	if _, err := fmt.Fprintln(w, "</ul>"); err != nil {
+		return err
+	}
+	return nil
+}
+
+type mailboxesTemplate struct {
+	names  []string
+	counts map[string]int
+}
+
+func newMailboxesTemplate(counts map[string]int) *mailboxesTemplate {
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return &mailboxesTemplate{names: names, counts: counts}
+}
+
+func (m *mailboxesTemplate) writeTitle(w io.Writer) error {
+	if _, err := fmt.Fprint(w, "Perso - Mailboxes"); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (m *mailboxesTemplate) writeContent(w io.Writer) error {
+	if _, err := fmt.Fprintln(w, "<ul>"); err != nil {
+		return err
+	}
+
+	for _, name := range m.names {
+		if _, err := fmt.Fprintf(w, `<li><a href="/mbox/%s/latest/0">%s</a> (%d)</li>`,
+			url.PathEscape(name), html.EscapeString(name), m.counts[name]); err != nil {
+			return err
+		}
+	}
+
+	if _, err := fmt.Fprintln(w, "</ul>"); err != nil {
+		return err
+	}
+	return nil
+}
+
+type threadsTemplate struct {
+	prefix  string
+	threads []threadSummary
+}
+
+func newThreadsTemplate(threads []threadSummary) *threadsTemplate {
+	return &threadsTemplate{threads: threads}
+}
+
+func (t *threadsTemplate) writeTitle(w io.Writer) error {
+	if _, err := fmt.Fprint(w, "Perso - Threads"); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (t *threadsTemplate) writeContent(w io.Writer) error {
+	if _, err := fmt.Fprintln(w, "<ul>"); err != nil {
+		return err
+	}
+
+	for _, th := range t.threads {
+		subject := th.Subject
+		if subject == "" {
+			subject = "(no subject)"
+		}
+		if _, err := fmt.Fprintf(w, `<li><a href="%s/threads/%s/oldest/0,%d">%s</a> (%d)</li>`,
+			t.prefix, th.ID, th.Messages, html.EscapeString(subject), th.Messages); err != nil {
 			return err
 		}
 	}